@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/bytedance/sonic"
 	"strings"
+	"time"
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/spf13/viper"
@@ -25,6 +26,18 @@ type Config struct {
 	LogLevel        string `default:"DEBUG"`
 	MessageGPool    int    `default:"10000"`
 	ConnectionGPool int    `default:"15000"`
+	// RouteWatchInterval 检查route.json变化的间隔，为0时关闭热加载
+	RouteWatchInterval time.Duration `default:"10s"`
+	// ResumeWindow 断线后保留会话等待重连的时长，为0时关闭断线恢复
+	ResumeWindow time.Duration `default:"30s"`
+	// ResumeBufferSize 每个channel缓存的最近下行消息数
+	ResumeBufferSize int `default:"100"`
+	// PushAckTimeout 推送消息等待客户端确认的时间，超时后重传并翻倍，为0时关闭重传
+	PushAckTimeout time.Duration `default:"3s"`
+	// PushRetries 推送消息的最大重传次数，超过后回退到离线同步
+	PushRetries int `default:"3"`
+	// SessionRenewInterval 为在线channel续期会话的间隔，需要小于Login服务的会话租约
+	SessionRenewInterval time.Duration `default:"1m"`
 }
 
 func (c Config) String() string {
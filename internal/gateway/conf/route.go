@@ -2,6 +2,8 @@ package conf
 
 import (
 	"X_IM/pkg/logger"
+	"errors"
+	"fmt"
 	"github.com/bytedance/sonic"
 	"os"
 )
@@ -9,6 +11,8 @@ import (
 type Zone struct {
 	ID     string
 	Weight int
+	// Failover 当前zone没有可用服务时，按顺序尝试的备用zone
+	Failover []string
 }
 
 type Route struct {
@@ -16,6 +20,8 @@ type Route struct {
 	Zones     []Zone
 	Whitelist map[string]string
 	Slots     []int
+	// Failover zone ID -> 备用zone链
+	Failover map[string][]string
 }
 
 func ReadRoute(path string) (*Route, error) {
@@ -44,6 +50,7 @@ func ReadRoute(path string) (*Route, error) {
 		Zones:     conf.Zones,
 		Whitelist: make(map[string]string, len(conf.Whitelist)),
 		Slots:     make([]int, 0),
+		Failover:  make(map[string][]string, len(conf.Zones)),
 	}
 	// build slots
 	for i, zone := range conf.Zones {
@@ -55,10 +62,16 @@ func ReadRoute(path string) (*Route, error) {
 		}
 		// 2. 追加到Slots中
 		rt.Slots = append(rt.Slots, shard...)
+		if len(zone.Failover) > 0 {
+			rt.Failover[zone.ID] = zone.Failover
+		}
 	}
 	for _, wl := range conf.Whitelist {
 		rt.Whitelist[wl.Key] = wl.Value
 	}
+	if err = rt.Validate(); err != nil {
+		return nil, err
+	}
 	logger.WithFields(logger.Fields{
 		"service": "gateway",
 		"pkg":     "conf",
@@ -66,3 +79,42 @@ func ReadRoute(path string) (*Route, error) {
 	}).Infoln("from route.json: ", rt)
 	return &rt, nil
 }
+
+// Validate 检查路由配置是否可用，热加载时校验失败则继续使用旧配置
+func (r *Route) Validate() error {
+	if len(r.Zones) == 0 {
+		return errors.New("route: no zones configured")
+	}
+	zones := make(map[string]struct{}, len(r.Zones))
+	for _, zone := range r.Zones {
+		if zone.ID == "" {
+			return errors.New("route: zone id is empty")
+		}
+		if zone.Weight < 0 {
+			return fmt.Errorf("route: weight of zone %s is negative", zone.ID)
+		}
+		if _, ok := zones[zone.ID]; ok {
+			return fmt.Errorf("route: zone %s is duplicated", zone.ID)
+		}
+		zones[zone.ID] = struct{}{}
+	}
+	if len(r.Slots) == 0 {
+		return errors.New("route: total weight of zones is zero")
+	}
+	for id, chain := range r.Failover {
+		for _, zone := range chain {
+			if zone == id {
+				return fmt.Errorf("route: zone %s fails over to itself", id)
+			}
+			if _, ok := zones[zone]; !ok {
+				return fmt.Errorf("route: failover of zone %s refers to unknown zone %s", id, zone)
+			}
+		}
+	}
+	for app, zone := range r.Whitelist {
+		if _, ok := zones[zone]; !ok {
+			return fmt.Errorf("route: whitelist %s refers to unknown zone %s", app, zone)
+		}
+	}
+	return nil
+}
@@ -16,6 +16,9 @@ import (
 const (
 	MetaKeyApp     = "app"
 	MetaKeyAccount = "account"
+
+	// renewBatch 每个续期包包含的channel数
+	renewBatch = 500
 )
 
 var log = logger.WithFields(logger.Fields{
@@ -26,6 +29,8 @@ var log = logger.WithFields(logger.Fields{
 type Handler struct {
 	ServiceID string
 	AppSecret string
+	// Resumer 为nil时不支持断线恢复
+	Resumer *Resumer
 }
 
 // Accept this connection
@@ -73,17 +78,49 @@ func (h *Handler) Accept(conn x.Conn, timeout time.Duration) (string, x.Meta, er
 
 		return "", nil, err
 	}
+	meta := x.Meta{
+		MetaKeyApp:     tk.App,
+		MetaKeyAccount: tk.Account,
+	}
+	// 断线重连，宽限期内直接恢复原来的channel，不再转发给Login服务
+	if h.Resumer != nil && login.ResumeToken != "" {
+		if id, ok := h.Resumer.Resume(login.ResumeToken, tk.Account, login.LastSeq); ok {
+			l.Infof("resume %v channel:%s from seq %d", tk, id, login.LastSeq)
+			resp := pkt.NewFrom(&req.Header)
+			resp.ChannelID = id
+			resp.Flag = pkt.Flag_Response
+			resp.WriteBody(&pkt.LoginResp{
+				ChannelID:   id,
+				Account:     tk.Account,
+				ResumeToken: login.ResumeToken,
+				Resumed:     true,
+			})
+			if err = conn.WriteFrame(x.OpBinary, pkt.Marshal(resp)); err != nil {
+				// channel不会加入网关，恢复宽限期计时，到期后正常登出
+				h.Resumer.Abort(id)
+				return "", nil, err
+			}
+			return id, meta, nil
+		}
+		l.Infof("resume token of %s is invalid or expired", tk.Account)
+	}
 	//6.生成全局唯一的ChannelID
 	id := generateChannelID(h.ServiceID, tk.Account)
 	l.Infof("accept %v channel:%s", tk, id)
 
+	var resumeToken string
+	if h.Resumer != nil {
+		resumeToken = h.Resumer.Open(id, meta)
+	}
 	req.ChannelID = id
 	req.WriteBody(&pkt.Session{
-		Account:   tk.Account,
-		ChannelID: id,
-		GateID:    h.ServiceID,
-		App:       tk.App,
-		RemoteIP:  getIP(conn.RemoteAddr().String()),
+		Account:     tk.Account,
+		ChannelID:   id,
+		GateID:      h.ServiceID,
+		App:         tk.App,
+		Device:      login.Device,
+		RemoteIP:    getIP(conn.RemoteAddr().String()),
+		ResumeToken: resumeToken,
 	})
 	req.AddStringMeta(MetaKeyApp, tk.App)
 	req.AddStringMeta(MetaKeyAccount, tk.Account)
@@ -92,12 +129,19 @@ func (h *Handler) Accept(conn x.Conn, timeout time.Duration) (string, x.Meta, er
 	err = container.Forward(common.SNLogin, req)
 	if err != nil {
 		l.Errorf("container.Forward :%v", err)
+		if h.Resumer != nil {
+			h.Resumer.Close(id)
+		}
 		return "", nil, err
 	}
-	return id, x.Meta{
-		MetaKeyApp:     tk.App,
-		MetaKeyAccount: tk.Account,
-	}, nil
+	return id, meta, nil
+}
+
+// Connect channel已加入网关，下发登录前缓存的消息或重连时需要重放的消息
+func (h *Handler) Connect(id string) {
+	if h.Resumer != nil {
+		h.Resumer.Attach(id)
+	}
 }
 
 // Receive default listener
@@ -120,6 +164,14 @@ func (h *Handler) Receive(ag x.Agent, payload []byte) {
 	//转发给逻辑服务处理
 	if logicPkt, ok := packet.(*pkt.LogicPkt); ok {
 		logicPkt.ChannelID = ag.ID()
+		//推送确认在网关处理
+		if logicPkt.Command == common.CommandPushAck {
+			var ack pkt.PushAckReq
+			if err = logicPkt.ReadBody(&ack); err == nil && h.Resumer != nil {
+				h.Resumer.Ack(ag.ID(), ack.Seq)
+			}
+			return
+		}
 
 		messageInTotal.WithLabelValues(h.ServiceID, common.SNTGateway, logicPkt.Command).Inc()
 		messageInFlowBytes.WithLabelValues(h.ServiceID, common.SNTGateway, logicPkt.Command).Add(float64(len(payload)))
@@ -143,9 +195,83 @@ func (h *Handler) Receive(ag x.Agent, payload []byte) {
 }
 
 // Disconnect 登出的逻辑，SDK不需要发送协议包，正常断开连接或者心跳超时等情况时网关就会发出连接断开通知
+// 开启断线恢复时，宽限期结束仍未重连才发出登出通知
 func (h *Handler) Disconnect(id string) error {
 	log.Infof("disconnect id: %s", id)
 
+	if h.Resumer == nil {
+		signout(id)
+		return nil
+	}
+	h.Resumer.Detach(id, func() {
+		signout(id)
+	})
+	return nil
+}
+
+// Fallback 重传失败的聊天消息通知Chat服务，由离线同步兜底
+func (h *Handler) Fallback(channelID string, meta x.Meta, packets []*pkt.LogicPkt) {
+	var req pkt.MessageFallbackReq
+	for _, p := range packets {
+		if p.Command != common.CommandChatUserTalk && p.Command != common.CommandChatGroupTalk {
+			continue
+		}
+		var push pkt.MessagePush
+		if err := p.ReadBody(&push); err != nil {
+			continue
+		}
+		req.MessageIDs = append(req.MessageIDs, push.MessageID)
+	}
+	if len(req.MessageIDs) == 0 {
+		return
+	}
+	log.WithField("func", "Fallback").Infof("%d messages of %s fall back to offline sync", len(req.MessageIDs), channelID)
+	fallback := pkt.New(common.CommandChatTalkFallback, pkt.WithChannel(channelID))
+	fallback.WriteBody(&req)
+	fallback.AddStringMeta(MetaKeyApp, meta[MetaKeyApp])
+	fallback.AddStringMeta(MetaKeyAccount, meta[MetaKeyAccount])
+	err := container.Forward(fallback.ServiceName(), fallback)
+	if err != nil {
+		logger.WithFields(logger.Fields{
+			"module": "handler",
+			"id":     channelID,
+		}).Error(err)
+	}
+}
+
+// RenewSessions 定期为网关上的会话续期，直到stop被关闭
+func (h *Handler) RenewSessions(interval time.Duration, stop <-chan struct{}) {
+	if h.Resumer == nil || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			h.renew()
+		}
+	}
+}
+
+func (h *Handler) renew() {
+	leases := h.Resumer.Leases()
+	for i := 0; i < len(leases); i += renewBatch {
+		// 续期包不属于某个channel，使用网关的ServiceID
+		renew := pkt.New(common.CommandLoginRenew, pkt.WithChannel(h.ServiceID))
+		renew.WriteBody(&pkt.SessionRenewReq{
+			Leases: leases[i:min(i+renewBatch, len(leases))],
+		})
+		if err := container.Forward(common.SNLogin, renew); err != nil {
+			log.WithField("func", "renew").Error(err)
+			return
+		}
+	}
+}
+
+func signout(id string) {
 	logout := pkt.New(common.CommandLoginSignOut, pkt.WithChannel(id))
 	err := container.Forward(common.SNLogin, logout)
 	if err != nil {
@@ -154,7 +280,6 @@ func (h *Handler) Disconnect(id string) error {
 			"id":     id,
 		}).Error(err)
 	}
-	return nil
 }
 
 var ipExp = regexp.MustCompile(string("\\:[0-9]+$"))
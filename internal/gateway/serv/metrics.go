@@ -22,3 +22,40 @@ var noServerFoundErrorTotal = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name:      "no_server_found_error_total",
 	Help:      "查找zone分区中服务失败的次数",
 }, []string{"zone"})
+
+var routeReloadTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "x_im",
+	Name:      "route_reload_total",
+	Help:      "路由配置热加载次数",
+}, []string{"result"})
+
+var routeConfigVersion = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "x_im",
+	Name:      "route_config_version",
+	Help:      "当前生效的路由配置版本",
+})
+
+var zoneServedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "x_im",
+	Name:      "zone_served_total",
+	Help:      "按实际提供服务的zone统计的请求数",
+}, []string{"home", "zone"})
+
+var pushAckLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "x_im",
+	Name:      "push_ack_latency_seconds",
+	Help:      "推送消息从下发到客户端确认的耗时",
+	Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10, 30},
+})
+
+var pushRetransmitTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "x_im",
+	Name:      "push_retransmit_total",
+	Help:      "推送消息重传次数",
+})
+
+var pushFallbackTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "x_im",
+	Name:      "push_fallback_total",
+	Help:      "重传失败回退到离线同步的推送消息数",
+})
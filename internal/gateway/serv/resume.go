@@ -0,0 +1,385 @@
+package serv
+
+import (
+	"X_IM/pkg/timingwheel"
+	"X_IM/pkg/wire/common"
+	"X_IM/pkg/wire/pkt"
+	"X_IM/pkg/x"
+	"bytes"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+// FallbackFunc 推送重试失败或会话结束时仍未确认的消息
+type FallbackFunc func(channelID string, meta x.Meta, packets []*pkt.LogicPkt)
+
+// Resumer 包装网关的x.Server，为每个channel的下行消息打上delivery seq并缓存最近的消息。
+// 连接断开后会话保留一个宽限期，期间客户端携带resumeToken重连即可恢复原来的channel，
+// 并从客户端最后收到的seq之后重放消息，不需要重新登录和同步离线消息。
+// 开启重传后，Push类消息在客户端确认前按退避时间重发，超过重试次数交给FallbackFunc。
+type Resumer struct {
+	x.Server
+	window time.Duration
+	size   int
+	// channelID -> *resumable
+	sessions sync.Map
+	// resumeToken -> channelID
+	tokens sync.Map
+
+	ackTimeout time.Duration
+	retries    int
+	fallback   FallbackFunc
+}
+
+type delivery struct {
+	seq     uint32
+	payload []byte
+}
+
+// inflight 等待客户端确认的Push消息
+type inflight struct {
+	payload  []byte
+	sent     time.Time
+	attempts int
+	timer    *timingwheel.Timer
+}
+
+type resumable struct {
+	sync.Mutex
+	channelID string
+	meta      x.Meta
+	token     string
+	// live 表示channel已经加入网关的ChannelMap，可以直接下发
+	live bool
+	// from 下次Attach时从这个seq之后开始重放
+	from    uint32
+	seq     uint32
+	recent  []delivery
+	unacked map[uint32]*inflight
+	signout *timingwheel.Timer
+	// onSignout Detach时传入的登出任务，恢复握手失败时重新计时
+	onSignout func()
+}
+
+// NewResumer window为断线后保留会话的时长，size为每个channel缓存的消息数
+func NewResumer(srv x.Server, window time.Duration, size int) *Resumer {
+	return &Resumer{
+		Server: srv,
+		window: window,
+		size:   size,
+	}
+}
+
+// EnableRetransmit 开启Push消息的确认与重传，timeout为第一次重传前的等待时间，之后每次翻倍
+func (r *Resumer) EnableRetransmit(timeout time.Duration, retries int, fallback FallbackFunc) {
+	r.ackTimeout = timeout
+	r.retries = retries
+	r.fallback = fallback
+}
+
+// Open 登录时为channel创建可恢复的会话，返回resumeToken
+func (r *Resumer) Open(channelID string, meta x.Meta) string {
+	rs := &resumable{
+		channelID: channelID,
+		meta:      meta,
+		token:     ksuid.New().String(),
+		recent:    make([]delivery, 0, r.size),
+		unacked:   make(map[uint32]*inflight),
+	}
+	r.sessions.Store(channelID, rs)
+	r.tokens.Store(rs.token, channelID)
+	return rs.token
+}
+
+// Close 删除channel的会话，仍未确认的消息交给FallbackFunc
+func (r *Resumer) Close(channelID string) {
+	val, ok := r.sessions.LoadAndDelete(channelID)
+	if !ok {
+		return
+	}
+	rs := val.(*resumable)
+	r.tokens.Delete(rs.token)
+	rs.Lock()
+	if rs.signout != nil {
+		rs.signout.Stop()
+		rs.signout = nil
+	}
+	payloads := make([][]byte, 0, len(rs.unacked))
+	for seq, f := range rs.unacked {
+		f.timer.Stop()
+		payloads = append(payloads, f.payload)
+		delete(rs.unacked, seq)
+	}
+	rs.Unlock()
+	r.giveUp(rs, payloads...)
+}
+
+// Leases 返回网关上的所有会话，包括宽限期内断开的，用于续期
+func (r *Resumer) Leases() []*pkt.SessionLease {
+	leases := make([]*pkt.SessionLease, 0)
+	r.sessions.Range(func(_, val any) bool {
+		rs := val.(*resumable)
+		leases = append(leases, &pkt.SessionLease{
+			ChannelID: rs.channelID,
+			Account:   rs.meta[MetaKeyAccount],
+		})
+		return true
+	})
+	return leases
+}
+
+// Resume 校验resumeToken，成功时返回原来的channelID。
+// 会话必须处于断开状态、属于同一个账号，并且缓存中还保留着lastSeq之后的全部消息
+func (r *Resumer) Resume(token, account string, lastSeq uint32) (string, bool) {
+	id, ok := r.tokens.Load(token)
+	if !ok {
+		return "", false
+	}
+	val, ok := r.sessions.Load(id)
+	if !ok {
+		return "", false
+	}
+	rs := val.(*resumable)
+	rs.Lock()
+	defer rs.Unlock()
+	if rs.live || rs.signout == nil || rs.meta[MetaKeyAccount] != account {
+		return "", false
+	}
+	if lastSeq > rs.seq {
+		return "", false
+	}
+	if lastSeq < rs.seq && (len(rs.recent) == 0 || lastSeq+1 < rs.recent[0].seq) {
+		// 缓存已经溢出，无法完整重放
+		return "", false
+	}
+	if !rs.signout.Stop() {
+		// 宽限期已过，登出任务已经开始执行
+		return "", false
+	}
+	rs.signout = nil
+	rs.from = lastSeq
+	r.ack(rs, lastSeq)
+	return rs.channelID, true
+}
+
+// Attach channel加入ChannelMap之后调用，下发from之后缓存的消息并切换为直接下发
+func (r *Resumer) Attach(channelID string) {
+	val, ok := r.sessions.Load(channelID)
+	if !ok {
+		return
+	}
+	rs := val.(*resumable)
+	rs.Lock()
+	defer rs.Unlock()
+	for _, d := range rs.recent {
+		if d.seq <= rs.from {
+			continue
+		}
+		if err := r.Server.Push(channelID, d.payload); err != nil {
+			log.WithField("func", "Attach").Warn(err)
+		}
+	}
+	rs.live = true
+}
+
+// Detach channel断开时调用，宽限期内没有恢复则执行signout并删除会话
+func (r *Resumer) Detach(channelID string, signout func()) {
+	val, ok := r.sessions.Load(channelID)
+	if !ok || r.window <= 0 {
+		r.Close(channelID)
+		signout()
+		return
+	}
+	rs := val.(*resumable)
+	rs.Lock()
+	defer rs.Unlock()
+	rs.live = false
+	rs.onSignout = signout
+	rs.signout = r.afterWindow(channelID, signout)
+}
+
+// Abort Resume成功之后没能完成握手时调用，会话回到断开状态并重新开始宽限期计时，
+// 否则会话会一直留在Leases中续期，账号永远显示在线
+func (r *Resumer) Abort(channelID string) {
+	val, ok := r.sessions.Load(channelID)
+	if !ok {
+		return
+	}
+	rs := val.(*resumable)
+	rs.Lock()
+	defer rs.Unlock()
+	if rs.live || rs.signout != nil || rs.onSignout == nil {
+		return
+	}
+	rs.signout = r.afterWindow(channelID, rs.onSignout)
+}
+
+func (r *Resumer) afterWindow(channelID string, signout func()) *timingwheel.Timer {
+	return timingwheel.AfterFunc(r.window, func() {
+		r.Close(channelID)
+		signout()
+	})
+}
+
+// Ack 客户端确认seq及之前的下行消息
+func (r *Resumer) Ack(channelID string, seq uint32) {
+	val, ok := r.sessions.Load(channelID)
+	if !ok {
+		return
+	}
+	rs := val.(*resumable)
+	rs.Lock()
+	defer rs.Unlock()
+	r.ack(rs, seq)
+}
+
+func (r *Resumer) ack(rs *resumable, seq uint32) {
+	for s, f := range rs.unacked {
+		if s > seq {
+			continue
+		}
+		f.timer.Stop()
+		pushAckLatency.Observe(time.Since(f.sent).Seconds())
+		delete(rs.unacked, s)
+	}
+}
+
+// Push 重写x.Server的Push，打上delivery seq后缓存；channel在线时直接下发
+// 踢下线通知下发之后关闭对应的channel
+func (r *Resumer) Push(id string, data []byte) error {
+	packet, err := pkt.MustReadLogicPkt(bytes.NewBuffer(data))
+	if err != nil {
+		return r.Server.Push(id, data)
+	}
+	if val, ok := r.sessions.Load(id); ok {
+		err = r.push(val.(*resumable), packet)
+	} else {
+		err = r.Server.Push(id, data)
+	}
+	if isKickOut(id, packet) {
+		r.kick(id)
+	}
+	return err
+}
+
+func (r *Resumer) push(rs *resumable, packet *pkt.LogicPkt) error {
+	rs.Lock()
+	defer rs.Unlock()
+	// 临时信号不分配delivery seq，不缓存也不重传，channel不在线时直接丢弃
+	if isEphemeral(packet) {
+		if !rs.live {
+			return nil
+		}
+		return r.Server.Push(rs.channelID, pkt.Marshal(packet))
+	}
+	rs.seq++
+	seq := rs.seq
+	packet.AddMeta(&pkt.Meta{
+		Key:   common.MetaDeliverySeq,
+		Value: strconv.FormatUint(uint64(seq), 10),
+		Type:  pkt.MetaType_int,
+	})
+	payload := pkt.Marshal(packet)
+	if len(rs.recent) == r.size && r.size > 0 {
+		rs.recent = append(rs.recent[:0], rs.recent[1:]...)
+	}
+	if r.size > 0 {
+		rs.recent = append(rs.recent, delivery{seq: seq, payload: payload})
+	}
+	if r.ackTimeout > 0 && packet.Flag == pkt.Flag_Push {
+		rs.unacked[seq] = &inflight{
+			payload: payload,
+			sent:    time.Now(),
+			timer: timingwheel.AfterFunc(r.ackTimeout, func() {
+				r.retransmit(rs, seq)
+			}),
+		}
+	}
+	if !rs.live {
+		return nil
+	}
+	return r.Server.Push(rs.channelID, payload)
+}
+
+// kick 被踢下线的会话不能再恢复；channel关闭时会先写完已经下发的通知
+func (r *Resumer) kick(id string) {
+	log.WithField("func", "kick").Infof("channel %s is kicked out", id)
+	r.Close(id)
+	// DefaultServer内嵌了ChannelMap
+	channels, ok := r.Server.(x.ChannelMap)
+	if !ok {
+		return
+	}
+	if ch, ok := channels.Get(id); ok {
+		_ = ch.Close()
+	}
+}
+
+// isKickOut 登录服务通过login.signin的Push消息通知旧的channel下线
+func isKickOut(id string, packet *pkt.LogicPkt) bool {
+	if packet.Command != common.CommandLoginSignIn || packet.Flag != pkt.Flag_Push {
+		return false
+	}
+	var notify pkt.KickOutNotify
+	if err := packet.ReadBody(&notify); err != nil {
+		return false
+	}
+	return notify.ChannelID == id
+}
+
+// isEphemeral 正在输入等临时信号只对在线的channel有意义
+func isEphemeral(packet *pkt.LogicPkt) bool {
+	if packet.Flag != pkt.Flag_Push {
+		return false
+	}
+	return packet.Command == common.CommandChatUserSignal || packet.Command == common.CommandChatGroupSignal
+}
+
+// retransmit 重传未确认的消息，断开期间只顺延不计入重试次数
+func (r *Resumer) retransmit(rs *resumable, seq uint32) {
+	rs.Lock()
+	f, ok := rs.unacked[seq]
+	if !ok {
+		rs.Unlock()
+		return
+	}
+	if rs.live && f.attempts >= r.retries {
+		delete(rs.unacked, seq)
+		rs.Unlock()
+		r.giveUp(rs, f.payload)
+		return
+	}
+	if rs.live {
+		f.attempts++
+		pushRetransmitTotal.Inc()
+		if err := r.Server.Push(rs.channelID, f.payload); err != nil {
+			log.WithField("func", "retransmit").Warn(err)
+		}
+	}
+	f.timer = timingwheel.AfterFunc(r.ackTimeout<<f.attempts, func() {
+		r.retransmit(rs, seq)
+	})
+	rs.Unlock()
+}
+
+func (r *Resumer) giveUp(rs *resumable, payloads ...[]byte) {
+	if len(payloads) == 0 {
+		return
+	}
+	pushFallbackTotal.Add(float64(len(payloads)))
+	if r.fallback == nil {
+		return
+	}
+	packets := make([]*pkt.LogicPkt, 0, len(payloads))
+	for _, payload := range payloads {
+		packet, err := pkt.MustReadLogicPkt(bytes.NewBuffer(payload))
+		if err != nil {
+			continue
+		}
+		packets = append(packets, packet)
+	}
+	r.fallback(rs.channelID, rs.meta, packets)
+}
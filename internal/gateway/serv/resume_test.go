@@ -0,0 +1,278 @@
+package serv
+
+import (
+	"X_IM/pkg/timingwheel"
+	"X_IM/pkg/token"
+	"X_IM/pkg/wire/common"
+	"X_IM/pkg/wire/pkt"
+	"X_IM/pkg/x"
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockServer struct {
+	x.Server
+	sync.Mutex
+	pushed map[string][]uint32
+}
+
+func (s *mockServer) Push(id string, data []byte) error {
+	packet, err := pkt.MustReadLogicPkt(bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	seq, ok := packet.GetMeta(common.MetaDeliverySeq)
+	if !ok {
+		return errors.New("no delivery seq")
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.pushed[id] = append(s.pushed[id], uint32(seq.(int)))
+	return nil
+}
+
+func (s *mockServer) seqs(id string) []uint32 {
+	s.Lock()
+	defer s.Unlock()
+	return s.pushed[id]
+}
+
+func pushN(r *Resumer, id string, n int) {
+	for i := 0; i < n; i++ {
+		p := pkt.New(common.CommandChatUserTalk, pkt.WithChannel(id))
+		p.Flag = pkt.Flag_Push
+		_ = r.Push(id, pkt.Marshal(p))
+	}
+}
+
+func TestResumer(t *testing.T) {
+	timingwheel.Start()
+
+	srv := &mockServer{pushed: make(map[string][]uint32)}
+	r := NewResumer(srv, time.Second*5, 3)
+	token := r.Open("ch1", x.Meta{MetaKeyAccount: "test1"})
+
+	// 登录前到达的消息缓存到Attach时下发
+	pushN(r, "ch1", 1)
+	assert.Empty(t, srv.seqs("ch1"))
+	r.Attach("ch1")
+	pushN(r, "ch1", 1)
+	assert.Equal(t, []uint32{1, 2}, srv.seqs("ch1"))
+
+	var signout int
+	r.Detach("ch1", func() { signout++ })
+	pushN(r, "ch1", 2)
+	assert.Equal(t, []uint32{1, 2}, srv.seqs("ch1"))
+
+	_, ok := r.Resume(token, "test2", 2)
+	assert.False(t, ok)
+	_, ok = r.Resume("wrong token", "test1", 2)
+	assert.False(t, ok)
+	// 客户端只收到了seq 1，但缓存里只剩2~4，仍然可以完整重放
+	id, ok := r.Resume(token, "test1", 1)
+	assert.True(t, ok)
+	assert.Equal(t, "ch1", id)
+	r.Attach(id)
+	assert.Equal(t, []uint32{1, 2, 2, 3, 4}, srv.seqs("ch1"))
+	assert.Equal(t, 0, signout)
+
+	// 缓存溢出后无法恢复
+	r.Detach("ch1", func() { signout++ })
+	pushN(r, "ch1", 4)
+	_, ok = r.Resume(token, "test1", 4)
+	assert.False(t, ok)
+}
+
+func TestResumerSignout(t *testing.T) {
+	timingwheel.Start()
+
+	srv := &mockServer{pushed: make(map[string][]uint32)}
+	r := NewResumer(srv, time.Millisecond*100, 10)
+	token := r.Open("ch1", x.Meta{MetaKeyAccount: "test1"})
+	r.Attach("ch1")
+
+	signout := make(chan struct{})
+	r.Detach("ch1", func() { close(signout) })
+	select {
+	case <-signout:
+	case <-time.After(time.Second * 3):
+		t.Fatal("signout is not called after the resume window")
+	}
+	_, ok := r.Resume(token, "test1", 0)
+	assert.False(t, ok)
+}
+
+func TestResumerRetransmit(t *testing.T) {
+	timingwheel.Start()
+
+	srv := &mockServer{pushed: make(map[string][]uint32)}
+	r := NewResumer(srv, time.Second*5, 10)
+	fallback := make(chan []*pkt.LogicPkt, 1)
+	r.EnableRetransmit(time.Millisecond*100, 1, func(channelID string, meta x.Meta, packets []*pkt.LogicPkt) {
+		fallback <- packets
+	})
+	_ = r.Open("ch1", x.Meta{MetaKeyAccount: "test1"})
+	r.Attach("ch1")
+
+	pushN(r, "ch1", 2)
+	r.Ack("ch1", 1)
+	select {
+	case packets := <-fallback:
+		assert.Equal(t, 1, len(packets))
+		seq, _ := packets[0].GetMeta(common.MetaDeliverySeq)
+		assert.Equal(t, 2, seq)
+	case <-time.After(time.Second * 5):
+		t.Fatal("fallback is not called after retries")
+	}
+	// seq 2重传了一次
+	assert.Equal(t, []uint32{1, 2, 2}, srv.seqs("ch1"))
+}
+
+type mockChannel struct {
+	x.Channel
+	closed bool
+}
+
+func (c *mockChannel) Close() error {
+	c.closed = true
+	return nil
+}
+
+type mockChannels struct {
+	*mockServer
+	x.ChannelMap
+	ch *mockChannel
+}
+
+func (s *mockChannels) Get(id string) (x.Channel, bool) {
+	return s.ch, true
+}
+
+func TestResumerKickOut(t *testing.T) {
+	timingwheel.Start()
+
+	srv := &mockChannels{
+		mockServer: &mockServer{pushed: make(map[string][]uint32)},
+		ch:         &mockChannel{},
+	}
+	r := NewResumer(srv, time.Second*5, 10)
+	token := r.Open("ch1", x.Meta{MetaKeyAccount: "test1"})
+	r.Attach("ch1")
+
+	// 通知的不是当前channel
+	p := pkt.New(common.CommandLoginSignIn, pkt.WithChannel("ch1"))
+	p.Flag = pkt.Flag_Push
+	p.WriteBody(&pkt.KickOutNotify{ChannelID: "ch2"})
+	_ = r.Push("ch1", pkt.Marshal(p))
+	assert.False(t, srv.ch.closed)
+
+	p.WriteBody(&pkt.KickOutNotify{ChannelID: "ch1"})
+	_ = r.Push("ch1", pkt.Marshal(p))
+	assert.Equal(t, []uint32{1, 2}, srv.seqs("ch1"))
+	assert.True(t, srv.ch.closed)
+
+	// 被踢下线的会话不能恢复
+	r.Detach("ch1", func() {})
+	_, ok := r.Resume(token, "test1", 2)
+	assert.False(t, ok)
+}
+
+func TestResumerLeases(t *testing.T) {
+	srv := &mockServer{pushed: make(map[string][]uint32)}
+	r := NewResumer(srv, time.Second*5, 10)
+	_ = r.Open("ch1", x.Meta{MetaKeyAccount: "test1"})
+	_ = r.Open("ch2", x.Meta{MetaKeyAccount: "test2"})
+	r.Close("ch2")
+
+	leases := r.Leases()
+	assert.Equal(t, 1, len(leases))
+	assert.Equal(t, "ch1", leases[0].ChannelID)
+	assert.Equal(t, "test1", leases[0].Account)
+}
+
+func TestResumerEphemeral(t *testing.T) {
+	timingwheel.Start()
+
+	srv := &mockServer{pushed: make(map[string][]uint32)}
+	r := NewResumer(srv, time.Second*5, 10)
+	r.EnableRetransmit(time.Millisecond*50, 3, nil)
+	_ = r.Open("ch1", x.Meta{MetaKeyAccount: "test1"})
+	signal := pkt.New(common.CommandChatUserSignal, pkt.WithChannel("ch1"))
+	signal.Flag = pkt.Flag_Push
+
+	// 登录前的临时信号直接丢弃
+	assert.Nil(t, r.Push("ch1", pkt.Marshal(signal)))
+	r.Attach("ch1")
+	// 在线时不带delivery seq直接下发，mockServer对这样的包返回错误
+	assert.Error(t, r.Push("ch1", pkt.Marshal(signal)))
+
+	// 临时信号不占用delivery seq，也不会重传
+	pushN(r, "ch1", 1)
+	assert.Equal(t, []uint32{1}, srv.seqs("ch1"))
+	r.Ack("ch1", 1)
+	time.Sleep(time.Millisecond * 200)
+	assert.Equal(t, []uint32{1}, srv.seqs("ch1"))
+}
+
+type mockFrame struct {
+	op      x.OpCode
+	payload []byte
+}
+
+func (f *mockFrame) SetOpCode(op x.OpCode) { f.op = op }
+func (f *mockFrame) GetOpCode() x.OpCode   { return f.op }
+func (f *mockFrame) SetPayload(p []byte)   { f.payload = p }
+func (f *mockFrame) GetPayload() []byte    { return f.payload }
+
+// mockConn 发送登录包后写入失败，模拟恢复握手时连接再次断开
+type mockConn struct {
+	x.Conn
+	login []byte
+}
+
+func (c *mockConn) SetReadDeadline(time.Time) error { return nil }
+
+func (c *mockConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8000}
+}
+
+func (c *mockConn) ReadFrame() (x.Frame, error) {
+	return &mockFrame{op: x.OpBinary, payload: c.login}, nil
+}
+
+func (c *mockConn) WriteFrame(x.OpCode, []byte) error {
+	return errors.New("broken pipe")
+}
+
+func TestResumeHandshakeFailed(t *testing.T) {
+	timingwheel.Start()
+
+	srv := &mockServer{pushed: make(map[string][]uint32)}
+	r := NewResumer(srv, time.Millisecond*200, 10)
+	resumeToken := r.Open("ch1", x.Meta{MetaKeyAccount: "test1"})
+	r.Attach("ch1")
+	signout := make(chan struct{})
+	r.Detach("ch1", func() { close(signout) })
+
+	tk, err := token.Generate(token.DefaultSecret, &token.Token{Account: "test1", App: "x_im", Exp: time.Now().Add(time.Hour).Unix()})
+	assert.Nil(t, err)
+	req := pkt.New(common.CommandLoginSignIn)
+	req.WriteBody(&pkt.LoginReq{Token: tk, ResumeToken: resumeToken})
+	h := &Handler{ServiceID: "gateway1", Resumer: r}
+	_, _, err = h.Accept(&mockConn{login: pkt.Marshal(req)}, time.Second)
+	assert.NotNil(t, err)
+
+	// 宽限期结束后照常登出，会话不再续期
+	select {
+	case <-signout:
+	case <-time.After(time.Second * 3):
+		t.Fatal("signout is not called after the failed resume")
+	}
+	assert.Empty(t, r.Leases())
+}
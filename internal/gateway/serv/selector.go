@@ -5,12 +5,28 @@ import (
 	"X_IM/pkg/logger"
 	"X_IM/pkg/wire/pkt"
 	"X_IM/pkg/x"
+	"fmt"
 	"hash/crc32"
 	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type RouteSelector struct {
-	route *conf.Route
+	path    string
+	route   atomic.Pointer[conf.Route]
+	version atomic.Int64
+	// 串行化Reload，Lookup不加锁
+	reloadMu sync.Mutex
+	modTime  time.Time
+	size     int64
+	// sticky home zone -> account -> 故障转移后使用的zone，home zone恢复前保持不变。
+	// home zone恢复或者配置重新加载时整组清除，转移后不再访问的账号不会一直留在表中
+	sticky   map[string]map[string]string
+	stickyMu sync.RWMutex
 }
 
 func NewRouteSelector(configPath string) (*RouteSelector, error) {
@@ -18,13 +34,93 @@ func NewRouteSelector(configPath string) (*RouteSelector, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &RouteSelector{
-		route: route,
-	}, nil
+	s := &RouteSelector{
+		path:   configPath,
+		sticky: make(map[string]map[string]string),
+	}
+	if fi, err := os.Stat(configPath); err == nil {
+		s.modTime, s.size = fi.ModTime(), fi.Size()
+	}
+	s.route.Store(route)
+	s.version.Store(1)
+	routeConfigVersion.Set(1)
+	return s, nil
+}
+
+// Version 当前生效的路由配置版本，每次成功Reload加一
+func (s *RouteSelector) Version() int64 {
+	return s.version.Load()
+}
+
+// Reload 重新读取route.json，校验通过后原子替换配置；失败时保留旧配置
+func (s *RouteSelector) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	log := logger.WithFields(logger.Fields{
+		"func": "Reload",
+		"path": s.path,
+	})
+	if fi, err := os.Stat(s.path); err == nil {
+		s.modTime, s.size = fi.ModTime(), fi.Size()
+	}
+	route, err := conf.ReadRoute(s.path)
+	if err != nil {
+		routeReloadTotal.WithLabelValues("failed").Inc()
+		log.Warnf("keep route version %d: %v", s.version.Load(), err)
+		return err
+	}
+	s.route.Store(route)
+	// failover链可能已经变化，之前的粘滞记录不再有效
+	s.stickyMu.Lock()
+	s.sticky = make(map[string]map[string]string)
+	s.stickyMu.Unlock()
+	version := s.version.Add(1)
+	routeConfigVersion.Set(float64(version))
+	routeReloadTotal.WithLabelValues("success").Inc()
+	log.Infof("route reloaded, version %d", version)
+	return nil
+}
+
+// Watch 定时检查route.json的修改时间，文件变化时触发Reload，直到stop被关闭
+func (s *RouteSelector) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			fi, err := os.Stat(s.path)
+			if err != nil {
+				continue
+			}
+			s.reloadMu.Lock()
+			changed := !fi.ModTime().Equal(s.modTime) || fi.Size() != s.size
+			s.reloadMu.Unlock()
+			if changed {
+				_ = s.Reload()
+			}
+		}
+	}
+}
+
+// ServeHTTP 管理接口，POST请求触发一次Reload
+func (s *RouteSelector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.Reload(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprintf(w, "reload failed, keep version %d: %v", s.Version(), err)
+		return
+	}
+	_, _ = fmt.Fprintf(w, "reloaded, version %d", s.Version())
 }
 
 // Lookup a logic server
 func (s *RouteSelector) Lookup(header *pkt.Header, srvs []x.Service) string {
+	route := s.route.Load()
 	// 1. 从header中读取Meta信息
 	app, _ := pkt.FindMeta(header.Meta, MetaKeyApp)
 	account, _ := pkt.FindMeta(header.Meta, MetaKeyAccount)
@@ -38,10 +134,10 @@ func (s *RouteSelector) Lookup(header *pkt.Header, srvs []x.Service) string {
 	})
 
 	// 2. 判断是否命中白名单
-	zone, ok := s.route.Whitelist[app.(string)]
+	zone, ok := route.Whitelist[app.(string)]
 	if !ok { // 未命中情况
 		var key string
-		switch s.route.RouteBy {
+		switch route.RouteBy {
 		case MetaKeyApp:
 			key = app.(string)
 		case MetaKeyAccount:
@@ -50,25 +146,95 @@ func (s *RouteSelector) Lookup(header *pkt.Header, srvs []x.Service) string {
 			key = account.(string)
 		}
 		// 3. 通过权重计算出zone
-		slot := hashcode(key) % len(s.route.Slots)
-		i := s.route.Slots[slot]
-		zone = s.route.Zones[i].ID
+		slot := hashcode(key) % len(route.Slots)
+		i := route.Slots[slot]
+		zone = route.Zones[i].ID
 	} else {
 		log.Infoln("hit a zone in whitelist", zone)
 	}
-	// 4. 过滤出当前zone的servers
-	zoneSrvs := filterSrvs(srvs, zone)
+	// 4. 过滤出当前zone的servers，没有则按failover链转移
+	served, zoneSrvs := s.failover(route, zone, account.(string), srvs)
 	if len(zoneSrvs) == 0 {
 		noServerFoundErrorTotal.WithLabelValues(zone).Inc()
+		if _, ok := route.Failover[zone]; ok {
+			log.Warnf("no service found in zone %s and its failover zones", zone)
+			return ""
+		}
+		// 未配置failover链的zone保持原来的随机选择
 		log.Warnf("selecting a random service from all due to no service found in zone %s", zone)
 		ri := rand.Intn(len(srvs))
 		return srvs[ri].ServiceID()
 	}
+	zoneServedTotal.WithLabelValues(zone, served).Inc()
 	// 5. 从zoneSrvs中选中一个服务
 	srv := selectSrvs(zoneSrvs, account.(string))
 	return srv.ServiceID()
 }
 
+// failover 返回实际提供服务的zone及其servers
+// home zone可用时清除这个zone所有的粘滞记录；否则优先使用上次转移到的zone，再按链上的顺序查找
+func (s *RouteSelector) failover(route *conf.Route, home, account string, srvs []x.Service) (string, []x.Service) {
+	if zoneSrvs := filterSrvs(srvs, home); len(zoneSrvs) > 0 {
+		s.clearSticky(home)
+		return home, zoneSrvs
+	}
+	chain := route.Failover[home]
+	if len(chain) == 0 {
+		return home, nil
+	}
+	s.stickyMu.RLock()
+	zone, ok := s.sticky[home][account]
+	s.stickyMu.RUnlock()
+	if ok {
+		for _, z := range chain {
+			if z != zone {
+				continue
+			}
+			if zoneSrvs := filterSrvs(srvs, zone); len(zoneSrvs) > 0 {
+				return zone, zoneSrvs
+			}
+			break
+		}
+	}
+	for _, zone := range chain {
+		if zoneSrvs := filterSrvs(srvs, zone); len(zoneSrvs) > 0 {
+			s.setSticky(home, account, zone)
+			return zone, zoneSrvs
+		}
+	}
+	s.setSticky(home, account, "")
+	return home, nil
+}
+
+// setSticky 记录account转移到的zone，zone为空时删除记录
+func (s *RouteSelector) setSticky(home, account, zone string) {
+	s.stickyMu.Lock()
+	defer s.stickyMu.Unlock()
+	accounts := s.sticky[home]
+	if zone == "" {
+		delete(accounts, account)
+		return
+	}
+	if accounts == nil {
+		accounts = make(map[string]string)
+		s.sticky[home] = accounts
+	}
+	accounts[account] = zone
+}
+
+// clearSticky home zone恢复后其中的账号都回到home，先用读锁检查避免每次查找都加写锁
+func (s *RouteSelector) clearSticky(home string) {
+	s.stickyMu.RLock()
+	_, ok := s.sticky[home]
+	s.stickyMu.RUnlock()
+	if !ok {
+		return
+	}
+	s.stickyMu.Lock()
+	delete(s.sticky, home)
+	s.stickyMu.Unlock()
+}
+
 func filterSrvs(srvs []x.Service, zone string) []x.Service {
 	var res = make([]x.Service, 0, len(srvs))
 	for _, srv := range srvs {
@@ -7,6 +7,8 @@ import (
 	"X_IM/pkg/x"
 	"github.com/segmentio/ksuid"
 	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -70,3 +72,102 @@ func TestSelectorLookup(t *testing.T) {
 	}
 	t.Log(hits)
 }
+
+func TestSelectorReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "route.json")
+	writeRoute := func(content string) {
+		err := os.WriteFile(path, []byte(content), 0644)
+		assert.Nil(t, err)
+	}
+	writeRoute(`{"zones":[{"id":"zone_ali_01","weight":10}],"whitelist":[{"key":"x_im","value":"zone_ali_01"}]}`)
+
+	rs, err := NewRouteSelector(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), rs.Version())
+
+	srvs := []x.Service{
+		&naming.DefaultService{ID: "s1", Meta: map[string]string{"zone": "zone_ali_01"}},
+		&naming.DefaultService{ID: "s2", Meta: map[string]string{"zone": "zone_ali_02"}},
+	}
+	packet := pkt2.New(common.CommandChatUserTalk, pkt2.WithChannel(ksuid.New().String()))
+	packet.AddStringMeta(MetaKeyApp, "x_im")
+	packet.AddStringMeta(MetaKeyAccount, "test1")
+	assert.Equal(t, "s1", rs.Lookup(&packet.Header, srvs))
+
+	// whitelist指向不存在的zone，校验失败，保留旧配置
+	writeRoute(`{"zones":[{"id":"zone_ali_01","weight":10}],"whitelist":[{"key":"x_im","value":"zone_ali_09"}]}`)
+	err = rs.Reload()
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(1), rs.Version())
+	assert.Equal(t, "s1", rs.Lookup(&packet.Header, srvs))
+
+	writeRoute(`{"zones":[{"id":"zone_ali_01","weight":10},{"id":"zone_ali_02","weight":10}],"whitelist":[{"key":"x_im","value":"zone_ali_02"}]}`)
+	err = rs.Reload()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), rs.Version())
+	assert.Equal(t, "s2", rs.Lookup(&packet.Header, srvs))
+}
+
+func TestSelectorFailover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "route.json")
+	err := os.WriteFile(path, []byte(`{"zones":[
+		{"id":"zone_cn_01","weight":10,"failover":["zone_cn_02","zone_cn_03"]},
+		{"id":"zone_cn_02","weight":0},
+		{"id":"zone_cn_03","weight":0},
+		{"id":"zone_us_01","weight":0}],
+		"whitelist":[{"key":"x_im","value":"zone_cn_01"}]}`), 0644)
+	assert.Nil(t, err)
+	rs, err := NewRouteSelector(path)
+	assert.Nil(t, err)
+
+	home := &naming.DefaultService{ID: "s1", Meta: map[string]string{"zone": "zone_cn_01"}}
+	second := &naming.DefaultService{ID: "s2", Meta: map[string]string{"zone": "zone_cn_02"}}
+	third := &naming.DefaultService{ID: "s3", Meta: map[string]string{"zone": "zone_cn_03"}}
+	overseas := &naming.DefaultService{ID: "s4", Meta: map[string]string{"zone": "zone_us_01"}}
+
+	packet := pkt2.New(common.CommandChatUserTalk, pkt2.WithChannel(ksuid.New().String()))
+	packet.AddStringMeta(MetaKeyApp, "x_im")
+	packet.AddStringMeta(MetaKeyAccount, "test1")
+
+	// 按顺序转移到链上第一个可用的zone
+	assert.Equal(t, "s3", rs.Lookup(&packet.Header, []x.Service{third, overseas}))
+	// 粘滞：zone_cn_02恢复后仍然留在zone_cn_03
+	assert.Equal(t, "s3", rs.Lookup(&packet.Header, []x.Service{second, third, overseas}))
+	// home zone恢复后回到home
+	assert.Equal(t, "s1", rs.Lookup(&packet.Header, []x.Service{home, second, third, overseas}))
+	assert.Equal(t, "s2", rs.Lookup(&packet.Header, []x.Service{second, third, overseas}))
+	// 链上的zone都不可用时不会选到海外的服务
+	assert.Equal(t, "", rs.Lookup(&packet.Header, []x.Service{overseas}))
+}
+
+func TestSelectorStickyCleared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "route.json")
+	err := os.WriteFile(path, []byte(`{"zones":[
+		{"id":"zone_cn_01","weight":10,"failover":["zone_cn_02"]},
+		{"id":"zone_cn_02","weight":0}],
+		"whitelist":[{"key":"x_im","value":"zone_cn_01"}]}`), 0644)
+	assert.Nil(t, err)
+	rs, err := NewRouteSelector(path)
+	assert.Nil(t, err)
+
+	home := &naming.DefaultService{ID: "s1", Meta: map[string]string{"zone": "zone_cn_01"}}
+	second := &naming.DefaultService{ID: "s2", Meta: map[string]string{"zone": "zone_cn_02"}}
+	lookup := func(account string, srvs ...x.Service) string {
+		packet := pkt2.New(common.CommandChatUserTalk, pkt2.WithChannel(ksuid.New().String()))
+		packet.AddStringMeta(MetaKeyApp, "x_im")
+		packet.AddStringMeta(MetaKeyAccount, account)
+		return rs.Lookup(&packet.Header, srvs)
+	}
+	assert.Equal(t, "s2", lookup("test1", second))
+	assert.Equal(t, "s2", lookup("test2", second))
+	assert.Equal(t, 2, len(rs.sticky["zone_cn_01"]))
+
+	// home zone恢复后，没有再次访问的账号的记录也被清除
+	assert.Equal(t, "s1", lookup("test1", home, second))
+	assert.Equal(t, 0, len(rs.sticky))
+
+	// 重新加载配置时清除
+	assert.Equal(t, "s2", lookup("test2", second))
+	assert.Nil(t, rs.Reload())
+	assert.Equal(t, 0, len(rs.sticky))
+}
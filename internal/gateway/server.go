@@ -8,12 +8,14 @@ import (
 	"X_IM/pkg/naming"
 	"X_IM/pkg/naming/consul"
 	"X_IM/pkg/tcp"
+	"X_IM/pkg/timingwheel"
 	"X_IM/pkg/websocket"
 	"X_IM/pkg/wire/common"
 	"X_IM/pkg/x"
 	"context"
 	"fmt"
 	"github.com/spf13/cobra"
+	"net/http"
 	_ "net/http/pprof"
 	"time"
 )
@@ -100,8 +102,14 @@ func RunServerStart(ctx context.Context, opts *StartOptions, version string) err
 	srv.SetMessageListener(handler)
 	srv.SetStateListener(handler)
 
+	timingwheel.Start()
+	// 下行消息经过Resumer打上delivery seq并缓存，用于断线恢复
+	resumer := serv.NewResumer(srv, config.ResumeWindow, config.ResumeBufferSize)
+	resumer.EnableRetransmit(config.PushAckTimeout, config.PushRetries, handler.Fallback)
+	handler.Resumer = resumer
+
 	//todo: _ = container.Init(srv, common.SNChat, common.SNLogin)
-	_ = container.Init(srv, common.SNChat)
+	_ = container.Init(resumer, common.SNChat)
 	container.EnableMonitor(fmt.Sprintf(":%d", config.MonitorPort))
 
 	ns, err := consul.NewNaming(config.ConsulURL)
@@ -118,5 +126,11 @@ func RunServerStart(ctx context.Context, opts *StartOptions, version string) err
 		return err
 	}
 	container.SetSelector(selector)
+	// 管理接口：curl -X POST http://localhost:8001/route/reload
+	http.Handle("/route/reload", selector)
+	if config.RouteWatchInterval > 0 {
+		go selector.Watch(config.RouteWatchInterval, ctx.Done())
+	}
+	go handler.RenewSessions(config.SessionRenewInterval, ctx.Done())
 	return container.Start()
 }
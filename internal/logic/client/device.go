@@ -0,0 +1,87 @@
+package client
+
+import (
+	"X_IM/pkg/wire/rpc"
+	"fmt"
+	"github.com/go-resty/resty/v2"
+	"google.golang.org/protobuf/proto"
+	"time"
+)
+
+// Device 离线推送的设备token
+type Device interface {
+	Register(app string, req *rpc.RegisterTokenReq) error
+	Unregister(app string, req *rpc.UnregisterTokenReq) error
+	Tokens(app string, req *rpc.DeviceTokensReq) (*rpc.DeviceTokensResp, error)
+}
+
+type DeviceHTTP struct {
+	url string
+	cli *resty.Client
+	srv *resty.SRVRecord
+}
+
+func NewDeviceService(url string) Device {
+	cli := resty.New().SetRetryCount(3).SetTimeout(time.Second * 5)
+	cli.SetHeader("Content-Type", "application/x-protobuf")
+	cli.SetHeader("Accept", "application/x-protobuf")
+	return &DeviceHTTP{
+		url: url,
+		cli: cli,
+	}
+}
+
+func NewDeviceServiceWithSRV(scheme string, srv *resty.SRVRecord) Device {
+	cli := resty.New().SetRetryCount(3).SetTimeout(time.Second * 5)
+	cli.SetHeader("Content-Type", "application/x-protobuf")
+	cli.SetHeader("Accept", "application/x-protobuf")
+	cli.SetScheme("http")
+
+	return &DeviceHTTP{
+		url: "",
+		cli: cli,
+		srv: srv,
+	}
+}
+
+func (d *DeviceHTTP) Register(app string, req *rpc.RegisterTokenReq) error {
+	path := fmt.Sprintf("%s/api/%s/device/token", d.url, app)
+	body, _ := proto.Marshal(req)
+	response, err := d.Req().SetBody(body).Post(path)
+	if err != nil {
+		return err
+	}
+	return checkStatus("Register", response)
+}
+
+func (d *DeviceHTTP) Unregister(app string, req *rpc.UnregisterTokenReq) error {
+	path := fmt.Sprintf("%s/api/%s/device/token", d.url, app)
+	body, _ := proto.Marshal(req)
+	response, err := d.Req().SetBody(body).Delete(path)
+	if err != nil {
+		return err
+	}
+	return checkStatus("Unregister", response)
+}
+
+func (d *DeviceHTTP) Tokens(app string, req *rpc.DeviceTokensReq) (*rpc.DeviceTokensResp, error) {
+	path := fmt.Sprintf("%s/api/%s/device/tokens", d.url, app)
+	body, _ := proto.Marshal(req)
+	response, err := d.Req().SetBody(body).Post(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkStatus("Tokens", response); err != nil {
+		return nil, err
+	}
+	var resp rpc.DeviceTokensResp
+	_ = proto.Unmarshal(response.Body(), &resp)
+	return &resp, nil
+}
+
+func (d *DeviceHTTP) Req() *resty.Request {
+	if d.srv == nil {
+		return d.cli.R()
+	}
+	return d.cli.R().SetSRV(d.srv)
+}
@@ -3,6 +3,7 @@ package client
 import (
 	"X_IM/pkg/logger"
 	"X_IM/pkg/wire/rpc"
+	"errors"
 	"fmt"
 	"github.com/go-resty/resty/v2"
 	"google.golang.org/protobuf/proto"
@@ -13,9 +14,38 @@ type Message interface {
 	InsertUser(app string, req *rpc.InsertMessageReq) (*rpc.InsertMessageResp, error)
 	InsertGroup(app string, req *rpc.InsertMessageReq) (*rpc.InsertMessageResp, error)
 	SetACK(app string, req *rpc.AckMessageReq) error
+	Rewind(app string, req *rpc.RewindMessageReq) error
+	Recall(app string, req *rpc.RecallMessageReq) (*rpc.RecallMessageResp, error)
+	Edit(app string, req *rpc.EditMessageReq) (*rpc.EditMessageResp, error)
+	React(app string, req *rpc.ReactMessageReq) (*rpc.ReactMessageResp, error)
+	Schedule(app string, req *rpc.ScheduledMessage) (*rpc.ScheduleMessageResp, error)
+	ScheduledList(app string, req *rpc.ScheduledListReq) (*rpc.ScheduledListResp, error)
+	CancelScheduled(app string, req *rpc.CancelScheduledReq) error
+	DeliverScheduled(app string, req *rpc.DeliverScheduledReq) (*rpc.DeliverScheduledResp, error)
+	FailScheduled(app string, req *rpc.FailScheduledReq) error
+	PendingScheduled(req *rpc.PendingScheduledReq) (*rpc.ScheduledListResp, error)
+	SweepExpired(req *rpc.SweepExpiredReq) (*rpc.SweepExpiredResp, error)
+	Read(app string, req *rpc.ReadMessageReq) (*rpc.ReadMessageResp, error)
+	ThreadReplies(app string, req *rpc.ThreadRepliesReq) (*rpc.ThreadRepliesResp, error)
+	ThreadCounts(app string, req *rpc.ThreadCountsReq) (*rpc.ThreadCountsResp, error)
+	ReadState(app string, req *rpc.ReadStateReq) (*rpc.ReadStateResp, error)
 	GetMessageIndex(app string, req *rpc.GetOfflineMessageIndexReq) (*rpc.GetOfflineMessageIndexResp, error)
 	GetMessageContent(app string, req *rpc.GetOfflineMessageContentReq) (*rpc.GetOfflineMessageContentResp, error)
+	Conversations(app string, req *rpc.ConversationsReq) (*rpc.ConversationsResp, error)
+	ConversationSync(app string, req *rpc.ConversationSyncReq) (*rpc.ConversationSyncResp, error)
+	ConversationHistory(app string, req *rpc.ConversationHistoryReq) (*rpc.ConversationHistoryResp, error)
+	ConversationMute(app string, req *rpc.ConversationMuteReq) error
+	MutedConversations(app string, req *rpc.MutedConversationsReq) (*rpc.MutedConversationsResp, error)
 }
+
+// occult拒绝请求时返回的错误
+var (
+	ErrBadRequest    = errors.New("bad request")
+	ErrForbidden     = errors.New("forbidden")
+	ErrExpired       = errors.New("operation expired")
+	ErrLimitExceeded = errors.New("limit exceeded")
+)
+
 type MessageHTTP struct {
 	url string
 	cli *resty.Client
@@ -54,8 +84,9 @@ func (m *MessageHTTP) InsertUser(app string, req *rpc.InsertMessageReq) (*rpc.In
 	if err != nil {
 		return nil, err
 	}
-	if response.StatusCode() != 200 {
-		return nil, fmt.Errorf("MessageHTTP.InsertUser response.StatusCode() = %d, want 200", response.StatusCode())
+	// 引用的消息不在会话中时返回ErrBadRequest
+	if err = checkStatus("InsertUser", response); err != nil {
+		return nil, err
 	}
 	var resp rpc.InsertMessageResp
 	_ = proto.Unmarshal(response.Body(), &resp)
@@ -71,8 +102,9 @@ func (m *MessageHTTP) InsertGroup(app string, req *rpc.InsertMessageReq) (*rpc.I
 	if err != nil {
 		return nil, err
 	}
-	if response.StatusCode() != 200 {
-		return nil, fmt.Errorf("MessageHTTP.InsertGroup response.StatusCode() = %d, want 200", response.StatusCode())
+	// 引用的消息不在会话中时返回ErrBadRequest
+	if err = checkStatus("InsertGroup", response); err != nil {
+		return nil, err
 	}
 	var resp rpc.InsertMessageResp
 	_ = proto.Unmarshal(response.Body(), &resp)
@@ -93,6 +125,221 @@ func (m *MessageHTTP) SetACK(app string, req *rpc.AckMessageReq) error {
 	return nil
 }
 
+func (m *MessageHTTP) Rewind(app string, req *rpc.RewindMessageReq) error {
+	path := fmt.Sprintf("%s/api/%s/message/rewind", m.url, app)
+	body, _ := proto.Marshal(req)
+	response, err := m.Req().SetBody(body).Post(path)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode() != 200 {
+		return fmt.Errorf("MessageHTTP.Rewind response.StatusCode() = %d, want 200", response.StatusCode())
+	}
+	return nil
+}
+
+func (m *MessageHTTP) Recall(app string, req *rpc.RecallMessageReq) (*rpc.RecallMessageResp, error) {
+	path := fmt.Sprintf("%s/api/%s/message/recall", m.url, app)
+	body, _ := proto.Marshal(req)
+	response, err := m.Req().SetBody(body).Post(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkStatus("Recall", response); err != nil {
+		return nil, err
+	}
+	var resp rpc.RecallMessageResp
+	_ = proto.Unmarshal(response.Body(), &resp)
+	return &resp, nil
+}
+
+func (m *MessageHTTP) Edit(app string, req *rpc.EditMessageReq) (*rpc.EditMessageResp, error) {
+	path := fmt.Sprintf("%s/api/%s/message/edit", m.url, app)
+	body, _ := proto.Marshal(req)
+	response, err := m.Req().SetBody(body).Post(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkStatus("Edit", response); err != nil {
+		return nil, err
+	}
+	var resp rpc.EditMessageResp
+	_ = proto.Unmarshal(response.Body(), &resp)
+	return &resp, nil
+}
+
+func (m *MessageHTTP) React(app string, req *rpc.ReactMessageReq) (*rpc.ReactMessageResp, error) {
+	path := fmt.Sprintf("%s/api/%s/message/reaction", m.url, app)
+	body, _ := proto.Marshal(req)
+	response, err := m.Req().SetBody(body).Post(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkStatus("React", response); err != nil {
+		return nil, err
+	}
+	var resp rpc.ReactMessageResp
+	_ = proto.Unmarshal(response.Body(), &resp)
+	return &resp, nil
+}
+
+func (m *MessageHTTP) Schedule(app string, req *rpc.ScheduledMessage) (*rpc.ScheduleMessageResp, error) {
+	path := fmt.Sprintf("%s/api/%s/message/scheduled", m.url, app)
+	body, _ := proto.Marshal(req)
+	response, err := m.Req().SetBody(body).Post(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkStatus("Schedule", response); err != nil {
+		return nil, err
+	}
+	var resp rpc.ScheduleMessageResp
+	_ = proto.Unmarshal(response.Body(), &resp)
+	return &resp, nil
+}
+
+func (m *MessageHTTP) ScheduledList(app string, req *rpc.ScheduledListReq) (*rpc.ScheduledListResp, error) {
+	path := fmt.Sprintf("%s/api/%s/message/scheduled/list", m.url, app)
+	body, _ := proto.Marshal(req)
+	response, err := m.Req().SetBody(body).Post(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkStatus("ScheduledList", response); err != nil {
+		return nil, err
+	}
+	var resp rpc.ScheduledListResp
+	_ = proto.Unmarshal(response.Body(), &resp)
+	return &resp, nil
+}
+
+func (m *MessageHTTP) CancelScheduled(app string, req *rpc.CancelScheduledReq) error {
+	path := fmt.Sprintf("%s/api/%s/message/scheduled/cancel", m.url, app)
+	body, _ := proto.Marshal(req)
+	response, err := m.Req().SetBody(body).Post(path)
+	if err != nil {
+		return err
+	}
+	return checkStatus("CancelScheduled", response)
+}
+
+func (m *MessageHTTP) DeliverScheduled(app string, req *rpc.DeliverScheduledReq) (*rpc.DeliverScheduledResp, error) {
+	path := fmt.Sprintf("%s/api/%s/message/scheduled/deliver", m.url, app)
+	body, _ := proto.Marshal(req)
+	response, err := m.Req().SetBody(body).Post(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkStatus("DeliverScheduled", response); err != nil {
+		return nil, err
+	}
+	var resp rpc.DeliverScheduledResp
+	_ = proto.Unmarshal(response.Body(), &resp)
+	return &resp, nil
+}
+
+func (m *MessageHTTP) FailScheduled(app string, req *rpc.FailScheduledReq) error {
+	path := fmt.Sprintf("%s/api/%s/message/scheduled/fail", m.url, app)
+	body, _ := proto.Marshal(req)
+	response, err := m.Req().SetBody(body).Post(path)
+	if err != nil {
+		return err
+	}
+	return checkStatus("FailScheduled", response)
+}
+
+// PendingScheduled 领取所有app待发送的消息
+func (m *MessageHTTP) PendingScheduled(req *rpc.PendingScheduledReq) (*rpc.ScheduledListResp, error) {
+	path := fmt.Sprintf("%s/api/scheduled/pending", m.url)
+	body, _ := proto.Marshal(req)
+	response, err := m.Req().SetBody(body).Post(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkStatus("PendingScheduled", response); err != nil {
+		return nil, err
+	}
+	var resp rpc.ScheduledListResp
+	_ = proto.Unmarshal(response.Body(), &resp)
+	return &resp, nil
+}
+
+// SweepExpired 删除所有app过期的消息
+func (m *MessageHTTP) SweepExpired(req *rpc.SweepExpiredReq) (*rpc.SweepExpiredResp, error) {
+	path := fmt.Sprintf("%s/api/expired/sweep", m.url)
+	body, _ := proto.Marshal(req)
+	response, err := m.Req().SetBody(body).Post(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkStatus("SweepExpired", response); err != nil {
+		return nil, err
+	}
+	var resp rpc.SweepExpiredResp
+	_ = proto.Unmarshal(response.Body(), &resp)
+	return &resp, nil
+}
+
+func (m *MessageHTTP) Read(app string, req *rpc.ReadMessageReq) (*rpc.ReadMessageResp, error) {
+	path := fmt.Sprintf("%s/api/%s/message/read", m.url, app)
+	body, _ := proto.Marshal(req)
+	response, err := m.Req().SetBody(body).Post(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkStatus("Read", response); err != nil {
+		return nil, err
+	}
+	var resp rpc.ReadMessageResp
+	_ = proto.Unmarshal(response.Body(), &resp)
+	return &resp, nil
+}
+
+func (m *MessageHTTP) ReadState(app string, req *rpc.ReadStateReq) (*rpc.ReadStateResp, error) {
+	path := fmt.Sprintf("%s/api/%s/message/read/state", m.url, app)
+	body, _ := proto.Marshal(req)
+	response, err := m.Req().SetBody(body).Post(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkStatus("ReadState", response); err != nil {
+		return nil, err
+	}
+	var resp rpc.ReadStateResp
+	_ = proto.Unmarshal(response.Body(), &resp)
+	return &resp, nil
+}
+
+func (m *MessageHTTP) ThreadReplies(app string, req *rpc.ThreadRepliesReq) (*rpc.ThreadRepliesResp, error) {
+	path := fmt.Sprintf("%s/api/%s/message/thread", m.url, app)
+	body, _ := proto.Marshal(req)
+	response, err := m.Req().SetBody(body).Post(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkStatus("ThreadReplies", response); err != nil {
+		return nil, err
+	}
+	var resp rpc.ThreadRepliesResp
+	_ = proto.Unmarshal(response.Body(), &resp)
+	return &resp, nil
+}
+
+func (m *MessageHTTP) ThreadCounts(app string, req *rpc.ThreadCountsReq) (*rpc.ThreadCountsResp, error) {
+	path := fmt.Sprintf("%s/api/%s/message/thread/counts", m.url, app)
+	body, _ := proto.Marshal(req)
+	response, err := m.Req().SetBody(body).Post(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkStatus("ThreadCounts", response); err != nil {
+		return nil, err
+	}
+	var resp rpc.ThreadCountsResp
+	_ = proto.Unmarshal(response.Body(), &resp)
+	return &resp, nil
+}
+
 func (m *MessageHTTP) GetMessageIndex(app string, req *rpc.GetOfflineMessageIndexReq) (*rpc.GetOfflineMessageIndexResp, error) {
 	path := fmt.Sprintf("%s/api/%s/offline/index", m.url, app)
 	body, _ := proto.Marshal(req)
@@ -124,6 +371,94 @@ func (m *MessageHTTP) GetMessageContent(app string, req *rpc.GetOfflineMessageCo
 	return &resp, nil
 }
 
+func (m *MessageHTTP) Conversations(app string, req *rpc.ConversationsReq) (*rpc.ConversationsResp, error) {
+	path := fmt.Sprintf("%s/api/%s/offline/conversations", m.url, app)
+	body, _ := proto.Marshal(req)
+	response, err := m.Req().SetBody(body).Post(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkStatus("Conversations", response); err != nil {
+		return nil, err
+	}
+	var resp rpc.ConversationsResp
+	_ = proto.Unmarshal(response.Body(), &resp)
+	return &resp, nil
+}
+
+func (m *MessageHTTP) ConversationSync(app string, req *rpc.ConversationSyncReq) (*rpc.ConversationSyncResp, error) {
+	path := fmt.Sprintf("%s/api/%s/offline/conversation/sync", m.url, app)
+	body, _ := proto.Marshal(req)
+	response, err := m.Req().SetBody(body).Post(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkStatus("ConversationSync", response); err != nil {
+		return nil, err
+	}
+	var resp rpc.ConversationSyncResp
+	_ = proto.Unmarshal(response.Body(), &resp)
+	return &resp, nil
+}
+
+func (m *MessageHTTP) ConversationHistory(app string, req *rpc.ConversationHistoryReq) (*rpc.ConversationHistoryResp, error) {
+	path := fmt.Sprintf("%s/api/%s/offline/conversation/history", m.url, app)
+	body, _ := proto.Marshal(req)
+	response, err := m.Req().SetBody(body).Post(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkStatus("ConversationHistory", response); err != nil {
+		return nil, err
+	}
+	var resp rpc.ConversationHistoryResp
+	_ = proto.Unmarshal(response.Body(), &resp)
+	return &resp, nil
+}
+
+func (m *MessageHTTP) ConversationMute(app string, req *rpc.ConversationMuteReq) error {
+	path := fmt.Sprintf("%s/api/%s/offline/conversation/mute", m.url, app)
+	body, _ := proto.Marshal(req)
+	response, err := m.Req().SetBody(body).Post(path)
+	if err != nil {
+		return err
+	}
+	return checkStatus("ConversationMute", response)
+}
+
+func (m *MessageHTTP) MutedConversations(app string, req *rpc.MutedConversationsReq) (*rpc.MutedConversationsResp, error) {
+	path := fmt.Sprintf("%s/api/%s/offline/conversations/muted", m.url, app)
+	body, _ := proto.Marshal(req)
+	response, err := m.Req().SetBody(body).Post(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkStatus("MutedConversations", response); err != nil {
+		return nil, err
+	}
+	var resp rpc.MutedConversationsResp
+	_ = proto.Unmarshal(response.Body(), &resp)
+	return &resp, nil
+}
+
+// checkStatus 把occult拒绝请求的状态码转换为对应的错误
+func checkStatus(method string, response *resty.Response) error {
+	switch response.StatusCode() {
+	case 200:
+		return nil
+	case 400:
+		return fmt.Errorf("%w: %s", ErrBadRequest, response.String())
+	case 403:
+		return fmt.Errorf("%w: %s", ErrForbidden, response.String())
+	case 422:
+		return fmt.Errorf("%w: %s", ErrExpired, response.String())
+	case 429:
+		return fmt.Errorf("%w: %s", ErrLimitExceeded, response.String())
+	default:
+		return fmt.Errorf("MessageHTTP.%s response.StatusCode() = %d, want 200", method, response.StatusCode())
+	}
+}
+
 func (m *MessageHTTP) Req() *resty.Request {
 	if m.srv == nil {
 		return m.cli.R()
@@ -26,6 +26,50 @@ const (
 type Server struct {
 }
 
+// 多端登录策略
+const (
+	DeviceSingle   = "single"
+	DevicePlatform = "platform"
+	DeviceMulti    = "multi"
+)
+
+// DevicePolicy 同一账号多端登录的策略
+//
+//	single：只允许一个设备在线，新的登录踢掉其他所有设备
+//	platform：每种设备类型一个会话，只踢掉同类型的设备
+//	multi：同类型的设备互踢，并且最多Max种设备同时在线
+type DevicePolicy struct {
+	Mode string `default:"platform"`
+	Max  int    `default:"3"`
+}
+
+// ReactionLimit 单条消息上表情回应的数量限制，避免群里被刷屏
+type ReactionLimit struct {
+	// MaxKinds 不同表情的最大数量
+	MaxKinds int `default:"20"`
+	// MaxPerUser 同一账号的最大回应数
+	MaxPerUser int `default:"3"`
+}
+
+// 离线推送服务
+const (
+	PushProviderHTTP = "http"
+	PushProviderFile = "file"
+)
+
+// Push 离线推送的配置
+//
+//	http：把通知以JSON POST到URL，由推送网关转发给APNs或FCM
+//	file：把通知逐行追加到File中，用于本地调试与测试
+//	为空时不推送
+type Push struct {
+	Provider string
+	URL      string
+	File     string
+	// Retry 发送失败后的重试次数，token失效时不重试
+	Retry int `default:"3"`
+}
+
 type Config struct {
 	ServiceID       string
 	Listen          string `default:":8005"`
@@ -41,6 +85,77 @@ type Config struct {
 	LogLevel        string `default:"DEBUG"`
 	MessageGPool    int    `default:"5000"`
 	ConnectionGPool int    `default:"500"`
+	// SessionCacheSize 本地缓存的会话数，为0时关闭本地缓存
+	SessionCacheSize int `default:"100000"`
+	// SessionCacheTTL 本地缓存的会话最长保留时长
+	SessionCacheTTL time.Duration `default:"10s"`
+	// SessionSweepInterval 清理租约过期的会话的间隔
+	SessionSweepInterval time.Duration `default:"30s"`
+	// GatewayDownGrace 网关断开后它的会话最多保留的时长
+	GatewayDownGrace time.Duration `default:"30s"`
+	// PresenceNotifyInterval 合并推送在线状态变化的间隔
+	PresenceNotifyInterval time.Duration `default:"1s"`
+	// PresenceMinInterval 同一账号的在线状态两次推送的最小间隔
+	PresenceMinInterval time.Duration `default:"5s"`
+	// SignalInterval 同一发送方在同一会话中重复发送同类信号的最小间隔
+	SignalInterval time.Duration `default:"3s"`
+	// SignalMaxGroupMembers 可以发送临时信号的群的最大人数
+	SignalMaxGroupMembers int `default:"100"`
+	// RecallWindow 默认的消息撤回时间窗口，AppRecallWindows按app覆盖
+	RecallWindow     time.Duration            `default:"2m"`
+	AppRecallWindows map[string]time.Duration `ignored:"true"`
+	// EditWindow 默认的消息编辑时间窗口，AppEditWindows按app覆盖
+	EditWindow     time.Duration            `default:"15m"`
+	AppEditWindows map[string]time.Duration `ignored:"true"`
+	ReactionLimit  ReactionLimit
+	// ScheduleMaxAhead 定时发送最多可以提前的时长
+	ScheduleMaxAhead time.Duration `default:"720h"`
+	// ScheduleScanInterval 接管过期还未送达的定时消息的间隔
+	ScheduleScanInterval time.Duration `default:"1m"`
+	// ExpireSweepInterval 清理过期的阅后即焚消息的间隔
+	ExpireSweepInterval time.Duration `default:"5s"`
+	// Push 默认的离线推送配置，AppPushes按app覆盖
+	Push      Push
+	AppPushes map[string]Push `ignored:"true"`
+	// PushCollapseInterval 合并同一会话发给同一账号的通知的间隔
+	PushCollapseInterval time.Duration `default:"2s"`
+	// PushWorkers 同时发送离线通知的最大并发数
+	PushWorkers int `default:"100"`
+	// DevicePolicy 默认的多端登录策略，AppDevicePolicies按app覆盖
+	DevicePolicy      DevicePolicy
+	AppDevicePolicies map[string]DevicePolicy `ignored:"true"`
+}
+
+// DevicePolicyOf 返回app的多端登录策略
+func (c *Config) DevicePolicyOf(app string) DevicePolicy {
+	if policy, ok := c.AppDevicePolicies[app]; ok {
+		return policy
+	}
+	return c.DevicePolicy
+}
+
+// PushOf 返回app的离线推送配置
+func (c *Config) PushOf(app string) Push {
+	if push, ok := c.AppPushes[app]; ok {
+		return push
+	}
+	return c.Push
+}
+
+// RecallWindowOf 返回app允许撤回消息的时间窗口
+func (c *Config) RecallWindowOf(app string) time.Duration {
+	if window, ok := c.AppRecallWindows[app]; ok {
+		return window
+	}
+	return c.RecallWindow
+}
+
+// EditWindowOf 返回app允许编辑消息的时间窗口
+func (c *Config) EditWindowOf(app string) time.Duration {
+	if window, ok := c.AppEditWindows[app]; ok {
+		return window
+	}
+	return c.EditWindow
 }
 
 func (c Config) String() string {
@@ -2,27 +2,58 @@ package handler
 
 import (
 	"X_IM/internal/logic/client"
+	"X_IM/internal/logic/conf"
+	"X_IM/pkg/logger"
+	"X_IM/pkg/wire/common"
 	"X_IM/pkg/wire/pkt"
 	"X_IM/pkg/wire/rpc"
 	"X_IM/pkg/x"
 	"errors"
+	"fmt"
 	"time"
 )
 
-var ErrNoDestination = errors.New("no destination")
+var (
+	ErrNoDestination      = errors.New("no destination")
+	ErrScheduleDisabled   = errors.New("scheduled messages are disabled")
+	ErrInvalidTTL         = fmt.Errorf("ttl must be between 0 and %s", common.MessageMaxTTL)
+	ErrInvalidClientMsgID = fmt.Errorf("clientMsgID must be at most %d bytes", common.ClientMsgIDMaxLength)
+	ErrTooManyMentions    = fmt.Errorf("a message can mention at most %d members", common.MessageMaxMentions)
+)
 
 type ChatHandler struct {
 	msgService   client.Message
 	groupService client.Group
+	// recallWindowOf与editWindowOf返回app允许撤回、编辑消息的时间窗口
+	recallWindowOf func(app string) time.Duration
+	editWindowOf   func(app string) time.Duration
+	reactionLimit  conf.ReactionLimit
+	// scheduler 为空时不支持定时发送
+	scheduler *ScheduleHandler
+	// notifier 为空时不发送离线通知
+	notifier *NotifyHandler
 }
 
-func NewChatHandler(msg client.Message, group client.Group) *ChatHandler {
+func NewChatHandler(msg client.Message, group client.Group, recallWindowOf, editWindowOf func(app string) time.Duration, reactionLimit conf.ReactionLimit) *ChatHandler {
 	return &ChatHandler{
-		msgService:   msg,
-		groupService: group,
+		msgService:     msg,
+		groupService:   group,
+		recallWindowOf: recallWindowOf,
+		editWindowOf:   editWindowOf,
+		reactionLimit:  reactionLimit,
 	}
 }
 
+// SetScheduler 设置定时发送的调度器，MessageReq.sendAt在未来时由它保存并定时送达
+func (h *ChatHandler) SetScheduler(scheduler *ScheduleHandler) {
+	h.scheduler = scheduler
+}
+
+// SetNotifier 设置离线通知，接收方没有在线的设备时由它通过推送服务通知
+func (h *ChatHandler) SetNotifier(notifier *NotifyHandler) {
+	h.notifier = notifier
+}
+
 // DoSingleTalk 单聊
 func (h *ChatHandler) DoSingleTalk(ctx x.Context) {
 	if ctx.Header().Dest == "" {
@@ -35,49 +66,89 @@ func (h *ChatHandler) DoSingleTalk(ctx x.Context) {
 		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
 		return
 	}
-	// 2. 获取接收方的位置信息
+	if req.Ttl < 0 || req.Ttl > int64(common.MessageMaxTTL) {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrInvalidTTL)
+		return
+	}
+	if len(req.ClientMsgID) > common.ClientMsgIDMaxLength {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrInvalidClientMsgID)
+		return
+	}
+	if req.SendAt > time.Now().UnixNano() {
+		h.schedule(ctx, &req, false)
+		return
+	}
+	// 2. 获取接收方所有设备的位置信息
 	receiver := ctx.Header().GetDest()
-	loc, err := ctx.GetLocation(receiver, "")
-	if err != nil && errors.Is(err, x.ErrSessionNil) {
+	locs, err := ctx.GetLocations(receiver)
+	if err != nil && !errors.Is(err, x.ErrSessionNil) {
 		_ = ctx.RespWithError(pkt.Status_SystemException, err)
 		return
 	}
 	// 3. 保存离线消息
 	sendTime := time.Now().UnixNano()
 	resp, err := h.msgService.InsertUser(ctx.Session().GetApp(), &rpc.InsertMessageReq{
-		Sender:   ctx.Session().GetAccount(),
-		Dest:     receiver,
-		SendTime: sendTime,
+		Sender:      ctx.Session().GetAccount(),
+		Dest:        receiver,
+		SendTime:    sendTime,
+		ClientMsgID: req.GetClientMsgID(),
 		Message: &rpc.Message{
-			Type:  req.GetType(),
-			Body:  req.GetBody(),
-			Extra: req.GetExtra(),
+			Type:         req.GetType(),
+			Body:         req.GetBody(),
+			Extra:        req.GetExtra(),
+			ReplyTo:      req.GetReplyTo(),
+			ThreadRoot:   req.GetThreadRoot(),
+			Ttl:          req.GetTtl(),
+			TtlAfterRead: req.GetTtlAfterRead(),
 		},
 	})
+	if errors.Is(err, client.ErrBadRequest) {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
 	if err != nil {
 		_ = ctx.RespWithError(pkt.Status_SystemException, err)
 		return
 	}
+	// 重复发送的消息已经推送过，只返回原来的消息
+	if resp.Duplicate {
+		respDuplicate(ctx, resp)
+		return
+	}
 	msgID := resp.MessageID
 
-	//4.if receiver is online,send the message to receiver
-	if loc != nil {
-		if err = ctx.Dispatch(&pkt.MessagePush{
-			MessageID: msgID,
-			Type:      req.GetType(),
-			Body:      req.GetBody(),
-			Extra:     req.GetExtra(),
-			Sender:    ctx.Session().GetAccount(),
-			SendTime:  sendTime,
-		}, loc); err != nil {
+	push := &pkt.MessagePush{
+		MessageID:    msgID,
+		Type:         req.GetType(),
+		Body:         req.GetBody(),
+		Extra:        req.GetExtra(),
+		Sender:       ctx.Session().GetAccount(),
+		SendTime:     sendTime,
+		ReplyTo:      req.GetReplyTo(),
+		ThreadRoot:   req.GetThreadRoot(),
+		Ttl:          req.GetTtl(),
+		TtlAfterRead: req.GetTtlAfterRead(),
+		ExpireAt:     expireAt(sendTime, req.GetTtl(), req.GetTtlAfterRead()),
+		Seq:          resp.Seq,
+		ClientMsgID:  req.GetClientMsgID(),
+	}
+	//4.if receiver is online,send the message to every device of receiver
+	if len(locs) > 0 && receiver != ctx.Session().GetAccount() {
+		if err = ctx.Dispatch(push, locs...); err != nil {
 			_ = ctx.RespWithError(pkt.Status_SystemException, err)
 			return
 		}
 	}
-	// 5. 返回一条resp消息
+	if len(locs) == 0 && receiver != ctx.Session().GetAccount() {
+		h.offline(ctx.Session().GetApp(), "", push, receiver)
+	}
+	// 5. 同步给发送方的其他设备
+	syncSent(ctx, push)
+	// 6. 返回一条resp消息
 	_ = ctx.Resp(pkt.Status_Success, &pkt.MessageResp{
 		MessageID: msgID,
 		SendTime:  sendTime,
+		Seq:       resp.Seq,
 	})
 }
 
@@ -93,25 +164,54 @@ func (h *ChatHandler) DoGroupTalk(ctx x.Context) {
 		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
 		return
 	}
+	if req.Ttl < 0 || req.Ttl > int64(common.MessageMaxTTL) {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrInvalidTTL)
+		return
+	}
+	if len(req.ClientMsgID) > common.ClientMsgIDMaxLength {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrInvalidClientMsgID)
+		return
+	}
+	if len(req.Mentions) > common.MessageMaxMentions {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrTooManyMentions)
+		return
+	}
+	if req.SendAt > time.Now().UnixNano() {
+		h.schedule(ctx, &req, true)
+		return
+	}
 	// 群聊里dest就不再是user account，而是群ID
 	group := ctx.Header().GetDest()
 	sendTime := time.Now().UnixNano()
 
 	// 2. 保存离线消息
 	resp, err := h.msgService.InsertGroup(ctx.Session().GetApp(), &rpc.InsertMessageReq{
-		Sender:   ctx.Session().GetAccount(),
-		Dest:     group,
-		SendTime: sendTime,
+		Sender:      ctx.Session().GetAccount(),
+		Dest:        group,
+		SendTime:    sendTime,
+		ClientMsgID: req.GetClientMsgID(),
 		Message: &rpc.Message{
-			Type:  req.GetType(),
-			Body:  req.GetBody(),
-			Extra: req.GetExtra(),
+			Type:         req.GetType(),
+			Body:         req.GetBody(),
+			Extra:        req.GetExtra(),
+			ReplyTo:      req.GetReplyTo(),
+			ThreadRoot:   req.GetThreadRoot(),
+			Ttl:          req.GetTtl(),
+			TtlAfterRead: req.GetTtlAfterRead(),
 		},
 	})
+	if errors.Is(err, client.ErrBadRequest) {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
 	if err != nil {
 		_ = ctx.RespWithError(pkt.Status_SystemException, err)
 		return
 	}
+	if resp.Duplicate {
+		respDuplicate(ctx, resp)
+		return
+	}
 	// 3. 读取群成员列表
 	membersResp, err := h.groupService.Members(ctx.Session().GetApp(), &rpc.GroupMembersReq{
 		GroupID: group,
@@ -120,9 +220,13 @@ func (h *ChatHandler) DoGroupTalk(ctx x.Context) {
 		_ = ctx.RespWithError(pkt.Status_SystemException, err)
 		return
 	}
-	var members = make([]string, len(membersResp.Users))
-	for i, user := range membersResp.Users {
-		members[i] = user.Account
+	// 发送方的其他设备单独同步
+	var members = make([]string, 0, len(membersResp.Users))
+	for _, user := range membersResp.Users {
+		if user.Account == ctx.Session().GetAccount() {
+			continue
+		}
+		members = append(members, user.Account)
 	}
 	// 4. 批量寻址（群成员）
 	locs, err := ctx.GetLocations(members...)
@@ -131,27 +235,87 @@ func (h *ChatHandler) DoGroupTalk(ctx x.Context) {
 		return
 	}
 
+	push := &pkt.MessagePush{
+		MessageID:    resp.MessageID,
+		Type:         req.GetType(),
+		Body:         req.GetBody(),
+		Extra:        req.GetExtra(),
+		Sender:       ctx.Session().GetAccount(),
+		SendTime:     sendTime,
+		ReplyTo:      req.GetReplyTo(),
+		ThreadRoot:   req.GetThreadRoot(),
+		Ttl:          req.GetTtl(),
+		TtlAfterRead: req.GetTtlAfterRead(),
+		ExpireAt:     expireAt(sendTime, req.GetTtl(), req.GetTtlAfterRead()),
+		Seq:          resp.Seq,
+		ClientMsgID:  req.GetClientMsgID(),
+		Mentions:     req.GetMentions(),
+	}
 	// 5. 批量推送消息给成员
 	if len(locs) > 0 {
-		if err = ctx.Dispatch(&pkt.MessagePush{
-			MessageID: resp.MessageID,
-			Type:      req.GetType(),
-			Body:      req.GetBody(),
-			Extra:     req.GetExtra(),
-			Sender:    ctx.Session().GetAccount(),
-			SendTime:  sendTime,
-		}, locs...); err != nil {
+		if err = ctx.Dispatch(push, locs...); err != nil {
 			_ = ctx.RespWithError(pkt.Status_SystemException, err)
 			return
 		}
 	}
-	// 6. 返回一条resp消息
+	// 在线的成员在发送通知前过滤
+	h.offline(ctx.Session().GetApp(), group, push, members...)
+	// 6. 同步给发送方的其他设备
+	syncSent(ctx, push)
+	// 7. 返回一条resp消息
 	_ = ctx.Resp(pkt.Status_Success, &pkt.MessageResp{
 		MessageID: resp.MessageID,
 		SendTime:  sendTime,
+		Seq:       resp.Seq,
 	})
 }
 
+func (h *ChatHandler) schedule(ctx x.Context, req *pkt.MessageReq, group bool) {
+	if h.scheduler == nil {
+		_ = ctx.RespWithError(pkt.Status_NotImplemented, ErrScheduleDisabled)
+		return
+	}
+	h.scheduler.schedule(ctx, req, group)
+}
+
+func (h *ChatHandler) offline(app string, group string, push *pkt.MessagePush, accounts ...string) {
+	if h.notifier != nil {
+		h.notifier.Offline(app, group, push, accounts...)
+	}
+}
+
+func respDuplicate(ctx x.Context, resp *rpc.InsertMessageResp) {
+	_ = ctx.Resp(pkt.Status_Success, &pkt.MessageResp{
+		MessageID: resp.MessageID,
+		SendTime:  resp.SendTime,
+		Seq:       resp.Seq,
+	})
+}
+
+// expireAt 从发送开始计时的消息返回过期时间，ttlAfterRead的消息在读到之前为0
+func expireAt(sendTime int64, ttl int64, afterRead bool) int64 {
+	if ttl <= 0 || afterRead {
+		return 0
+	}
+	return sendTime + ttl
+}
+
+// syncSent 把消息带上self标记推送给发送方的其他在线设备，Dispatch会跳过当前的channel。
+// 消息已经保存，同步失败时由其他设备的离线同步兜底
+func syncSent(ctx x.Context, push *pkt.MessagePush) {
+	locs, err := ctx.GetLocations(ctx.Session().GetAccount())
+	if err != nil {
+		if !errors.Is(err, x.ErrSessionNil) {
+			logger.WithField("func", "syncSent").Warn(err)
+		}
+		return
+	}
+	push.Self = true
+	if err = ctx.Dispatch(push, locs...); err != nil {
+		logger.WithField("func", "syncSent").Warn(err)
+	}
+}
+
 func (h *ChatHandler) DoTalkAck(ctx x.Context) {
 	var req pkt.MessageAckReq
 	if err := ctx.ReadBody(&req); err != nil {
@@ -169,3 +333,19 @@ func (h *ChatHandler) DoTalkAck(ctx x.Context) {
 	}
 	_ = ctx.Resp(pkt.Status_Success, nil)
 }
+
+// DoTalkFallback 网关重传失败的消息，重置接收方的离线同步位置，由离线同步兜底
+// 网关内部指令，不需要回复
+func (h *ChatHandler) DoTalkFallback(ctx x.Context) {
+	var req pkt.MessageFallbackReq
+	if err := ctx.ReadBody(&req); err != nil {
+		return
+	}
+	err := h.msgService.Rewind(ctx.Session().GetApp(), &rpc.RewindMessageReq{
+		Account:    ctx.Session().GetAccount(),
+		MessageIDs: req.GetMessageIDs(),
+	})
+	if err != nil {
+		logger.WithField("func", "DoTalkFallback").Warn(err)
+	}
+}
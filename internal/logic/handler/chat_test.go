@@ -0,0 +1,66 @@
+package handler
+
+import (
+	"X_IM/internal/logic/client"
+	"X_IM/internal/logic/conf"
+	"X_IM/pkg/wire/pkt"
+	"X_IM/pkg/wire/rpc"
+	"X_IM/pkg/x"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mockInsert 第一次写入之后按clientMsgID返回原来的消息
+type mockInsert struct {
+	client.Message
+	inserted map[string]*rpc.InsertMessageResp
+}
+
+func (m *mockInsert) InsertUser(app string, req *rpc.InsertMessageReq) (*rpc.InsertMessageResp, error) {
+	if resp, ok := m.inserted[req.ClientMsgID]; ok {
+		return &rpc.InsertMessageResp{MessageID: resp.MessageID, SendTime: resp.SendTime, Seq: resp.Seq, Duplicate: true}, nil
+	}
+	resp := &rpc.InsertMessageResp{MessageID: int64(len(m.inserted) + 1), SendTime: req.SendTime, Seq: int64(len(m.inserted) + 1)}
+	m.inserted[req.ClientMsgID] = resp
+	return resp, nil
+}
+
+func TestSingleTalkDuplicate(t *testing.T) {
+	h := NewChatHandler(&mockInsert{inserted: make(map[string]*rpc.InsertMessageResp)}, nil, nil, nil, conf.ReactionLimit{})
+	notifier := NewNotifyHandler(&mockDevices{}, &mockMuted{}, &mockSessions{}, func(app string) conf.Push {
+		return conf.Push{Provider: conf.PushProviderFile}
+	}, 1)
+	h.SetNotifier(notifier)
+	sessions := &mockSessions{locs: map[string][]*x.Location{
+		"bob": {{ChannelID: "b1", GateID: "gateway1", Device: "ios"}},
+	}}
+	talk := func(dest, clientMsgID string) *mockContext {
+		ctx := newMockContext(&pkt.Session{App: "app1", Account: "alice"}, &pkt.MessageReq{Type: 1, Body: "hi", ClientMsgID: clientMsgID})
+		ctx.header = &pkt.Header{Dest: dest}
+		ctx.sessions = sessions
+		h.DoSingleTalk(ctx)
+		return ctx
+	}
+
+	first := talk("bob", "c1")
+	assert.Equal(t, pkt.Status_Success, first.status)
+	assert.Len(t, first.dispatched, 1)
+	// 重发时只返回原来的消息，不再推送
+	retry := talk("bob", "c1")
+	assert.Equal(t, pkt.Status_Success, retry.status)
+	assert.Equal(t, first.resp.(*pkt.MessageResp).MessageID, retry.resp.(*pkt.MessageResp).MessageID)
+	assert.Equal(t, first.resp.(*pkt.MessageResp).SendTime, retry.resp.(*pkt.MessageResp).SendTime)
+	assert.Equal(t, first.resp.(*pkt.MessageResp).Seq, retry.resp.(*pkt.MessageResp).Seq)
+	assert.Empty(t, retry.dispatched)
+
+	// 离线的接收方也不会重复记录离线通知
+	first = talk("carol", "c2")
+	assert.Equal(t, pkt.Status_Success, first.status)
+	assert.Len(t, notifier.pending, 1)
+	notifier.pending = make(map[notifyKey]*pendingNotify)
+	retry = talk("carol", "c2")
+	assert.Equal(t, pkt.Status_Success, retry.status)
+	assert.Empty(t, retry.dispatched)
+	assert.Empty(t, notifier.pending)
+}
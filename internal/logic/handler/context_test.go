@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"X_IM/pkg/wire/pkt"
+	"X_IM/pkg/x"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// mockContext 保存请求，记录回复与下发的消息，没有实现的方法调用时会panic
+type mockContext struct {
+	x.Context
+	sessions   x.SessionStorage
+	header     *pkt.Header
+	session    *pkt.Session
+	req        proto.Message
+	status     pkt.Status
+	err        error
+	resp       proto.Message
+	dispatched []proto.Message
+}
+
+func newMockContext(session *pkt.Session, req proto.Message) *mockContext {
+	return &mockContext{session: session, req: req, status: -1}
+}
+
+func (c *mockContext) ReadBody(val proto.Message) error {
+	buf, err := proto.Marshal(c.req)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(buf, val)
+}
+
+func (c *mockContext) Header() *pkt.Header {
+	return c.header
+}
+
+func (c *mockContext) Session() x.Session {
+	return c.session
+}
+
+func (c *mockContext) RespWithError(status pkt.Status, err error) error {
+	c.status, c.err = status, err
+	return nil
+}
+
+func (c *mockContext) Resp(status pkt.Status, body proto.Message) error {
+	c.status, c.resp = status, body
+	return nil
+}
+
+func (c *mockContext) Dispatch(body proto.Message, recvs ...*x.Location) error {
+	c.dispatched = append(c.dispatched, body)
+	return nil
+}
+
+func (c *mockContext) GetLocations(accounts ...string) ([]*x.Location, error) {
+	return c.sessions.GetLocations(accounts...)
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"X_IM/internal/logic/client"
+	"X_IM/pkg/logger"
+	"X_IM/pkg/wire/common"
+	"X_IM/pkg/wire/pkt"
+	"X_IM/pkg/wire/rpc"
+	"X_IM/pkg/x"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+var (
+	ErrEmptyBody    = errors.New("empty body")
+	ErrBodyTooLong  = fmt.Errorf("body must be at most %d characters", common.MessageMaxBodyLength)
+	ErrExtraTooLong = fmt.Errorf("extra must be at most %d characters", common.MessageMaxExtraLength)
+)
+
+// DoEdit 编辑自己发送的文本消息，通知在线的接收方与自己的其他设备
+func (h *ChatHandler) DoEdit(ctx x.Context) {
+	var req pkt.MessageEditReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	if req.MessageID <= 0 {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrInvalidMessageID)
+		return
+	}
+	if req.Body == "" {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrEmptyBody)
+		return
+	}
+	if utf8.RuneCountInString(req.Body) > common.MessageMaxBodyLength {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrBodyTooLong)
+		return
+	}
+	if utf8.RuneCountInString(req.Extra) > common.MessageMaxExtraLength {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrExtraTooLong)
+		return
+	}
+	app := ctx.Session().GetApp()
+	sender := ctx.Session().GetAccount()
+	resp, err := h.msgService.Edit(app, &rpc.EditMessageReq{
+		Account:   sender,
+		MessageID: req.MessageID,
+		Body:      req.Body,
+		Extra:     req.Extra,
+		Window:    int64(h.editWindowOf(app)),
+	})
+	if errors.Is(err, client.ErrBadRequest) {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	if errors.Is(err, client.ErrForbidden) {
+		_ = ctx.RespWithError(pkt.Status_Forbidden, err)
+		return
+	}
+	if errors.Is(err, client.ErrExpired) {
+		_ = ctx.RespWithError(pkt.Status_OperationExpired, err)
+		return
+	}
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	// 编辑已经保存，离线的接收方同步时得到最新版本
+	receivers, err := h.messageReceivers(app, sender, resp.Dest, resp.Group)
+	if err != nil {
+		logger.WithField("func", "DoEdit").Warn(err)
+	}
+	locs, err := ctx.GetLocations(append(receivers, sender)...)
+	if err != nil && !errors.Is(err, x.ErrSessionNil) {
+		logger.WithField("func", "DoEdit").Warn(err)
+	}
+	err = ctx.Dispatch(&pkt.MessageEditNotify{
+		MessageID: req.MessageID,
+		Sender:    sender,
+		Group:     resp.Group,
+		Version:   resp.Version,
+		Body:      req.Body,
+		Extra:     resp.Extra,
+	}, locs...)
+	if err != nil {
+		logger.WithField("func", "DoEdit").Warn(err)
+	}
+	_ = ctx.Resp(pkt.Status_Success, &pkt.MessageEditResp{
+		Version: resp.Version,
+	})
+}
@@ -0,0 +1,23 @@
+package handler
+
+import (
+	"X_IM/internal/logic/conf"
+	"X_IM/pkg/wire/common"
+	"X_IM/pkg/wire/pkt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEditBodyTooLong(t *testing.T) {
+	// 正文超长时不请求occult，msgService为nil
+	h := NewChatHandler(nil, nil, nil, nil, conf.ReactionLimit{})
+	ctx := newMockContext(&pkt.Session{App: "app1", Account: "alice"}, &pkt.MessageEditReq{
+		MessageID: 1,
+		Body:      strings.Repeat("长", common.MessageMaxBodyLength+1),
+	})
+	h.DoEdit(ctx)
+	assert.Equal(t, pkt.Status_InvalidPacketBody, ctx.status)
+	assert.Equal(t, ErrBodyTooLong, ctx.err)
+}
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"X_IM/internal/logic/client"
+	"X_IM/pkg/logger"
+	"X_IM/pkg/wire/common"
+	"X_IM/pkg/wire/pkt"
+	"X_IM/pkg/wire/rpc"
+	"X_IM/pkg/x"
+	"time"
+)
+
+// ExpireHandler 定期清理过期的阅后即焚消息，并把过期通知推送给在线的参与者。
+// 清理之前离线同步只返回过期消息的墓碑，多个实例同时清理时每条消息只通知一次
+type ExpireHandler struct {
+	msgService client.Message
+	sessions   x.SessionStorage
+	dispatcher x.Dispatcher
+}
+
+func NewExpireHandler(msg client.Message, sessions x.SessionStorage, dispatcher x.Dispatcher) *ExpireHandler {
+	return &ExpireHandler{
+		msgService: msg,
+		sessions:   sessions,
+		dispatcher: dispatcher,
+	}
+}
+
+// Sweep 每隔interval清理一次过期的消息，直到stop被关闭
+func (h *ExpireHandler) Sweep(interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if err := h.sweep(now.UnixNano()); err != nil {
+				logger.WithField("func", "ExpireSweep").Warn(err)
+			}
+		}
+	}
+}
+
+// sweep 分批清理before之前过期的消息，直到没有剩余
+func (h *ExpireHandler) sweep(before int64) error {
+	for {
+		resp, err := h.msgService.SweepExpired(&rpc.SweepExpiredReq{
+			Before: before,
+			Limit:  common.MessageMaxCountPerPage,
+		})
+		if err != nil {
+			return err
+		}
+		for _, expired := range resp.List {
+			if err = h.notify(expired); err != nil {
+				logger.WithField("func", "ExpireNotify").Warn(err)
+			}
+		}
+		if len(resp.List) < common.MessageMaxCountPerPage {
+			return nil
+		}
+	}
+}
+
+// notify 推送给有这条消息索引的账号
+func (h *ExpireHandler) notify(expired *rpc.ExpiredMessage) error {
+	return pushTo(h.sessions, h.dispatcher, common.CommandChatTalkExpired, expired.Group, &pkt.MessageExpiredNotify{
+		MessageID: expired.MessageID,
+		Group:     expired.Group,
+	}, expired.Accounts...)
+}
@@ -1,17 +1,36 @@
 package handler
 
 import (
+	"X_IM/internal/logic/conf"
 	"X_IM/pkg/logger"
 	"X_IM/pkg/wire/pkt"
 	"X_IM/pkg/x"
 	"errors"
+	"sort"
 )
 
+// DefaultDevice 客户端没有上报设备类型时使用
+const DefaultDevice = "default"
+
+// PresenceNotifier 登录、登出后通知账号的在线状态可能发生了变化
+type PresenceNotifier interface {
+	Changed(account string)
+	// SignedIn 登录后记录账号所属的app并通知状态变化
+	SignedIn(app string, account string)
+}
+
 type LoginHandler struct {
+	policyOf func(app string) conf.DevicePolicy
+	leaser   x.SessionLeaser
+	notifier PresenceNotifier
 }
 
-func NewLoginHandler() *LoginHandler {
-	return &LoginHandler{}
+func NewLoginHandler(policyOf func(app string) conf.DevicePolicy, leaser x.SessionLeaser, notifier PresenceNotifier) *LoginHandler {
+	return &LoginHandler{
+		policyOf: policyOf,
+		leaser:   leaser,
+		notifier: notifier,
+	}
 }
 
 func (h *LoginHandler) DoLogin(ctx x.Context) {
@@ -21,35 +40,46 @@ func (h *LoginHandler) DoLogin(ctx x.Context) {
 		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
 		return
 	}
+	if session.Device == "" {
+		session.Device = DefaultDevice
+	}
 
 	log.Infof("do login of %v ", session.String())
 
-	// 2. 检查当前账号是否在其他地方登录
-	old, err := ctx.GetLocation(session.Account, "")
+	// 2. 检查当前账号在哪些设备上登录
+	olds, err := ctx.GetLocations(session.Account)
 	if err != nil && !errors.Is(err, x.ErrSessionNil) {
 		_ = ctx.RespWithError(pkt.Status_SystemException, err)
 		return
 	}
 
-	if old != nil {
-		//将旧的连接关闭，通知用户被踢下线
-		_ = ctx.Dispatch(&pkt.KickOutNotify{
-			//在web客户端由于网络IO都是异步操作，并且会自动重连
-			//不能使用account作为唯一标识，否则很容易导致自己踢自己下线
-			ChannelID: old.ChannelID,
-		}, old)
+	// 3. 按app的多端登录策略踢掉旧的连接
+	for _, old := range kickOut(h.policyOf(session.App), session.Device, olds) {
+		if err = kick(ctx, session.Account, old); err != nil {
+			_ = ctx.RespWithError(pkt.Status_SystemException, err)
+			return
+		}
 	}
 
 	//将新的连接加入到sessionStorage中
-	err = ctx.Add(&session)
+	prev, err := ctx.Add(&session)
 	if err != nil {
 		_ = ctx.RespWithError(pkt.Status_SystemException, err)
 		return
 	}
+	// 同一设备并发登录时，Add返回被替换的位置
+	if prev != nil && prev.ChannelID != session.ChannelID {
+		if err = kick(ctx, session.Account, prev); err != nil {
+			_ = ctx.RespWithError(pkt.Status_SystemException, err)
+			return
+		}
+	}
+	h.notifier.SignedIn(session.App, session.Account)
 	//return login succeed
 	var resp = &pkt.LoginResp{
-		ChannelID: session.ChannelID,
-		Account:   session.Account,
+		ChannelID:   session.ChannelID,
+		Account:     session.Account,
+		ResumeToken: session.ResumeToken,
 	}
 	_ = ctx.Resp(pkt.Status_Success, resp)
 }
@@ -58,11 +88,59 @@ func (h *LoginHandler) DoLogout(ctx x.Context) {
 	logger.WithField("func", "DoLogout").Infof("do Logout of %s %s ",
 		ctx.Session().GetChannelID(), ctx.Session().GetAccount())
 
+	// 被踢下线的channel登出时，账号的位置已经指向新的channel，storage不会删除它
 	err := ctx.Delete(ctx.Session().GetAccount(), ctx.Session().GetChannelID())
 	if err != nil {
 		_ = ctx.RespWithError(pkt.Status_SystemException, err)
 		return
 	}
+	h.notifier.Changed(ctx.Session().GetAccount())
 
 	_ = ctx.Resp(pkt.Status_Success, nil)
 }
+
+// DoRenew 网关定期续期在线channel的会话
+// 网关内部指令，不需要回复
+func (h *LoginHandler) DoRenew(ctx x.Context) {
+	var req pkt.SessionRenewReq
+	if err := ctx.ReadBody(&req); err != nil {
+		return
+	}
+	err := h.leaser.Renew(ctx.Session().GetGateID(), req.GetLeases()...)
+	if err != nil {
+		logger.WithField("func", "DoRenew").Warn(err)
+	}
+}
+
+// kick 通知旧的连接下线并删除它的会话，位置已经指向其他channel时只删除会话
+func kick(ctx x.Context, account string, old *x.Location) error {
+	logger.WithField("func", "kick").Infof("kick out %s of %s on %s", old.ChannelID, account, old.Device)
+	//将旧的连接关闭，通知用户被踢下线
+	_ = ctx.Dispatch(&pkt.KickOutNotify{
+		//在web客户端由于网络IO都是异步操作，并且会自动重连
+		//不能使用account作为唯一标识，否则很容易导致自己踢自己下线
+		ChannelID: old.ChannelID,
+	}, old)
+	// 网关收到通知后关闭旧的channel，旧会话在这里直接删除
+	return ctx.Delete(account, old.ChannelID)
+}
+
+// kickOut 返回新设备登录时需要踢下线的旧设备
+func kickOut(policy conf.DevicePolicy, device string, olds []*x.Location) []*x.Location {
+	var kicked, others []*x.Location
+	for _, old := range olds {
+		if policy.Mode == conf.DeviceSingle || old.Device == device {
+			kicked = append(kicked, old)
+		} else {
+			others = append(others, old)
+		}
+	}
+	if policy.Mode == conf.DeviceMulti && policy.Max > 0 && len(others) >= policy.Max {
+		// 加上新设备超出数量限制，按登录时间踢掉最早登录的设备。没有登录时间的旧数据视为最早
+		sort.SliceStable(others, func(i, j int) bool {
+			return others[i].LoginTime < others[j].LoginTime
+		})
+		kicked = append(kicked, others[:len(others)-policy.Max+1]...)
+	}
+	return kicked
+}
@@ -0,0 +1,36 @@
+package handler
+
+import (
+	"X_IM/internal/logic/conf"
+	"X_IM/pkg/x"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKickOutOldest(t *testing.T) {
+	olds := []*x.Location{
+		{ChannelID: "c2", Device: "pad", LoginTime: 300},
+		{ChannelID: "c1", Device: "pc", LoginTime: 100},
+		{ChannelID: "c3", Device: "web", LoginTime: 200},
+	}
+	// 同类设备总是被踢掉
+	kicked := kickOut(conf.DevicePolicy{Mode: conf.DeviceMulti, Max: 5}, "pc", olds)
+	assert.Equal(t, []*x.Location{olds[1]}, kicked)
+
+	// 超出数量限制时按登录时间从早到晚踢掉，保留最近登录的设备
+	kicked = kickOut(conf.DevicePolicy{Mode: conf.DeviceMulti, Max: 2}, "ios", olds)
+	assert.Equal(t, 2, len(kicked))
+	assert.Equal(t, "c1", kicked[0].ChannelID)
+	assert.Equal(t, "c3", kicked[1].ChannelID)
+
+	kicked = kickOut(conf.DevicePolicy{Mode: conf.DeviceSingle}, "ios", olds)
+	assert.Equal(t, 3, len(kicked))
+}
+
+func TestLocationLoginTime(t *testing.T) {
+	loc := x.Location{ChannelID: "c1", GateID: "g1", Device: "pc", LoginTime: 1234}
+	var decoded x.Location
+	assert.Nil(t, decoded.Unmarshal(loc.Bytes()))
+	assert.Equal(t, loc, decoded)
+}
@@ -0,0 +1,321 @@
+package handler
+
+import (
+	"X_IM/internal/logic/client"
+	"X_IM/internal/logic/conf"
+	"X_IM/internal/logic/push"
+	"X_IM/pkg/logger"
+	"X_IM/pkg/wire/common"
+	"X_IM/pkg/wire/pkt"
+	"X_IM/pkg/wire/rpc"
+	"X_IM/pkg/x"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/panjf2000/ants/v2"
+)
+
+var ErrInvalidDeviceToken = errors.New("platform must be apns or fcm and token must not be empty")
+
+// notifyRetryInterval 通知发送失败后第一次重试的间隔，之后每次翻倍
+const notifyRetryInterval = time.Second
+
+// NotifyHandler 接收方没有在线的设备时，通过APNs、FCM等推送服务发送离线通知。
+// 消息先记录为待通知，按interval合并后发送，同一会话发给同一账号的多条消息合并为一条通知；
+// 发送前再次检查账号是否在线，已经上线的不再通知；设置了免打扰的会话只在被提及时通知
+type NotifyHandler struct {
+	devices    client.Device
+	msgService client.Message
+	sessions   x.LocationBatcher
+	// pushOf 返回app的推送配置
+	pushOf        func(app string) conf.Push
+	retryInterval time.Duration
+	// pool 限制同时发送通知的并发数，满了之后flush等待空闲的worker
+	pool *ants.Pool
+
+	sync.Mutex
+	pending   map[notifyKey]*pendingNotify
+	providers map[string]push.Provider
+}
+
+// notifyKey 同一app中同一账号在同一会话的通知合并
+type notifyKey struct {
+	app     string
+	account string
+	// conversation 单聊为发送方，群聊为群ID
+	conversation string
+}
+
+type pendingNotify struct {
+	group string
+	count int
+	last  *pkt.MessagePush
+	// mentioned 合并的消息中有提及这个账号的
+	mentioned bool
+}
+
+// mutedKey 账号设置了免打扰的会话
+type mutedKey struct {
+	account string
+	dest    string
+	group   bool
+}
+
+// NewNotifyHandler workers为同时发送通知的最大并发数
+func NewNotifyHandler(devices client.Device, msg client.Message, sessions x.LocationBatcher, pushOf func(app string) conf.Push, workers int) *NotifyHandler {
+	pool, _ := ants.NewPool(workers)
+	return &NotifyHandler{
+		devices:       devices,
+		msgService:    msg,
+		sessions:      sessions,
+		pushOf:        pushOf,
+		retryInterval: notifyRetryInterval,
+		pool:          pool,
+		pending:       make(map[notifyKey]*pendingNotify),
+		providers:     make(map[string]push.Provider),
+	}
+}
+
+// DoRegister 注册当前设备的推送token，覆盖同类设备之前的token
+func (h *NotifyHandler) DoRegister(ctx x.Context) {
+	var req pkt.DeviceTokenReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	if (req.Platform != push.PlatformAPNs && req.Platform != push.PlatformFCM) ||
+		req.Token == "" || len(req.Token) > common.DeviceTokenMaxLength {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrInvalidDeviceToken)
+		return
+	}
+	err := h.devices.Register(ctx.Session().GetApp(), &rpc.RegisterTokenReq{
+		Token: &rpc.DeviceToken{
+			Account:  ctx.Session().GetAccount(),
+			Device:   ctx.Session().GetDevice(),
+			Platform: req.Platform,
+			Token:    req.Token,
+		},
+	})
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	_ = ctx.Resp(pkt.Status_Success, nil)
+}
+
+// DoUnregister 注销当前设备的推送token，例如用户关闭了通知
+func (h *NotifyHandler) DoUnregister(ctx x.Context) {
+	err := h.devices.Unregister(ctx.Session().GetApp(), &rpc.UnregisterTokenReq{
+		Account: ctx.Session().GetAccount(),
+		Device:  ctx.Session().GetDevice(),
+	})
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	_ = ctx.Resp(pkt.Status_Success, nil)
+}
+
+// Offline 记录发给accounts的消息为待通知，group为空时是单聊。没有配置推送服务的app忽略
+func (h *NotifyHandler) Offline(app string, group string, msg *pkt.MessagePush, accounts ...string) {
+	if len(accounts) == 0 || h.pushOf(app).Provider == "" {
+		return
+	}
+	conversation := group
+	if conversation == "" {
+		conversation = msg.Sender
+	}
+	var mentions = make(map[string]bool, len(msg.Mentions))
+	for _, account := range msg.Mentions {
+		mentions[account] = true
+	}
+	h.Lock()
+	defer h.Unlock()
+	for _, account := range accounts {
+		key := notifyKey{app: app, account: account, conversation: conversation}
+		p, ok := h.pending[key]
+		if !ok {
+			p = &pendingNotify{group: group}
+			h.pending[key] = p
+		}
+		p.count++
+		p.last = msg
+		p.mentioned = p.mentioned || mentions[account]
+	}
+}
+
+// Notify 每隔interval发送一次合并后的通知，直到stop被关闭
+func (h *NotifyHandler) Notify(interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			h.flush()
+		}
+	}
+}
+
+func (h *NotifyHandler) flush() {
+	log := logger.WithField("func", "NotifyFlush")
+	h.Lock()
+	pending := h.pending
+	h.pending = make(map[notifyKey]*pendingNotify)
+	h.Unlock()
+
+	var apps = make(map[string]map[notifyKey]*pendingNotify)
+	for key, p := range pending {
+		if apps[key.app] == nil {
+			apps[key.app] = make(map[notifyKey]*pendingNotify)
+		}
+		apps[key.app][key] = p
+	}
+	for app, list := range apps {
+		if err := h.notifyApp(app, list); err != nil {
+			log.Warn(err)
+		}
+	}
+}
+
+// notifyApp 读取仍然离线的账号的token，跳过免打扰且没有被提及的会话，每台设备单独发送
+func (h *NotifyHandler) notifyApp(app string, list map[notifyKey]*pendingNotify) error {
+	provider, err := h.provider(app)
+	if err != nil || provider == nil {
+		return err
+	}
+	var accounts = make([]string, 0, len(list))
+	var seen = make(map[string]bool, len(list))
+	for key := range list {
+		if !seen[key.account] {
+			seen[key.account] = true
+			accounts = append(accounts, key.account)
+		}
+	}
+	online, err := h.sessions.GetAccountLocations(accounts...)
+	if err != nil {
+		return err
+	}
+	var offline = make([]string, 0, len(accounts))
+	for _, account := range accounts {
+		if len(online[account]) == 0 {
+			offline = append(offline, account)
+		}
+	}
+	if len(offline) == 0 {
+		return nil
+	}
+	muted, err := h.muted(app, offline)
+	if err != nil {
+		return err
+	}
+	resp, err := h.devices.Tokens(app, &rpc.DeviceTokensReq{Accounts: offline})
+	if err != nil {
+		return err
+	}
+	var tokens = make(map[string][]*rpc.DeviceToken)
+	for _, token := range resp.Tokens {
+		tokens[token.Account] = append(tokens[token.Account], token)
+	}
+	retry := h.pushOf(app).Retry
+	for key, p := range list {
+		if muted[mutedKey{account: key.account, dest: key.conversation, group: p.group != ""}] && !p.mentioned {
+			continue
+		}
+		for _, token := range tokens[key.account] {
+			token, n := token, newNotification(key.conversation, p, token)
+			if err = h.pool.Submit(func() {
+				h.send(app, provider, retry, token, n)
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// muted 批量读取离线账号设置了免打扰的会话
+func (h *NotifyHandler) muted(app string, accounts []string) (map[mutedKey]bool, error) {
+	resp, err := h.msgService.MutedConversations(app, &rpc.MutedConversationsReq{Accounts: accounts})
+	if err != nil {
+		return nil, err
+	}
+	var muted = make(map[mutedKey]bool, len(resp.List))
+	for _, c := range resp.List {
+		muted[mutedKey{account: c.Account, dest: c.Dest, group: c.Group}] = true
+	}
+	return muted, nil
+}
+
+// send 发送失败后按指数退避重试，token失效时注销它
+func (h *NotifyHandler) send(app string, provider push.Provider, retry int, token *rpc.DeviceToken, n *push.Notification) {
+	log := logger.WithField("func", "NotifySend")
+	interval := h.retryInterval
+	for i := 0; ; i++ {
+		err := provider.Send(n)
+		if err == nil {
+			return
+		}
+		if errors.Is(err, push.ErrInvalidToken) {
+			err = h.devices.Unregister(app, &rpc.UnregisterTokenReq{
+				Account: token.Account,
+				Token:   token.Token,
+			})
+			if err != nil {
+				log.Warn(err)
+			}
+			return
+		}
+		if i >= retry {
+			log.Warn(err)
+			return
+		}
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+// provider 按app的配置创建推送服务并缓存
+func (h *NotifyHandler) provider(app string) (push.Provider, error) {
+	h.Lock()
+	defer h.Unlock()
+	if provider, ok := h.providers[app]; ok {
+		return provider, nil
+	}
+	provider, err := push.NewProvider(h.pushOf(app))
+	if err != nil {
+		return nil, err
+	}
+	h.providers[app] = provider
+	return provider, nil
+}
+
+// newNotification 用会话中最后一条消息生成通知，阅后即焚的消息不带正文
+func newNotification(conversation string, p *pendingNotify, token *rpc.DeviceToken) *push.Notification {
+	body := []rune(p.last.Body)
+	if len(body) > common.NotificationMaxBody {
+		body = body[:common.NotificationMaxBody]
+	}
+	if p.last.Ttl > 0 {
+		body = nil
+	}
+	return &push.Notification{
+		Platform:   token.Platform,
+		Token:      token.Token,
+		Title:      p.last.Sender,
+		Body:       string(body),
+		Count:      p.count,
+		CollapseID: conversation,
+		Data: map[string]string{
+			"messageID": strconv.FormatInt(p.last.MessageID, 10),
+			"sender":    p.last.Sender,
+			"group":     p.group,
+		},
+	}
+}
@@ -0,0 +1,173 @@
+package handler
+
+import (
+	"X_IM/internal/logic/client"
+	"X_IM/internal/logic/conf"
+	"X_IM/internal/logic/push"
+	"X_IM/pkg/wire/pkt"
+	"X_IM/pkg/wire/rpc"
+	"X_IM/pkg/x"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockDevices struct {
+	client.Device
+	sync.Mutex
+	tokens       []*rpc.DeviceToken
+	unregistered []string
+}
+
+func (m *mockDevices) Tokens(app string, req *rpc.DeviceTokensReq) (*rpc.DeviceTokensResp, error) {
+	var resp rpc.DeviceTokensResp
+	for _, token := range m.tokens {
+		for _, account := range req.Accounts {
+			if token.Account == account {
+				resp.Tokens = append(resp.Tokens, token)
+			}
+		}
+	}
+	return &resp, nil
+}
+
+func (m *mockDevices) Unregister(app string, req *rpc.UnregisterTokenReq) error {
+	m.Lock()
+	m.unregistered = append(m.unregistered, req.Token)
+	m.Unlock()
+	return nil
+}
+
+type mockMuted struct {
+	client.Message
+	list []*rpc.MutedConversation
+}
+
+func (m *mockMuted) MutedConversations(app string, req *rpc.MutedConversationsReq) (*rpc.MutedConversationsResp, error) {
+	var resp rpc.MutedConversationsResp
+	for _, c := range m.list {
+		for _, account := range req.Accounts {
+			if c.Account == account {
+				resp.List = append(resp.List, c)
+			}
+		}
+	}
+	return &resp, nil
+}
+
+type mockProvider struct {
+	sync.Mutex
+	// fails 每个token前几次发送失败
+	fails map[string]int
+	sent  []*push.Notification
+}
+
+func (m *mockProvider) Send(n *push.Notification) error {
+	m.Lock()
+	defer m.Unlock()
+	if n.Token == "expired" {
+		return push.ErrInvalidToken
+	}
+	if m.fails[n.Token] > 0 {
+		m.fails[n.Token]--
+		return errors.New("unavailable")
+	}
+	m.sent = append(m.sent, n)
+	return nil
+}
+
+func TestNotifyCollapse(t *testing.T) {
+	sessions := &mockSessions{locs: map[string][]*x.Location{
+		"carol": {{ChannelID: "c1", GateID: "gateway1", Device: "pc"}},
+	}}
+	devices := &mockDevices{tokens: []*rpc.DeviceToken{
+		{Account: "bob", Device: "ios", Platform: push.PlatformAPNs, Token: "bob-ios"},
+		{Account: "bob", Device: "android", Platform: push.PlatformFCM, Token: "expired"},
+		{Account: "carol", Device: "ios", Platform: push.PlatformAPNs, Token: "carol-ios"},
+	}}
+	provider := &mockProvider{fails: map[string]int{"bob-ios": 1}}
+	h := NewNotifyHandler(devices, &mockMuted{}, sessions, func(app string) conf.Push {
+		if app == "disabled" {
+			return conf.Push{}
+		}
+		return conf.Push{Provider: conf.PushProviderFile, Retry: 2}
+	}, 2)
+	h.retryInterval = time.Millisecond
+	h.providers["x_t"] = provider
+
+	// 同一会话的多条消息合并为一条通知，在线的carol不通知
+	h.Offline("x_t", "", &pkt.MessagePush{MessageID: 1, Sender: "alice", Body: "hi"}, "bob")
+	h.Offline("x_t", "", &pkt.MessagePush{MessageID: 2, Sender: "alice", Body: "are you there"}, "bob")
+	h.Offline("x_t", "g1", &pkt.MessagePush{MessageID: 3, Sender: "alice", Body: "secret", Ttl: 1}, "bob", "carol")
+	h.Offline("disabled", "", &pkt.MessagePush{MessageID: 4, Sender: "alice", Body: "hi"}, "bob")
+	assert.Equal(t, 3, len(h.pending))
+	h.flush()
+	assert.Equal(t, 0, len(h.pending))
+
+	time.Sleep(time.Millisecond * 100)
+	provider.Lock()
+	defer provider.Unlock()
+	assert.Equal(t, 2, len(provider.sent))
+	for _, n := range provider.sent {
+		assert.Equal(t, "bob-ios", n.Token)
+		switch n.CollapseID {
+		case "alice":
+			assert.Equal(t, 2, n.Count)
+			assert.Equal(t, "are you there", n.Body)
+			assert.Equal(t, "2", n.Data["messageID"])
+		case "g1":
+			// 阅后即焚的消息不带正文
+			assert.Equal(t, 1, n.Count)
+			assert.Equal(t, "", n.Body)
+			assert.Equal(t, "g1", n.Data["group"])
+		default:
+			t.Errorf("unexpected collapseID %s", n.CollapseID)
+		}
+	}
+	// 失效的token被注销，不重试
+	devices.Lock()
+	defer devices.Unlock()
+	assert.Equal(t, []string{"expired", "expired"}, devices.unregistered)
+}
+
+func TestNotifyMuted(t *testing.T) {
+	devices := &mockDevices{tokens: []*rpc.DeviceToken{
+		{Account: "bob", Device: "ios", Platform: push.PlatformAPNs, Token: "bob-ios"},
+	}}
+	muted := &mockMuted{list: []*rpc.MutedConversation{
+		{Account: "bob", Dest: "g1", Group: true},
+		{Account: "bob", Dest: "g2", Group: true},
+		{Account: "bob", Dest: "dave"},
+		// 同名的群与单聊互不影响
+		{Account: "bob", Dest: "alice", Group: true},
+	}}
+	provider := &mockProvider{}
+	h := NewNotifyHandler(devices, muted, &mockSessions{}, func(app string) conf.Push {
+		return conf.Push{Provider: conf.PushProviderFile}
+	}, 1)
+	h.providers["x_t"] = provider
+
+	// 免打扰的群只在被提及时通知，合并的消息中任意一条提及即可
+	h.Offline("x_t", "g1", &pkt.MessagePush{MessageID: 1, Sender: "alice", Body: "hi"}, "bob")
+	h.Offline("x_t", "g2", &pkt.MessagePush{MessageID: 2, Sender: "alice", Body: "@bob", Mentions: []string{"bob"}}, "bob")
+	h.Offline("x_t", "g2", &pkt.MessagePush{MessageID: 3, Sender: "carol", Body: "later"}, "bob")
+	h.Offline("x_t", "", &pkt.MessagePush{MessageID: 4, Sender: "dave", Body: "hi"}, "bob")
+	h.Offline("x_t", "", &pkt.MessagePush{MessageID: 5, Sender: "alice", Body: "hi"}, "bob")
+	h.flush()
+
+	time.Sleep(time.Millisecond * 100)
+	provider.Lock()
+	defer provider.Unlock()
+	var collapsed []string
+	for _, n := range provider.sent {
+		collapsed = append(collapsed, n.CollapseID)
+		if n.CollapseID == "g2" {
+			assert.Equal(t, 2, n.Count)
+			assert.Equal(t, "3", n.Data["messageID"])
+		}
+	}
+	assert.ElementsMatch(t, []string{"g2", "alice"}, collapsed)
+}
@@ -28,6 +28,7 @@ func (h *OfflineHandler) DoSyncIndex(ctx x.Context) {
 	resp, err := h.msgService.GetMessageIndex(ctx.Session().GetApp(), &rpc.GetOfflineMessageIndexReq{
 		Account:   ctx.Session().GetAccount(),
 		MessageID: req.GetMessageID(),
+		WithSent:  req.GetWithSent(),
 	})
 	if err != nil {
 		_ = ctx.RespWithError(pkt.Status_SystemException, err)
@@ -41,6 +42,8 @@ func (h *OfflineHandler) DoSyncIndex(ctx x.Context) {
 			SendTime:  val.SendTime,
 			AccountB:  val.AccountB,
 			Group:     val.Group,
+			Seq:       val.Seq,
+			Expired:   val.Expired,
 		}
 	}
 	_ = ctx.Resp(pkt.Status_Success, &pkt.MessageIndexResp{
@@ -66,16 +69,193 @@ func (h *OfflineHandler) DoSyncContent(ctx x.Context) {
 		_ = ctx.RespWithError(pkt.Status_SystemException, err)
 		return
 	}
-	var list = make([]*pkt.MessageContent, len(resp.List))
+	_ = ctx.Resp(pkt.Status_Success, &pkt.MessageContentResp{
+		Contents: toContents(resp.List),
+	})
+}
+
+// DoConversationList 按最后一条消息从新到旧分页读取会话列表与未读数，不受离线索引数量的限制
+func (h *OfflineHandler) DoConversationList(ctx x.Context) {
+	var req pkt.ConversationListReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	resp, err := h.msgService.Conversations(ctx.Session().GetApp(), &rpc.ConversationsReq{
+		Account: ctx.Session().GetAccount(),
+		Before:  req.Before,
+		Limit:   req.Limit,
+	})
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	var list = make([]*pkt.Conversation, len(resp.List))
 	for i, val := range resp.List {
-		list[i] = &pkt.MessageContent{
-			MessageID: val.ID,
-			Type:      val.Type,
-			Body:      val.Body,
-			Extra:     val.Extra,
+		list[i] = &pkt.Conversation{
+			Dest:          val.Dest,
+			Group:         val.Group,
+			LastMessageID: val.LastMessageID,
+			LastSendTime:  val.LastSendTime,
+			Unread:        val.Unread,
+			LastSeq:       val.LastSeq,
+			Muted:         val.Muted,
 		}
 	}
-	_ = ctx.Resp(pkt.Status_Success, &pkt.MessageContentResp{
-		Contents: list,
+	_ = ctx.Resp(pkt.Status_Success, &pkt.ConversationListResp{
+		List: list,
+		More: resp.More,
 	})
 }
+
+// DoConversationMute 设置会话免打扰，会话中的消息照常保存与推送，离线时只在被提及时发送通知
+func (h *OfflineHandler) DoConversationMute(ctx x.Context) {
+	var req pkt.ConversationMuteReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	if req.Dest == "" {
+		_ = ctx.RespWithError(pkt.Status_NoDestination, ErrNoDestination)
+		return
+	}
+	err := h.msgService.ConversationMute(ctx.Session().GetApp(), &rpc.ConversationMuteReq{
+		Account: ctx.Session().GetAccount(),
+		Dest:    req.Dest,
+		Group:   req.Group,
+		Muted:   req.Muted,
+	})
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	_ = ctx.Resp(pkt.Status_Success, nil)
+}
+
+// DoConversationSync 按序号分页同步会话中的消息索引，客户端从本地最大的连续序号开始同步，
+// 推送中的序号不连续时说明中间有消息缺失
+func (h *OfflineHandler) DoConversationSync(ctx x.Context) {
+	var req pkt.ConversationSyncReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	if req.Dest == "" {
+		_ = ctx.RespWithError(pkt.Status_NoDestination, ErrNoDestination)
+		return
+	}
+	resp, err := h.msgService.ConversationSync(ctx.Session().GetApp(), &rpc.ConversationSyncReq{
+		Account:        ctx.Session().GetAccount(),
+		Dest:           req.Dest,
+		Group:          req.Group,
+		After:          req.After,
+		Limit:          req.Limit,
+		AfterMessageID: req.AfterMessageID,
+	})
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	var list = make([]*pkt.MessageIndex, len(resp.List))
+	for i, val := range resp.List {
+		list[i] = &pkt.MessageIndex{
+			MessageID: val.MessageID,
+			Direction: val.Direction,
+			SendTime:  val.SendTime,
+			AccountB:  val.AccountB,
+			Group:     val.Group,
+			Seq:       val.Seq,
+			Expired:   val.Expired,
+		}
+	}
+	_ = ctx.Resp(pkt.Status_Success, &pkt.ConversationSyncResp{
+		Indexes: list,
+		More:    resp.More,
+	})
+}
+
+// DoConversationHistory 从游标开始向前或向后分页读取会话的历史消息和内容，用于向上翻看本地没有的消息。
+// 群聊只有当前的成员可以读取，只返回加入之后的消息
+func (h *OfflineHandler) DoConversationHistory(ctx x.Context) {
+	var req pkt.ConversationHistoryReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	if req.Dest == "" {
+		_ = ctx.RespWithError(pkt.Status_NoDestination, ErrNoDestination)
+		return
+	}
+	resp, err := h.msgService.ConversationHistory(ctx.Session().GetApp(), &rpc.ConversationHistoryReq{
+		Account:   ctx.Session().GetAccount(),
+		Dest:      req.Dest,
+		Group:     req.Group,
+		SendTime:  req.SendTime,
+		MessageID: req.MessageID,
+		Forward:   req.Forward,
+		Limit:     req.Limit,
+	})
+	if errors.Is(err, client.ErrForbidden) {
+		_ = ctx.RespWithError(pkt.Status_Forbidden, err)
+		return
+	}
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	var messages = make([]*rpc.Message, len(resp.List))
+	for i, val := range resp.List {
+		messages[i] = val.Message
+	}
+	contents := toContents(messages)
+	var list = make([]*pkt.HistoryMessage, len(resp.List))
+	for i, val := range resp.List {
+		list[i] = &pkt.HistoryMessage{
+			Sender:   val.Sender,
+			SendTime: val.SendTime,
+			Seq:      val.Seq,
+			Content:  contents[i],
+		}
+	}
+	_ = ctx.Resp(pkt.Status_Success, &pkt.ConversationHistoryResp{
+		List: list,
+		More: resp.More,
+	})
+}
+
+func toContents(messages []*rpc.Message) []*pkt.MessageContent {
+	var list = make([]*pkt.MessageContent, len(messages))
+	for i, val := range messages {
+		list[i] = &pkt.MessageContent{
+			MessageID:    val.ID,
+			Type:         val.Type,
+			Body:         val.Body,
+			Extra:        val.Extra,
+			Recalled:     val.Recalled,
+			Edited:       val.Version > 0,
+			Version:      val.Version,
+			ReplyTo:      val.ReplyTo,
+			ThreadRoot:   val.ThreadRoot,
+			Reactions:    toReactions(val.Reactions),
+			Ttl:          val.Ttl,
+			TtlAfterRead: val.TtlAfterRead,
+			ExpireAt:     val.ExpireAt,
+			Expired:      val.Expired,
+		}
+	}
+	return list
+}
+
+func toReactions(reactions []*rpc.Reaction) []*pkt.Reaction {
+	if len(reactions) == 0 {
+		return nil
+	}
+	var list = make([]*pkt.Reaction, len(reactions))
+	for i, val := range reactions {
+		list[i] = &pkt.Reaction{
+			Reaction: val.Reaction,
+			Count:    val.Count,
+		}
+	}
+	return list
+}
@@ -0,0 +1,367 @@
+package handler
+
+import (
+	"X_IM/pkg/logger"
+	"X_IM/pkg/wire/common"
+	"X_IM/pkg/wire/pkt"
+	"X_IM/pkg/x"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTooManyAccounts      = fmt.Errorf("accounts must be between 1 and %d", common.PresenceMaxAccounts)
+	ErrTooManySubscriptions = fmt.Errorf("subscriptions must not exceed %d", common.PresenceMaxSubscriptions)
+)
+
+// PresenceHandler 在线状态由会话推导，自定义状态与订阅关系保存在PresenceStorage中。
+// 账号登录、登出或修改状态后只记录为待通知，按interval合并后推送给订阅者，
+// 同一账号两次推送至少间隔minInterval，状态没有变化时不推送，连接频繁断开重连不会刷屏。
+// 在线状态只对同一app的账号可见
+type PresenceHandler struct {
+	presence   x.PresenceStorage
+	sessions   x.SessionStorage
+	dispatcher x.Dispatcher
+	// minInterval 同一账号两次推送的最小间隔
+	minInterval time.Duration
+
+	sync.Mutex
+	pending map[string]struct{}
+	// sent 最近minInterval内推送过的状态
+	sent map[string]sentPresence
+}
+
+type sentPresence struct {
+	at     time.Time
+	digest string
+}
+
+func NewPresenceHandler(presence x.PresenceStorage, sessions x.SessionStorage, dispatcher x.Dispatcher, minInterval time.Duration) *PresenceHandler {
+	return &PresenceHandler{
+		presence:    presence,
+		sessions:    sessions,
+		dispatcher:  dispatcher,
+		minInterval: minInterval,
+		pending:     make(map[string]struct{}),
+		sent:        make(map[string]sentPresence),
+	}
+}
+
+// DoQuery 批量查询在线状态，其他app的账号总是返回离线
+func (h *PresenceHandler) DoQuery(ctx x.Context) {
+	accounts, ok := readAccounts(ctx)
+	if !ok {
+		return
+	}
+	presences, err := h.loadVisible(ctx.Session().GetApp(), accounts...)
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	_ = ctx.Resp(pkt.Status_Success, &pkt.PresenceResp{Presences: presences})
+}
+
+// DoSubscribe 订阅账号的在线状态变化，同时返回它们当前的状态。
+// 其他app的账号不订阅，一个账号最多订阅PresenceMaxSubscriptions个账号
+func (h *PresenceHandler) DoSubscribe(ctx x.Context) {
+	accounts, ok := readAccounts(ctx)
+	if !ok {
+		return
+	}
+	subscriber, app := ctx.Session().GetAccount(), ctx.Session().GetApp()
+	apps, err := h.presence.GetApps(accounts...)
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	subscribed, err := h.presence.Subscriptions(subscriber)
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	var exists = make(map[string]bool, len(subscribed))
+	for _, account := range subscribed {
+		exists[account] = true
+	}
+	var added []string
+	for _, account := range accounts {
+		// 还没有登录过的账号不知道所属的app，推送时再按app过滤
+		if other, ok := apps[account]; ok && other != app {
+			continue
+		}
+		if !exists[account] {
+			exists[account] = true
+			added = append(added, account)
+		}
+	}
+	if len(subscribed)+len(added) > common.PresenceMaxSubscriptions {
+		_ = ctx.RespWithError(pkt.Status_LimitExceeded, ErrTooManySubscriptions)
+		return
+	}
+	if len(added) > 0 {
+		if err = h.presence.Subscribe(subscriber, added...); err != nil {
+			_ = ctx.RespWithError(pkt.Status_SystemException, err)
+			return
+		}
+	}
+	presences, err := h.loadVisible(app, accounts...)
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	_ = ctx.Resp(pkt.Status_Success, &pkt.PresenceResp{Presences: presences})
+}
+
+// DoUnsubscribe 取消订阅
+func (h *PresenceHandler) DoUnsubscribe(ctx x.Context) {
+	accounts, ok := readAccounts(ctx)
+	if !ok {
+		return
+	}
+	err := h.presence.Unsubscribe(ctx.Session().GetAccount(), accounts...)
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	_ = ctx.Resp(pkt.Status_Success, nil)
+}
+
+// DoSetStatus 设置自定义状态文本，为空时清除
+func (h *PresenceHandler) DoSetStatus(ctx x.Context) {
+	var req pkt.PresenceStatusReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	account := ctx.Session().GetAccount()
+	if err := h.presence.SetStatus(account, req.Status); err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	h.Changed(account)
+	_ = ctx.Resp(pkt.Status_Success, nil)
+}
+
+// readAccounts 读取请求中的账号，数量不合法时直接回复错误
+func readAccounts(ctx x.Context) ([]string, bool) {
+	var req pkt.PresenceReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return nil, false
+	}
+	if len(req.Accounts) == 0 || len(req.Accounts) > common.PresenceMaxAccounts {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrTooManyAccounts)
+		return nil, false
+	}
+	return req.Accounts, true
+}
+
+// SignedIn 记录账号所属的app，之后只有同一app的账号可以查询和订阅它的在线状态
+func (h *PresenceHandler) SignedIn(app string, account string) {
+	if err := h.presence.SetApp(account, app); err != nil {
+		logger.WithField("func", "SignedIn").Warn(err)
+	}
+	h.Changed(account)
+}
+
+// Changed 记录账号的在线状态可能发生了变化，由Notify合并后推送
+func (h *PresenceHandler) Changed(account string) {
+	h.Lock()
+	h.pending[account] = struct{}{}
+	h.Unlock()
+}
+
+// Notify 每隔interval推送一次待通知的在线状态，直到stop被关闭
+func (h *PresenceHandler) Notify(interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			h.flush(now)
+		}
+	}
+}
+
+func (h *PresenceHandler) flush(now time.Time) {
+	log := logger.WithField("func", "PresenceFlush")
+	h.Lock()
+	for account, last := range h.sent {
+		if _, ok := h.pending[account]; !ok && now.Sub(last.at) >= h.minInterval {
+			delete(h.sent, account)
+		}
+	}
+	var accounts = make([]string, 0, len(h.pending))
+	for account := range h.pending {
+		// 距离上次推送不足minInterval的留到之后再推送
+		if last, ok := h.sent[account]; ok && now.Sub(last.at) < h.minInterval {
+			continue
+		}
+		accounts = append(accounts, account)
+		delete(h.pending, account)
+	}
+	h.Unlock()
+
+	if len(accounts) == 0 {
+		return
+	}
+	presences, err := h.load(accounts...)
+	if err != nil {
+		log.Warn(err)
+		// 读取失败的账号留到下次推送
+		h.Lock()
+		for _, account := range accounts {
+			h.pending[account] = struct{}{}
+		}
+		h.Unlock()
+		return
+	}
+	for _, presence := range presences {
+		account := presence.Account
+		digest := presenceDigest(presence)
+		h.Lock()
+		last, ok := h.sent[account]
+		if !ok || last.digest != digest {
+			h.sent[account] = sentPresence{at: now, digest: digest}
+		}
+		h.Unlock()
+		// 合并后状态没有变化，例如断开后很快重连
+		if ok && last.digest == digest {
+			continue
+		}
+		if err = h.push(presence); err != nil {
+			log.Warn(err)
+		}
+	}
+}
+
+// push 把在线状态推送给同一app的订阅者的所有在线设备
+func (h *PresenceHandler) push(presence *pkt.Presence) error {
+	subscribers, err := h.presence.Subscribers(presence.Account)
+	if err != nil || len(subscribers) == 0 {
+		return err
+	}
+	apps, err := h.presence.GetApps(append(subscribers, presence.Account)...)
+	if err != nil {
+		return err
+	}
+	var visible = make([]string, 0, len(subscribers))
+	for _, subscriber := range subscribers {
+		if app, ok := apps[subscriber]; ok && app == apps[presence.Account] {
+			visible = append(visible, subscriber)
+		}
+	}
+	if len(visible) == 0 {
+		return nil
+	}
+	locs, err := h.sessions.GetLocations(visible...)
+	if err != nil {
+		if errors.Is(err, x.ErrSessionNil) {
+			return nil
+		}
+		return err
+	}
+	packet := pkt.New(common.CommandPresenceNotify)
+	packet.Flag = pkt.Flag_Push
+	packet.WriteBody(presence)
+
+	group := make(map[string][]string)
+	for _, loc := range locs {
+		group[loc.GateID] = append(group[loc.GateID], loc.ChannelID)
+	}
+	for gateway, channels := range group {
+		if err = h.dispatcher.Push(gateway, channels, packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadVisible 读取app中账号的在线状态，其他app或者还没有登录过的账号只返回离线
+func (h *PresenceHandler) loadVisible(app string, accounts ...string) ([]*pkt.Presence, error) {
+	apps, err := h.presence.GetApps(accounts...)
+	if err != nil {
+		return nil, err
+	}
+	var visible []string
+	for _, account := range accounts {
+		if apps[account] == app {
+			visible = append(visible, account)
+		}
+	}
+	loaded, err := h.load(visible...)
+	if err != nil {
+		return nil, err
+	}
+	var byAccount = make(map[string]*pkt.Presence, len(loaded))
+	for _, presence := range loaded {
+		byAccount[presence.Account] = presence
+	}
+	var presences = make([]*pkt.Presence, len(accounts))
+	for i, account := range accounts {
+		if presence, ok := byAccount[account]; ok {
+			presences[i] = presence
+		} else {
+			presences[i] = &pkt.Presence{Account: account}
+		}
+	}
+	return presences, nil
+}
+
+// load 从会话推导账号是否在线以及在线的设备
+func (h *PresenceHandler) load(accounts ...string) ([]*pkt.Presence, error) {
+	statuses, err := h.presence.GetStatus(accounts...)
+	if err != nil {
+		return nil, err
+	}
+	online, err := h.locations(accounts...)
+	if err != nil {
+		return nil, err
+	}
+	var presences = make([]*pkt.Presence, 0, len(accounts))
+	for _, account := range accounts {
+		locs := online[account]
+		presence := &pkt.Presence{
+			Account: account,
+			Online:  len(locs) > 0,
+			Status:  statuses[account],
+		}
+		for _, loc := range locs {
+			presence.Devices = append(presence.Devices, loc.Device)
+		}
+		sort.Strings(presence.Devices)
+		presences = append(presences, presence)
+	}
+	return presences, nil
+}
+
+// locations 按账号分组读取位置，SessionStorage支持批量读取时一次请求完成
+func (h *PresenceHandler) locations(accounts ...string) (map[string][]*x.Location, error) {
+	if batcher, ok := h.sessions.(x.LocationBatcher); ok {
+		return batcher.GetAccountLocations(accounts...)
+	}
+	var online = make(map[string][]*x.Location, len(accounts))
+	for _, account := range accounts {
+		locs, err := h.sessions.GetLocations(account)
+		if err != nil && !errors.Is(err, x.ErrSessionNil) {
+			return nil, err
+		}
+		if len(locs) > 0 {
+			online[account] = locs
+		}
+	}
+	return online, nil
+}
+
+func presenceDigest(presence *pkt.Presence) string {
+	return fmt.Sprintf("%t|%s|%s", presence.Online, strings.Join(presence.Devices, ","), presence.Status)
+}
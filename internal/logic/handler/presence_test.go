@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"X_IM/pkg/wire/common"
+	"X_IM/pkg/wire/pkt"
+	"X_IM/pkg/x"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockPresence struct {
+	x.PresenceStorage
+	subs map[string][]string
+	// apps 账号所属的app
+	apps      map[string]string
+	following map[string][]string
+}
+
+func (m *mockPresence) GetApps(accounts ...string) (map[string]string, error) {
+	var result = make(map[string]string)
+	for _, account := range accounts {
+		if app, ok := m.apps[account]; ok {
+			result[account] = app
+		}
+	}
+	return result, nil
+}
+
+func (m *mockPresence) Subscriptions(subscriber string) ([]string, error) {
+	return m.following[subscriber], nil
+}
+
+func (m *mockPresence) Subscribe(subscriber string, accounts ...string) error {
+	m.following[subscriber] = append(m.following[subscriber], accounts...)
+	for _, account := range accounts {
+		m.subs[account] = append(m.subs[account], subscriber)
+	}
+	return nil
+}
+
+func (m *mockPresence) GetStatus(accounts ...string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (m *mockPresence) Subscribers(account string) ([]string, error) {
+	return m.subs[account], nil
+}
+
+type mockSessions struct {
+	x.SessionStorage
+	locs map[string][]*x.Location
+}
+
+func (m *mockSessions) GetLocations(accounts ...string) ([]*x.Location, error) {
+	var result []*x.Location
+	for _, account := range accounts {
+		result = append(result, m.locs[account]...)
+	}
+	if len(result) == 0 {
+		return nil, x.ErrSessionNil
+	}
+	return result, nil
+}
+
+func (m *mockSessions) GetAccountLocations(accounts ...string) (map[string][]*x.Location, error) {
+	var result = make(map[string][]*x.Location)
+	for _, account := range accounts {
+		if locs := m.locs[account]; len(locs) > 0 {
+			result[account] = locs
+		}
+	}
+	return result, nil
+}
+
+type mockDispatcher struct {
+	pushed []*pkt.Presence
+}
+
+func (m *mockDispatcher) Push(gateway string, channels []string, p *pkt.LogicPkt) error {
+	var presence pkt.Presence
+	_ = p.ReadBody(&presence)
+	m.pushed = append(m.pushed, &presence)
+	return nil
+}
+
+func TestPresenceNotify(t *testing.T) {
+	sessions := &mockSessions{locs: map[string][]*x.Location{
+		"watcher": {{ChannelID: "w1", GateID: "gateway1", Device: "pc"}},
+	}}
+	dispatcher := &mockDispatcher{}
+	h := NewPresenceHandler(&mockPresence{
+		subs: map[string][]string{"alice": {"watcher", "stranger"}},
+		apps: map[string]string{"alice": "x_im", "watcher": "x_im", "stranger": "other"},
+	}, sessions, dispatcher, time.Second*5)
+	// 其他app的订阅者在另一个网关上，推送给它时会多出一次Push
+	sessions.locs["stranger"] = []*x.Location{{ChannelID: "s1", GateID: "gateway2", Device: "pc"}}
+	now := time.Now()
+
+	// 登录后推送上线
+	sessions.locs["alice"] = []*x.Location{{ChannelID: "a1", GateID: "gateway1", Device: "ios"}}
+	h.Changed("alice")
+	h.flush(now)
+	assert.Equal(t, 1, len(dispatcher.pushed))
+	assert.True(t, dispatcher.pushed[0].Online)
+	assert.Equal(t, []string{"ios"}, dispatcher.pushed[0].Devices)
+
+	// minInterval内的变化留到之后再推送，多次变化合并为一次
+	delete(sessions.locs, "alice")
+	h.Changed("alice")
+	h.flush(now.Add(time.Second))
+	sessions.locs["alice"] = []*x.Location{{ChannelID: "a2", GateID: "gateway1", Device: "ios"}}
+	h.Changed("alice")
+	h.flush(now.Add(time.Second * 2))
+	assert.Equal(t, 1, len(dispatcher.pushed))
+
+	// 断开后重连，状态没有变化，不推送
+	h.flush(now.Add(time.Second * 6))
+	assert.Equal(t, 1, len(dispatcher.pushed))
+
+	// 下线
+	delete(sessions.locs, "alice")
+	h.Changed("alice")
+	h.flush(now.Add(time.Second * 7))
+	assert.Equal(t, 2, len(dispatcher.pushed))
+	assert.False(t, dispatcher.pushed[1].Online)
+}
+
+func TestPresenceSameApp(t *testing.T) {
+	sessions := &mockSessions{locs: map[string][]*x.Location{
+		"alice": {{ChannelID: "a1", GateID: "gateway1", Device: "ios"}},
+		"bob":   {{ChannelID: "b1", GateID: "gateway1", Device: "pc"}},
+	}}
+	presence := &mockPresence{
+		subs:      map[string][]string{},
+		apps:      map[string]string{"watcher": "x_im", "alice": "x_im", "bob": "other"},
+		following: map[string][]string{},
+	}
+	h := NewPresenceHandler(presence, sessions, &mockDispatcher{}, time.Second)
+	session := &pkt.Session{Account: "watcher", App: "x_im"}
+
+	// 其他app的账号总是离线
+	ctx := newMockContext(session, &pkt.PresenceReq{Accounts: []string{"alice", "bob"}})
+	h.DoQuery(ctx)
+	assert.Equal(t, pkt.Status_Success, ctx.status)
+	presences := ctx.resp.(*pkt.PresenceResp).Presences
+	assert.True(t, presences[0].Online)
+	assert.False(t, presences[1].Online)
+	assert.Empty(t, presences[1].Devices)
+
+	// 不订阅其他app的账号，还没有登录过的账号可以订阅
+	ctx = newMockContext(session, &pkt.PresenceReq{Accounts: []string{"alice", "bob", "carol"}})
+	h.DoSubscribe(ctx)
+	assert.Equal(t, pkt.Status_Success, ctx.status)
+	assert.Equal(t, []string{"alice", "carol"}, presence.following["watcher"])
+
+	// 重复订阅不计入数量，超出上限时拒绝
+	for i := len(presence.following["watcher"]); i < common.PresenceMaxSubscriptions; i++ {
+		presence.following["watcher"] = append(presence.following["watcher"], fmt.Sprintf("account%d", i))
+	}
+	ctx = newMockContext(session, &pkt.PresenceReq{Accounts: []string{"alice"}})
+	h.DoSubscribe(ctx)
+	assert.Equal(t, pkt.Status_Success, ctx.status)
+	ctx = newMockContext(session, &pkt.PresenceReq{Accounts: []string{"dave"}})
+	h.DoSubscribe(ctx)
+	assert.Equal(t, pkt.Status_LimitExceeded, ctx.status)
+}
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"X_IM/internal/logic/client"
+	"X_IM/pkg/logger"
+	"X_IM/pkg/wire/common"
+	"X_IM/pkg/wire/pkt"
+	"X_IM/pkg/wire/rpc"
+	"X_IM/pkg/x"
+	"errors"
+	"fmt"
+)
+
+var ErrInvalidReaction = fmt.Errorf("reaction must be between 1 and %d bytes", common.ReactionMaxLength)
+
+// DoReactionAdd 给会话中的消息添加表情回应
+func (h *ChatHandler) DoReactionAdd(ctx x.Context) {
+	h.react(ctx, false)
+}
+
+// DoReactionRemove 删除自己添加的表情回应
+func (h *ChatHandler) DoReactionRemove(ctx x.Context) {
+	h.react(ctx, true)
+}
+
+// react 回应发生变化时通知会话中在线的成员与自己的其他设备
+func (h *ChatHandler) react(ctx x.Context, remove bool) {
+	var req pkt.MessageReactionReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	if req.MessageID <= 0 {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrInvalidMessageID)
+		return
+	}
+	if req.Reaction == "" || len(req.Reaction) > common.ReactionMaxLength {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrInvalidReaction)
+		return
+	}
+	app := ctx.Session().GetApp()
+	account := ctx.Session().GetAccount()
+	resp, err := h.msgService.React(app, &rpc.ReactMessageReq{
+		Account:    account,
+		MessageID:  req.MessageID,
+		Reaction:   req.Reaction,
+		Remove:     remove,
+		MaxKinds:   int32(h.reactionLimit.MaxKinds),
+		MaxPerUser: int32(h.reactionLimit.MaxPerUser),
+	})
+	if errors.Is(err, client.ErrForbidden) {
+		_ = ctx.RespWithError(pkt.Status_Forbidden, err)
+		return
+	}
+	if errors.Is(err, client.ErrBadRequest) {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	if errors.Is(err, client.ErrLimitExceeded) {
+		_ = ctx.RespWithError(pkt.Status_LimitExceeded, err)
+		return
+	}
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	if resp.Changed {
+		h.notifyReaction(ctx, resp, &pkt.MessageReactionNotify{
+			MessageID: req.MessageID,
+			Account:   account,
+			Group:     resp.Group,
+			Reaction:  req.Reaction,
+			Removed:   remove,
+			Reactions: toReactions(resp.Reactions),
+		})
+	}
+	_ = ctx.Resp(pkt.Status_Success, nil)
+}
+
+func (h *ChatHandler) notifyReaction(ctx x.Context, resp *rpc.ReactMessageResp, notify *pkt.MessageReactionNotify) {
+	log := logger.WithField("func", "notifyReaction")
+	account := ctx.Session().GetAccount()
+	receivers, err := h.messageReceivers(ctx.Session().GetApp(), account, resp.Dest, resp.Group)
+	if err != nil {
+		log.Warn(err)
+	}
+	locs, err := ctx.GetLocations(append(receivers, account)...)
+	if err != nil && !errors.Is(err, x.ErrSessionNil) {
+		log.Warn(err)
+	}
+	if err = ctx.Dispatch(notify, locs...); err != nil {
+		log.Warn(err)
+	}
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"X_IM/internal/logic/client"
+	"X_IM/internal/logic/conf"
+	"X_IM/pkg/wire/pkt"
+	"X_IM/pkg/wire/rpc"
+	"X_IM/pkg/x"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mockReact 每个账号对同一表情只记一次，超过maxPerUser时返回限流错误
+type mockReact struct {
+	client.Message
+	reacted map[string]bool
+	limits  []*rpc.ReactMessageReq
+}
+
+func (m *mockReact) React(app string, req *rpc.ReactMessageReq) (*rpc.ReactMessageResp, error) {
+	m.limits = append(m.limits, req)
+	key := req.Account + "|" + req.Reaction
+	if req.Remove {
+		changed := m.reacted[key]
+		delete(m.reacted, key)
+		return &rpc.ReactMessageResp{Dest: "bob", Changed: changed}, nil
+	}
+	if m.reacted[key] {
+		return &rpc.ReactMessageResp{Dest: "bob"}, nil
+	}
+	if len(m.reacted) >= int(req.MaxPerUser) {
+		return nil, fmt.Errorf("%w: too many reactions", client.ErrLimitExceeded)
+	}
+	m.reacted[key] = true
+	return &rpc.ReactMessageResp{Dest: "bob", Changed: true}, nil
+}
+
+func TestReactionNotify(t *testing.T) {
+	msg := &mockReact{reacted: map[string]bool{}}
+	h := NewChatHandler(msg, nil, nil, nil, conf.ReactionLimit{MaxKinds: 20, MaxPerUser: 1})
+	sessions := &mockSessions{locs: map[string][]*x.Location{
+		"bob": {{ChannelID: "b1", GateID: "gateway1", Device: "ios"}},
+	}}
+	react := func(reaction string, remove bool) *mockContext {
+		ctx := newMockContext(&pkt.Session{App: "app1", Account: "alice"}, &pkt.MessageReactionReq{MessageID: 1, Reaction: reaction})
+		ctx.sessions = sessions
+		if remove {
+			h.DoReactionRemove(ctx)
+		} else {
+			h.DoReactionAdd(ctx)
+		}
+		return ctx
+	}
+
+	ctx := react("", false)
+	assert.Equal(t, pkt.Status_InvalidPacketBody, ctx.status)
+
+	ctx = react("👍", false)
+	assert.Equal(t, pkt.Status_Success, ctx.status)
+	assert.Len(t, ctx.dispatched, 1)
+	// 没有变化的回应不推送
+	ctx = react("👍", false)
+	assert.Equal(t, pkt.Status_Success, ctx.status)
+	assert.Empty(t, ctx.dispatched)
+
+	ctx = react("❤", false)
+	assert.Equal(t, pkt.Status_LimitExceeded, ctx.status)
+	assert.Empty(t, ctx.dispatched)
+
+	ctx = react("👍", true)
+	assert.Equal(t, pkt.Status_Success, ctx.status)
+	assert.Len(t, ctx.dispatched, 1)
+	notify := ctx.dispatched[0].(*pkt.MessageReactionNotify)
+	assert.True(t, notify.Removed)
+	assert.Equal(t, "alice", notify.Account)
+
+	for _, req := range msg.limits {
+		assert.Equal(t, int32(20), req.MaxKinds)
+		assert.Equal(t, int32(1), req.MaxPerUser)
+	}
+}
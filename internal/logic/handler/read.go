@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"X_IM/internal/logic/client"
+	"X_IM/pkg/logger"
+	"X_IM/pkg/wire/pkt"
+	"X_IM/pkg/wire/rpc"
+	"X_IM/pkg/x"
+	"errors"
+)
+
+var ErrInvalidMessageID = errors.New("invalid messageID")
+
+// DoUserRead 单聊已读回执，读位置前进时通知对方与自己的其他设备
+func (h *ChatHandler) DoUserRead(ctx x.Context) {
+	req, ok := readMessageRead(ctx)
+	if !ok {
+		return
+	}
+	dest := ctx.Header().GetDest()
+	resp, err := h.msgService.Read(ctx.Session().GetApp(), &rpc.ReadMessageReq{
+		Account:   ctx.Session().GetAccount(),
+		Dest:      dest,
+		MessageID: req.MessageID,
+	})
+	if errors.Is(err, client.ErrForbidden) {
+		_ = ctx.RespWithError(pkt.Status_Forbidden, err)
+		return
+	}
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	if resp.Advanced {
+		notifyRead(ctx, &pkt.MessageReadNotify{
+			Reader:    ctx.Session().GetAccount(),
+			MessageID: req.MessageID,
+		}, dest)
+	}
+	_ = ctx.Resp(pkt.Status_Success, nil)
+}
+
+// DoGroupRead 群聊已读回执，读位置前进时通知消息的发送方与自己的其他设备
+func (h *ChatHandler) DoGroupRead(ctx x.Context) {
+	req, ok := readMessageRead(ctx)
+	if !ok {
+		return
+	}
+	group := ctx.Header().GetDest()
+	resp, err := h.msgService.Read(ctx.Session().GetApp(), &rpc.ReadMessageReq{
+		Account:   ctx.Session().GetAccount(),
+		Group:     group,
+		MessageID: req.MessageID,
+	})
+	if errors.Is(err, client.ErrForbidden) {
+		_ = ctx.RespWithError(pkt.Status_Forbidden, err)
+		return
+	}
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	if resp.Advanced {
+		var accounts []string
+		if resp.Sender != "" && resp.Sender != ctx.Session().GetAccount() {
+			accounts = append(accounts, resp.Sender)
+		}
+		notifyRead(ctx, &pkt.MessageReadNotify{
+			Reader:    ctx.Session().GetAccount(),
+			MessageID: req.MessageID,
+			Group:     group,
+		}, accounts...)
+	}
+	_ = ctx.Resp(pkt.Status_Success, nil)
+}
+
+// DoUserReadState 查询单聊的对方读到了哪条消息
+func (h *ChatHandler) DoUserReadState(ctx x.Context) {
+	if ctx.Header().GetDest() == "" {
+		_ = ctx.RespWithError(pkt.Status_NoDestination, ErrNoDestination)
+		return
+	}
+	resp, err := h.msgService.ReadState(ctx.Session().GetApp(), &rpc.ReadStateReq{
+		Account: ctx.Session().GetAccount(),
+		Dest:    ctx.Header().GetDest(),
+	})
+	if errors.Is(err, client.ErrForbidden) {
+		_ = ctx.RespWithError(pkt.Status_Forbidden, err)
+		return
+	}
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	_ = ctx.Resp(pkt.Status_Success, &pkt.MessageReadStateResp{
+		MessageID: resp.MessageID,
+	})
+}
+
+// DoGroupReadState 查询群里读到某条消息的成员数与成员列表，只有群成员可以查询
+func (h *ChatHandler) DoGroupReadState(ctx x.Context) {
+	if ctx.Header().GetDest() == "" {
+		_ = ctx.RespWithError(pkt.Status_NoDestination, ErrNoDestination)
+		return
+	}
+	var req pkt.MessageReadStateReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	if req.MessageID <= 0 {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrInvalidMessageID)
+		return
+	}
+	resp, err := h.msgService.ReadState(ctx.Session().GetApp(), &rpc.ReadStateReq{
+		Account:   ctx.Session().GetAccount(),
+		Group:     ctx.Header().GetDest(),
+		MessageID: req.MessageID,
+	})
+	if errors.Is(err, client.ErrForbidden) {
+		_ = ctx.RespWithError(pkt.Status_Forbidden, err)
+		return
+	}
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	_ = ctx.Resp(pkt.Status_Success, &pkt.MessageReadStateResp{
+		MessageID: req.MessageID,
+		ReadCount: int32(len(resp.Readers)),
+		Readers:   resp.Readers,
+	})
+}
+
+func readMessageRead(ctx x.Context) (*pkt.MessageReadReq, bool) {
+	if ctx.Header().GetDest() == "" {
+		_ = ctx.RespWithError(pkt.Status_NoDestination, ErrNoDestination)
+		return nil, false
+	}
+	var req pkt.MessageReadReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return nil, false
+	}
+	if req.MessageID <= 0 {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrInvalidMessageID)
+		return nil, false
+	}
+	return &req, true
+}
+
+// notifyRead 推送已读回执给accounts以及读者的其他在线设备。
+// 读位置已经保存，推送失败时由查询兜底
+func notifyRead(ctx x.Context, notify *pkt.MessageReadNotify, accounts ...string) {
+	locs, err := ctx.GetLocations(append(accounts, ctx.Session().GetAccount())...)
+	if err != nil {
+		if !errors.Is(err, x.ErrSessionNil) {
+			logger.WithField("func", "notifyRead").Warn(err)
+		}
+		return
+	}
+	if err = ctx.Dispatch(notify, locs...); err != nil {
+		logger.WithField("func", "notifyRead").Warn(err)
+	}
+}
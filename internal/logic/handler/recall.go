@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"X_IM/internal/logic/client"
+	"X_IM/pkg/logger"
+	"X_IM/pkg/wire/pkt"
+	"X_IM/pkg/wire/rpc"
+	"X_IM/pkg/x"
+	"errors"
+)
+
+// DoRecall 撤回自己发送的消息，通知在线的接收方与自己的其他设备
+func (h *ChatHandler) DoRecall(ctx x.Context) {
+	var req pkt.MessageRecallReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	if req.MessageID <= 0 {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrInvalidMessageID)
+		return
+	}
+	app := ctx.Session().GetApp()
+	sender := ctx.Session().GetAccount()
+	resp, err := h.msgService.Recall(app, &rpc.RecallMessageReq{
+		Account:   sender,
+		MessageID: req.MessageID,
+		Window:    int64(h.recallWindowOf(app)),
+	})
+	if errors.Is(err, client.ErrForbidden) {
+		_ = ctx.RespWithError(pkt.Status_Forbidden, err)
+		return
+	}
+	if errors.Is(err, client.ErrExpired) {
+		_ = ctx.RespWithError(pkt.Status_OperationExpired, err)
+		return
+	}
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	// 撤回已经保存，离线的接收方同步时得到墓碑
+	receivers, err := h.messageReceivers(app, sender, resp.Dest, resp.Group)
+	if err != nil {
+		logger.WithField("func", "DoRecall").Warn(err)
+	}
+	locs, err := ctx.GetLocations(append(receivers, sender)...)
+	if err != nil && !errors.Is(err, x.ErrSessionNil) {
+		logger.WithField("func", "DoRecall").Warn(err)
+	}
+	err = ctx.Dispatch(&pkt.MessageRecallNotify{
+		MessageID: req.MessageID,
+		Sender:    sender,
+		Group:     resp.Group,
+	}, locs...)
+	if err != nil {
+		logger.WithField("func", "DoRecall").Warn(err)
+	}
+	_ = ctx.Resp(pkt.Status_Success, nil)
+}
+
+// messageReceivers 单聊为接收方，群聊为发送方以外的群成员，发送方的其他设备由调用方加上
+func (h *ChatHandler) messageReceivers(app string, sender string, dest string, group string) ([]string, error) {
+	if group == "" {
+		return []string{dest}, nil
+	}
+	membersResp, err := h.groupService.Members(app, &rpc.GroupMembersReq{
+		GroupID: group,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var receivers = make([]string, 0, len(membersResp.Users))
+	for _, user := range membersResp.Users {
+		if user.Account != sender {
+			receivers = append(receivers, user.Account)
+		}
+	}
+	return receivers, nil
+}
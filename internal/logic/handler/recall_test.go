@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"X_IM/internal/logic/client"
+	"X_IM/internal/logic/conf"
+	"X_IM/pkg/wire/pkt"
+	"X_IM/pkg/wire/rpc"
+	"X_IM/pkg/x"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mockRecall 按请求的时间窗口判断消息是否还可以撤回
+type mockRecall struct {
+	client.Message
+	sentAgo time.Duration
+	windows []int64
+}
+
+func (m *mockRecall) Recall(app string, req *rpc.RecallMessageReq) (*rpc.RecallMessageResp, error) {
+	m.windows = append(m.windows, req.Window)
+	if int64(m.sentAgo) > req.Window {
+		return nil, fmt.Errorf("%w: window expired", client.ErrExpired)
+	}
+	return &rpc.RecallMessageResp{Dest: "bob"}, nil
+}
+
+func TestRecallAppWindow(t *testing.T) {
+	config := &conf.Config{
+		RecallWindow:     time.Minute * 2,
+		AppRecallWindows: map[string]time.Duration{"app2": time.Minute * 10},
+	}
+	msg := &mockRecall{sentAgo: time.Minute * 5}
+	h := NewChatHandler(msg, nil, config.RecallWindowOf, config.EditWindowOf, conf.ReactionLimit{})
+	sessions := &mockSessions{locs: map[string][]*x.Location{
+		"bob": {{ChannelID: "b1", GateID: "gateway1", Device: "ios"}},
+	}}
+
+	recall := func(app string) *mockContext {
+		ctx := newMockContext(&pkt.Session{App: app, Account: "alice"}, &pkt.MessageRecallReq{MessageID: 1})
+		ctx.sessions = sessions
+		h.DoRecall(ctx)
+		return ctx
+	}
+
+	ctx := recall("app1")
+	assert.Equal(t, pkt.Status_OperationExpired, ctx.status)
+	assert.Empty(t, ctx.dispatched)
+
+	ctx = recall("app2")
+	assert.Equal(t, pkt.Status_Success, ctx.status)
+	assert.Len(t, ctx.dispatched, 1)
+
+	assert.Equal(t, []int64{int64(time.Minute * 2), int64(time.Minute * 10)}, msg.windows)
+}
@@ -0,0 +1,369 @@
+package handler
+
+import (
+	"X_IM/internal/logic/client"
+	"X_IM/pkg/logger"
+	"X_IM/pkg/timingwheel"
+	"X_IM/pkg/wire/common"
+	"X_IM/pkg/wire/pkt"
+	"X_IM/pkg/wire/rpc"
+	"X_IM/pkg/x"
+	"errors"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// scheduleRetryInterval 送达或者恢复失败后重试的间隔
+	scheduleRetryInterval = time.Second * 10
+	// scheduleMaxAttempts 最多尝试送达的次数，需要在common.ScheduledLease内完成
+	scheduleMaxAttempts = 6
+)
+
+var ErrInvalidSendAt = errors.New("sendAt is too far in the future")
+
+// ScheduleHandler 定时发送的消息先在occult中保存为待发送，到时间后由时间轮触发送达。
+// 每条消息由创建或者领取它的实例（owner）负责送达，启动时只恢复自己的以及没有被领取的消息，
+// 并且定期接管领取已经过期的消息，例如负责它的实例已经退出；
+// occult保证同一条消息只会被送达一次，多个实例同时触发时只有一个会推送
+type ScheduleHandler struct {
+	msgService   client.Message
+	groupService client.Group
+	sessions     x.SessionStorage
+	dispatcher   x.Dispatcher
+	// owner 当前实例的ServiceID
+	owner string
+	// maxAhead 最多可以提前多久定时
+	maxAhead      time.Duration
+	afterFunc     func(d time.Duration, f func()) *timingwheel.Timer
+	retryInterval time.Duration
+	// notifier 为空时不发送离线通知
+	notifier *NotifyHandler
+
+	sync.Mutex
+	timers map[int64]*timingwheel.Timer
+}
+
+func NewScheduleHandler(msg client.Message, group client.Group, sessions x.SessionStorage, dispatcher x.Dispatcher, owner string, maxAhead time.Duration) *ScheduleHandler {
+	return &ScheduleHandler{
+		msgService:    msg,
+		groupService:  group,
+		sessions:      sessions,
+		dispatcher:    dispatcher,
+		owner:         owner,
+		maxAhead:      maxAhead,
+		afterFunc:     timingwheel.AfterFunc,
+		retryInterval: scheduleRetryInterval,
+		timers:        make(map[int64]*timingwheel.Timer),
+	}
+}
+
+// SetNotifier 设置离线通知，送达时接收方没有在线的设备由它通过推送服务通知
+func (h *ScheduleHandler) SetNotifier(notifier *NotifyHandler) {
+	h.notifier = notifier
+}
+
+// Schedule 保存定时发送的消息并启动定时器，返回scheduleID
+func (h *ScheduleHandler) Schedule(m *rpc.ScheduledMessage) (int64, error) {
+	if time.Duration(m.SendAt-time.Now().UnixNano()) > h.maxAhead {
+		return 0, ErrInvalidSendAt
+	}
+	m.Owner = h.owner
+	resp, err := h.msgService.Schedule(m.App, m)
+	if err != nil {
+		return 0, err
+	}
+	m.ID = resp.ID
+	h.add(m)
+	return m.ID, nil
+}
+
+// schedule 定时发送单聊或群聊消息，返回scheduleID，messageID在送达时生成
+func (h *ScheduleHandler) schedule(ctx x.Context, req *pkt.MessageReq, group bool) {
+	id, err := h.Schedule(&rpc.ScheduledMessage{
+		App:      ctx.Session().GetApp(),
+		Sender:   ctx.Session().GetAccount(),
+		Dest:     ctx.Header().GetDest(),
+		Group:    group,
+		SendAt:   req.GetSendAt(),
+		Mentions: req.GetMentions(),
+		Message: &rpc.Message{
+			Type:         req.GetType(),
+			Body:         req.GetBody(),
+			Extra:        req.GetExtra(),
+			ReplyTo:      req.GetReplyTo(),
+			ThreadRoot:   req.GetThreadRoot(),
+			Ttl:          req.GetTtl(),
+			TtlAfterRead: req.GetTtlAfterRead(),
+		},
+	})
+	if errors.Is(err, ErrInvalidSendAt) || errors.Is(err, client.ErrBadRequest) {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	_ = ctx.Resp(pkt.Status_Success, &pkt.MessageResp{
+		ScheduleID: id,
+	})
+}
+
+// DoList 分页读取自己待发送的消息
+func (h *ScheduleHandler) DoList(ctx x.Context) {
+	var req pkt.ScheduledListReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	resp, err := h.msgService.ScheduledList(ctx.Session().GetApp(), &rpc.ScheduledListReq{
+		Account: ctx.Session().GetAccount(),
+		After:   req.After,
+		Limit:   req.Limit,
+	})
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	var list = make([]*pkt.ScheduledMessage, len(resp.List))
+	for i, val := range resp.List {
+		list[i] = &pkt.ScheduledMessage{
+			ScheduleID:   val.ID,
+			Dest:         val.Dest,
+			Group:        val.Group,
+			SendAt:       val.SendAt,
+			Type:         val.Message.GetType(),
+			Body:         val.Message.GetBody(),
+			Extra:        val.Message.GetExtra(),
+			ReplyTo:      val.Message.GetReplyTo(),
+			ThreadRoot:   val.Message.GetThreadRoot(),
+			Ttl:          val.Message.GetTtl(),
+			TtlAfterRead: val.Message.GetTtlAfterRead(),
+			Mentions:     val.Mentions,
+		}
+	}
+	_ = ctx.Resp(pkt.Status_Success, &pkt.ScheduledListResp{
+		List: list,
+		More: resp.More,
+	})
+}
+
+// DoCancel 取消自己还未送达的消息，已经送达或者取消的返回Status_OperationExpired
+func (h *ScheduleHandler) DoCancel(ctx x.Context) {
+	var req pkt.ScheduledCancelReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	err := h.msgService.CancelScheduled(ctx.Session().GetApp(), &rpc.CancelScheduledReq{
+		Account: ctx.Session().GetAccount(),
+		ID:      req.ScheduleID,
+	})
+	if errors.Is(err, client.ErrForbidden) {
+		_ = ctx.RespWithError(pkt.Status_Forbidden, err)
+		return
+	}
+	if errors.Is(err, client.ErrExpired) {
+		_ = ctx.RespWithError(pkt.Status_OperationExpired, err)
+		return
+	}
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	// 定时器可能在其他实例上，到时间后送达会失败
+	h.Lock()
+	if timer, ok := h.timers[req.ScheduleID]; ok {
+		timer.Stop()
+		delete(h.timers, req.ScheduleID)
+	}
+	h.Unlock()
+	_ = ctx.Resp(pkt.Status_Success, nil)
+}
+
+// Recover 启动时领取待发送的消息，之后每隔interval接管领取已经过期的消息，直到stop被关闭。
+// 只在chat实例上运行
+func (h *ScheduleHandler) Recover(interval time.Duration, stop <-chan struct{}) {
+	log := logger.WithField("func", "ScheduleRecover")
+	for {
+		err := h.load(0)
+		if err == nil {
+			break
+		}
+		log.Warn(err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(h.retryInterval):
+		}
+	}
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if err := h.load(now.UnixNano()); err != nil {
+				log.Warn(err)
+			}
+		}
+	}
+}
+
+// load 分页领取待发送的消息，before不为0时只领取sendAt不晚于before的消息
+func (h *ScheduleHandler) load(before int64) error {
+	var after int64
+	for {
+		resp, err := h.msgService.PendingScheduled(&rpc.PendingScheduledReq{
+			After:  after,
+			Before: before,
+			Limit:  common.MessageMaxCountPerPage,
+			Owner:  h.owner,
+		})
+		if err != nil {
+			return err
+		}
+		for _, m := range resp.List {
+			h.add(m)
+			after = m.ID
+		}
+		if !resp.More {
+			return nil
+		}
+	}
+}
+
+// add 启动定时器，已经有定时器的消息忽略
+func (h *ScheduleHandler) add(m *rpc.ScheduledMessage) {
+	h.Lock()
+	defer h.Unlock()
+	if _, ok := h.timers[m.ID]; ok {
+		return
+	}
+	h.timers[m.ID] = h.afterFunc(time.Duration(m.SendAt-time.Now().UnixNano()), func() {
+		h.deliver(m, 1)
+	})
+}
+
+// deliver 送达失败时按retryInterval重试，attempt达到scheduleMaxAttempts后标记为失败
+func (h *ScheduleHandler) deliver(m *rpc.ScheduledMessage, attempt int) {
+	log := logger.WithField("func", "ScheduleDeliver")
+	sendTime := time.Now().UnixNano()
+	resp, err := h.msgService.DeliverScheduled(m.App, &rpc.DeliverScheduledReq{
+		ID:       m.ID,
+		SendTime: sendTime,
+	})
+	if err != nil && attempt < scheduleMaxAttempts {
+		log.Warn(err)
+		h.Lock()
+		h.timers[m.ID] = h.afterFunc(h.retryInterval, func() {
+			h.deliver(m, attempt+1)
+		})
+		h.Unlock()
+		return
+	}
+	h.Lock()
+	delete(h.timers, m.ID)
+	h.Unlock()
+	if err != nil {
+		log.Errorf("scheduled message %d failed after %d attempts: %v", m.ID, attempt, err)
+		// 标记失败也没有成功时，领取过期后由其他实例接管
+		if err = h.msgService.FailScheduled(m.App, &rpc.FailScheduledReq{ID: m.ID, Owner: h.owner}); err != nil {
+			log.Warn(err)
+		}
+		return
+	}
+	// 已经取消或者由其他实例送达
+	if !resp.Delivered {
+		return
+	}
+	// 消息已经保存，推送失败时由离线同步兜底
+	if err = h.push(m, resp, sendTime); err != nil {
+		log.Warn(err)
+	}
+}
+
+// push 推送给接收方（群聊为其他成员）与发送方的所有在线设备，发送方的推送带上self标记
+func (h *ScheduleHandler) push(m *rpc.ScheduledMessage, delivered *rpc.DeliverScheduledResp, sendTime int64) error {
+	command := common.CommandChatUserTalk
+	var receivers []string
+	if !m.Group && m.Dest != m.Sender {
+		receivers = []string{m.Dest}
+	}
+	if m.Group {
+		command = common.CommandChatGroupTalk
+		membersResp, err := h.groupService.Members(m.App, &rpc.GroupMembersReq{
+			GroupID: m.Dest,
+		})
+		if err != nil {
+			return err
+		}
+		for _, user := range membersResp.Users {
+			if user.Account != m.Sender {
+				receivers = append(receivers, user.Account)
+			}
+		}
+	}
+	push := &pkt.MessagePush{
+		MessageID:    delivered.MessageID,
+		Type:         m.Message.GetType(),
+		Body:         m.Message.GetBody(),
+		Extra:        m.Message.GetExtra(),
+		Sender:       m.Sender,
+		SendTime:     sendTime,
+		ReplyTo:      m.Message.GetReplyTo(),
+		ThreadRoot:   m.Message.GetThreadRoot(),
+		Ttl:          m.Message.GetTtl(),
+		TtlAfterRead: m.Message.GetTtlAfterRead(),
+		ExpireAt:     expireAt(sendTime, m.Message.GetTtl(), m.Message.GetTtlAfterRead()),
+		Seq:          delivered.Seq,
+		Mentions:     m.Mentions,
+	}
+	if err := pushTo(h.sessions, h.dispatcher, command, m.Dest, push, receivers...); err != nil {
+		return err
+	}
+	if h.notifier != nil {
+		group := ""
+		if m.Group {
+			group = m.Dest
+		}
+		h.notifier.Offline(m.App, group, push, receivers...)
+	}
+	push.Self = true
+	return pushTo(h.sessions, h.dispatcher, command, m.Dest, push, m.Sender)
+}
+
+// pushTo 不经过请求上下文，把消息推送给账号的所有在线设备
+func pushTo(sessions x.SessionStorage, dispatcher x.Dispatcher, command string, dest string, body proto.Message, accounts ...string) error {
+	if len(accounts) == 0 {
+		return nil
+	}
+	locs, err := sessions.GetLocations(accounts...)
+	if err != nil {
+		if errors.Is(err, x.ErrSessionNil) {
+			return nil
+		}
+		return err
+	}
+	packet := pkt.New(command, pkt.WithDest(dest))
+	packet.Flag = pkt.Flag_Push
+	packet.WriteBody(body)
+
+	group := make(map[string][]string)
+	for _, loc := range locs {
+		group[loc.GateID] = append(group[loc.GateID], loc.ChannelID)
+	}
+	for gateway, channels := range group {
+		if err = dispatcher.Push(gateway, channels, packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
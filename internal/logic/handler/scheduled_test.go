@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"X_IM/internal/logic/client"
+	"X_IM/pkg/timingwheel"
+	"X_IM/pkg/wire/pkt"
+	"X_IM/pkg/wire/rpc"
+	"X_IM/pkg/x"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockScheduled struct {
+	client.Message
+	sync.Mutex
+	pending   []*rpc.ScheduledMessage
+	canceled  map[int64]bool
+	delivered []int64
+	// broken 送达时总是失败的消息
+	broken   map[int64]bool
+	attempts map[int64]int
+	failed   []*rpc.FailScheduledReq
+}
+
+func (m *mockScheduled) PendingScheduled(req *rpc.PendingScheduledReq) (*rpc.ScheduledListResp, error) {
+	if req.Owner == "" {
+		return nil, fmt.Errorf("%w: owner is required", client.ErrBadRequest)
+	}
+	return &rpc.ScheduledListResp{List: m.pending}, nil
+}
+
+func (m *mockScheduled) FailScheduled(app string, req *rpc.FailScheduledReq) error {
+	m.Lock()
+	defer m.Unlock()
+	m.failed = append(m.failed, req)
+	return nil
+}
+
+func (m *mockScheduled) DeliverScheduled(app string, req *rpc.DeliverScheduledReq) (*rpc.DeliverScheduledResp, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.broken[req.ID] {
+		m.attempts[req.ID]++
+		return nil, errors.New("occult is unavailable")
+	}
+	if m.canceled[req.ID] {
+		return &rpc.DeliverScheduledResp{}, nil
+	}
+	m.delivered = append(m.delivered, req.ID)
+	return &rpc.DeliverScheduledResp{Delivered: true, MessageID: req.ID * 10}, nil
+}
+
+type mockPushes struct {
+	sync.Mutex
+	pushed []*pkt.MessagePush
+}
+
+func (m *mockPushes) Push(gateway string, channels []string, p *pkt.LogicPkt) error {
+	var push pkt.MessagePush
+	_ = p.ReadBody(&push)
+	m.Lock()
+	m.pushed = append(m.pushed, &push)
+	m.Unlock()
+	return nil
+}
+
+func TestScheduleRecover(t *testing.T) {
+	tw := timingwheel.NewTimingWheel(time.Millisecond, 20)
+	tw.Start()
+	defer tw.Stop()
+
+	now := time.Now().UnixNano()
+	msg := &mockScheduled{
+		pending: []*rpc.ScheduledMessage{
+			// 重启期间已经过期的消息立即送达
+			{ID: 1, Sender: "alice", Dest: "bob", SendAt: now - int64(time.Second), Message: &rpc.Message{Body: "1"}},
+			{ID: 2, Sender: "alice", Dest: "bob", SendAt: now + int64(time.Millisecond*50), Message: &rpc.Message{Body: "2"},
+				Mentions: []string{"bob"}},
+			// 已经取消的消息不推送
+			{ID: 3, Sender: "alice", Dest: "bob", SendAt: now, Message: &rpc.Message{Body: "3"}},
+		},
+		canceled: map[int64]bool{3: true},
+	}
+	sessions := &mockSessions{locs: map[string][]*x.Location{
+		"bob": {{ChannelID: "b1", GateID: "gateway1", Device: "pc"}},
+	}}
+	dispatcher := &mockPushes{}
+	h := NewScheduleHandler(msg, nil, sessions, dispatcher, "chat01", time.Hour)
+	h.afterFunc = tw.AfterFunc
+
+	assert.Nil(t, h.load(0))
+	// 重复恢复不会重复启动定时器
+	assert.Nil(t, h.load(0))
+
+	time.Sleep(time.Millisecond * 200)
+	msg.Lock()
+	assert.ElementsMatch(t, []int64{1, 2}, msg.delivered)
+	msg.Unlock()
+	dispatcher.Lock()
+	defer dispatcher.Unlock()
+	assert.Equal(t, 2, len(dispatcher.pushed))
+	for _, push := range dispatcher.pushed {
+		assert.Equal(t, "alice", push.Sender)
+		assert.Equal(t, push.MessageID, map[string]int64{"1": 10, "2": 20}[push.Body])
+		if push.Body == "2" {
+			assert.Equal(t, []string{"bob"}, push.Mentions)
+		} else {
+			assert.Empty(t, push.Mentions)
+		}
+	}
+	h.Lock()
+	assert.Equal(t, 0, len(h.timers))
+	h.Unlock()
+}
+
+func TestScheduleDeliverFailed(t *testing.T) {
+	tw := timingwheel.NewTimingWheel(time.Millisecond, 20)
+	tw.Start()
+	defer tw.Stop()
+
+	msg := &mockScheduled{
+		pending: []*rpc.ScheduledMessage{
+			{ID: 1, App: "app1", Sender: "alice", Dest: "bob", SendAt: time.Now().UnixNano(), Message: &rpc.Message{Body: "1"}},
+		},
+		broken:   map[int64]bool{1: true},
+		attempts: map[int64]int{},
+	}
+	h := NewScheduleHandler(msg, nil, &mockSessions{}, &mockPushes{}, "chat01", time.Hour)
+	h.afterFunc = tw.AfterFunc
+	h.retryInterval = time.Millisecond * 5
+
+	assert.Nil(t, h.load(0))
+	time.Sleep(time.Millisecond * 300)
+
+	msg.Lock()
+	assert.Equal(t, scheduleMaxAttempts, msg.attempts[1])
+	assert.Len(t, msg.failed, 1)
+	assert.Equal(t, "chat01", msg.failed[0].Owner)
+	msg.Unlock()
+	h.Lock()
+	assert.Equal(t, 0, len(h.timers))
+	h.Unlock()
+}
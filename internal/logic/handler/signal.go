@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"X_IM/internal/logic/client"
+	"X_IM/pkg/logger"
+	"X_IM/pkg/wire/pkt"
+	"X_IM/pkg/wire/rpc"
+	"X_IM/pkg/x"
+	"errors"
+	"fmt"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+const (
+	signalThrottleSize = 100000
+	signalMembersSize  = 10000
+	// signalMembersTTL 群成员的缓存时间，成员变化后最多这么久才会收到信号
+	signalMembersTTL = time.Second * 30
+)
+
+var (
+	ErrInvalidSignal  = errors.New("invalid signal type")
+	ErrGroupTooLarge  = errors.New("group is too large for signals")
+	ErrNotGroupMember = errors.New("sender is not a member of the group")
+)
+
+// SignalHandler 正在输入等临时信号，不经过occult保存，只推送给接收方在线的设备。
+// 同一发送方在同一会话中的信号按interval限流，不区分类型
+type SignalHandler struct {
+	groupService client.Group
+	interval     time.Duration
+	maxMembers   int
+	// last 发送方在会话中最近一次转发的信号
+	last *lru.Cache
+	// members 小群的成员，避免每个信号都请求occult
+	members *lru.Cache
+}
+
+type lastSignal struct {
+	typ int32
+	// at 当前限流窗口的开始时间
+	at time.Time
+	// changed 当前窗口内已经转发过一次类型变化
+	changed bool
+}
+
+type cachedMembers struct {
+	accounts []string
+	expireAt time.Time
+}
+
+func NewSignalHandler(group client.Group, interval time.Duration, maxMembers int) *SignalHandler {
+	last, _ := lru.New(signalThrottleSize)
+	members, _ := lru.New(signalMembersSize)
+	return &SignalHandler{
+		groupService: group,
+		interval:     interval,
+		maxMembers:   maxMembers,
+		last:         last,
+		members:      members,
+	}
+}
+
+// DoUserSignal 单聊信号，推送给接收方的所有在线设备
+func (h *SignalHandler) DoUserSignal(ctx x.Context) {
+	req, ok := h.readSignal(ctx)
+	if !ok {
+		return
+	}
+	if !h.allow(ctx, req.Type) {
+		_ = ctx.Resp(pkt.Status_Success, nil)
+		return
+	}
+	receiver := ctx.Header().GetDest()
+	if receiver == ctx.Session().GetAccount() {
+		_ = ctx.Resp(pkt.Status_Success, nil)
+		return
+	}
+	h.dispatch(ctx, req.Type, receiver)
+}
+
+// DoGroupSignal 小群的信号，推送给其他在线成员，只有群成员可以发送
+func (h *SignalHandler) DoGroupSignal(ctx x.Context) {
+	req, ok := h.readSignal(ctx)
+	if !ok {
+		return
+	}
+	if !h.allow(ctx, req.Type) {
+		_ = ctx.Resp(pkt.Status_Success, nil)
+		return
+	}
+	members, err := h.groupMembers(ctx.Session().GetApp(), ctx.Header().GetDest())
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	if len(members) > h.maxMembers {
+		_ = ctx.RespWithError(pkt.Status_InvalidCommand, ErrGroupTooLarge)
+		return
+	}
+	var (
+		receivers = make([]string, 0, len(members))
+		joined    bool
+	)
+	for _, member := range members {
+		if member == ctx.Session().GetAccount() {
+			joined = true
+		} else {
+			receivers = append(receivers, member)
+		}
+	}
+	if !joined {
+		_ = ctx.RespWithError(pkt.Status_Forbidden, ErrNotGroupMember)
+		return
+	}
+	h.dispatch(ctx, req.Type, receivers...)
+}
+
+func (h *SignalHandler) readSignal(ctx x.Context) (*pkt.SignalReq, bool) {
+	if ctx.Header().GetDest() == "" {
+		_ = ctx.RespWithError(pkt.Status_NoDestination, ErrNoDestination)
+		return nil, false
+	}
+	var req pkt.SignalReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return nil, false
+	}
+	if req.Type <= 0 {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrInvalidSignal)
+		return nil, false
+	}
+	return &req, true
+}
+
+// allow 同一发送方在同一会话中的信号在interval内只转发一次，被限流的信号直接丢弃。
+// 窗口内重复的同类信号合并为一次；类型变化（例如正在输入变为暂停）额外转发一次，
+// 避免接收方停留在旧的状态，交替发送不同类型也不能绕过限流
+func (h *SignalHandler) allow(ctx x.Context, typ int32) bool {
+	key := fmt.Sprintf("%s|%s|%s", ctx.Header().GetCommand(), ctx.Session().GetAccount(), ctx.Header().GetDest())
+	now := time.Now()
+	if val, ok := h.last.Get(key); ok {
+		last := val.(*lastSignal)
+		if now.Sub(last.at) < h.interval {
+			if last.typ == typ || last.changed {
+				return false
+			}
+			h.last.Add(key, &lastSignal{typ: typ, at: last.at, changed: true})
+			return true
+		}
+	}
+	h.last.Add(key, &lastSignal{typ: typ, at: now})
+	return true
+}
+
+func (h *SignalHandler) dispatch(ctx x.Context, typ int32, receivers ...string) {
+	if len(receivers) > 0 {
+		locs, err := ctx.GetLocations(receivers...)
+		if err != nil && !errors.Is(err, x.ErrSessionNil) {
+			_ = ctx.RespWithError(pkt.Status_SystemException, err)
+			return
+		}
+		err = ctx.Dispatch(&pkt.SignalPush{
+			Type:   typ,
+			Sender: ctx.Session().GetAccount(),
+		}, locs...)
+		if err != nil {
+			logger.WithField("func", "SignalDispatch").Warn(err)
+		}
+	}
+	_ = ctx.Resp(pkt.Status_Success, nil)
+}
+
+func (h *SignalHandler) groupMembers(app string, group string) ([]string, error) {
+	key := app + "|" + group
+	if val, ok := h.members.Get(key); ok {
+		cached := val.(*cachedMembers)
+		if time.Now().Before(cached.expireAt) {
+			return cached.accounts, nil
+		}
+	}
+	resp, err := h.groupService.Members(app, &rpc.GroupMembersReq{
+		GroupID: group,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var accounts = make([]string, 0, len(resp.Users))
+	for _, user := range resp.Users {
+		accounts = append(accounts, user.Account)
+	}
+	h.members.Add(key, &cachedMembers{
+		accounts: accounts,
+		expireAt: time.Now().Add(signalMembersTTL),
+	})
+	return accounts, nil
+}
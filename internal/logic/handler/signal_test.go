@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"X_IM/internal/logic/client"
+	"X_IM/pkg/wire/common"
+	"X_IM/pkg/wire/pkt"
+	"X_IM/pkg/wire/rpc"
+	"X_IM/pkg/x"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockGroup struct {
+	client.Group
+	members map[string][]string
+}
+
+func (m *mockGroup) Members(app string, req *rpc.GroupMembersReq) (*rpc.GroupMembersResp, error) {
+	var users []*rpc.Member
+	for _, account := range m.members[req.GroupID] {
+		users = append(users, &rpc.Member{Account: account})
+	}
+	return &rpc.GroupMembersResp{Users: users}, nil
+}
+
+func TestGroupSignalMember(t *testing.T) {
+	group := &mockGroup{members: map[string][]string{
+		"g1": {"alice", "bob"},
+	}}
+	sessions := &mockSessions{locs: map[string][]*x.Location{
+		"bob": {{ChannelID: "b1", GateID: "gateway1", Device: "ios"}},
+	}}
+	h := NewSignalHandler(group, time.Second, 10)
+
+	send := func(account string) *mockContext {
+		ctx := newMockContext(&pkt.Session{App: "app1", Account: account}, &pkt.SignalReq{Type: 1})
+		ctx.header = &pkt.Header{Command: common.CommandChatGroupSignal, Dest: "g1"}
+		ctx.sessions = sessions
+		h.DoGroupSignal(ctx)
+		return ctx
+	}
+
+	ctx := send("alice")
+	assert.Equal(t, pkt.Status_Success, ctx.status)
+	assert.Len(t, ctx.dispatched, 1)
+
+	ctx = send("mallory")
+	assert.Equal(t, pkt.Status_Forbidden, ctx.status)
+	assert.Equal(t, ErrNotGroupMember, ctx.err)
+	assert.Empty(t, ctx.dispatched)
+}
+
+func TestSignalThrottle(t *testing.T) {
+	sessions := &mockSessions{locs: map[string][]*x.Location{
+		"bob": {{ChannelID: "b1", GateID: "gateway1", Device: "ios"}},
+	}}
+	h := NewSignalHandler(&mockGroup{}, time.Second, 10)
+
+	send := func(typ int32, dest string) int {
+		ctx := newMockContext(&pkt.Session{App: "app1", Account: "alice"}, &pkt.SignalReq{Type: typ})
+		ctx.header = &pkt.Header{Command: common.CommandChatUserSignal, Dest: dest}
+		ctx.sessions = sessions
+		h.DoUserSignal(ctx)
+		assert.Equal(t, pkt.Status_Success, ctx.status)
+		return len(ctx.dispatched)
+	}
+
+	assert.Equal(t, 1, send(common.SignalTypeTyping, "bob"))
+	assert.Equal(t, 0, send(common.SignalTypeTyping, "bob"))
+	// 类型变化转发一次
+	assert.Equal(t, 1, send(common.SignalTypePaused, "bob"))
+	// 交替发送不能绕过限流
+	assert.Equal(t, 0, send(common.SignalTypeTyping, "bob"))
+	assert.Equal(t, 0, send(common.SignalTypePaused, "bob"))
+	// 不同会话分别限流
+	sessions.locs["carol"] = []*x.Location{{ChannelID: "c1", GateID: "gateway1", Device: "ios"}}
+	assert.Equal(t, 1, send(common.SignalTypeTyping, "carol"))
+}
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"X_IM/internal/logic/client"
+	"X_IM/pkg/wire/common"
+	"X_IM/pkg/wire/pkt"
+	"X_IM/pkg/wire/rpc"
+	"X_IM/pkg/x"
+	"errors"
+	"fmt"
+)
+
+var ErrTooManyRoots = fmt.Errorf("roots must be between 1 and %d", common.MessageMaxCountPerPage)
+
+// DoThreadReplies 按消息ID分页读取话题的回复，只有会话的参与者可以读取
+func (h *ChatHandler) DoThreadReplies(ctx x.Context) {
+	var req pkt.ThreadRepliesReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	if req.Root <= 0 {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrInvalidMessageID)
+		return
+	}
+	resp, err := h.msgService.ThreadReplies(ctx.Session().GetApp(), &rpc.ThreadRepliesReq{
+		Account: ctx.Session().GetAccount(),
+		Root:    req.Root,
+		After:   req.After,
+		Limit:   req.Limit,
+	})
+	if errors.Is(err, client.ErrForbidden) {
+		_ = ctx.RespWithError(pkt.Status_Forbidden, err)
+		return
+	}
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	_ = ctx.Resp(pkt.Status_Success, &pkt.ThreadRepliesResp{
+		Replies: toContents(resp.List),
+		More:    resp.More,
+	})
+}
+
+// DoThreadCounts 批量查询根消息的回复数，只返回自己所在会话中的根消息
+func (h *ChatHandler) DoThreadCounts(ctx x.Context) {
+	var req pkt.ThreadCountsReq
+	if err := ctx.ReadBody(&req); err != nil {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, err)
+		return
+	}
+	if len(req.Roots) == 0 || len(req.Roots) > common.MessageMaxCountPerPage {
+		_ = ctx.RespWithError(pkt.Status_InvalidPacketBody, ErrTooManyRoots)
+		return
+	}
+	resp, err := h.msgService.ThreadCounts(ctx.Session().GetApp(), &rpc.ThreadCountsReq{
+		Roots:   req.Roots,
+		Account: ctx.Session().GetAccount(),
+	})
+	if err != nil {
+		_ = ctx.RespWithError(pkt.Status_SystemException, err)
+		return
+	}
+	_ = ctx.Resp(pkt.Status_Success, &pkt.ThreadCountsResp{
+		Counts: resp.Counts,
+	})
+}
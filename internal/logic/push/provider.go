@@ -0,0 +1,117 @@
+package push
+
+import (
+	"X_IM/internal/logic/conf"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bytedance/sonic"
+	"github.com/go-resty/resty/v2"
+)
+
+// 设备推送的平台
+const (
+	PlatformAPNs = "apns"
+	PlatformFCM  = "fcm"
+)
+
+// ErrInvalidToken token已经失效，对应APNs的410 Unregistered与FCM的UNREGISTERED，调用方应该注销它，不再重试
+var ErrInvalidToken = errors.New("device token is invalid")
+
+// Notification 发给一台设备的通知，字段与APNs、FCM的通知对应
+type Notification struct {
+	Platform string `json:"platform"`
+	Token    string `json:"token"`
+	Title    string `json:"title"`
+	Body     string `json:"body"`
+	// Count 合并到这条通知里的消息数
+	Count int `json:"count"`
+	// CollapseID 同一会话的通知互相覆盖，对应APNs的apns-collapse-id与FCM的collapse_key
+	CollapseID string `json:"collapseId"`
+	// Data 透传给客户端的数据，对应APNs的自定义payload与FCM的data
+	Data map[string]string `json:"data,omitempty"`
+}
+
+// Provider 把通知发送给APNs、FCM或者它们的推送网关
+type Provider interface {
+	Send(n *Notification) error
+}
+
+// NewProvider 按配置创建推送服务，Provider为空时返回nil
+func NewProvider(c conf.Push) (Provider, error) {
+	switch c.Provider {
+	case "":
+		return nil, nil
+	case conf.PushProviderHTTP:
+		if c.URL == "" {
+			return nil, errors.New("push url is empty")
+		}
+		return NewHTTPProvider(c.URL), nil
+	case conf.PushProviderFile:
+		if c.File == "" {
+			return nil, errors.New("push file is empty")
+		}
+		return NewFileProvider(c.File), nil
+	default:
+		return nil, fmt.Errorf("unknown push provider %s", c.Provider)
+	}
+}
+
+// HTTPProvider 把通知以JSON POST给推送网关，404与410表示token失效
+type HTTPProvider struct {
+	url string
+	cli *resty.Client
+}
+
+func NewHTTPProvider(url string) *HTTPProvider {
+	cli := resty.New().SetTimeout(time.Second * 5)
+	cli.SetHeader("Content-Type", "application/json")
+	return &HTTPProvider{
+		url: url,
+		cli: cli,
+	}
+}
+
+func (p *HTTPProvider) Send(n *Notification) error {
+	body, _ := sonic.Marshal(n)
+	response, err := p.cli.R().SetBody(body).Post(p.url)
+	if err != nil {
+		return err
+	}
+	switch code := response.StatusCode(); {
+	case code == 404 || code == 410:
+		return fmt.Errorf("%w: %s", ErrInvalidToken, response.String())
+	case code < 200 || code >= 300:
+		return fmt.Errorf("HTTPProvider.Send response.StatusCode() = %d, want 2xx", code)
+	}
+	return nil
+}
+
+// FileProvider 把通知逐行追加到文件中，用于本地调试与测试
+type FileProvider struct {
+	sync.Mutex
+	file string
+}
+
+func NewFileProvider(file string) *FileProvider {
+	return &FileProvider{file: file}
+}
+
+func (p *FileProvider) Send(n *Notification) error {
+	line, err := sonic.Marshal(n)
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	f, err := os.OpenFile(p.file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
@@ -12,6 +12,7 @@ import (
 	"X_IM/pkg/naming/consul"
 	"X_IM/pkg/storage"
 	"X_IM/pkg/tcp"
+	"X_IM/pkg/timingwheel"
 	"X_IM/pkg/wire/common"
 	"X_IM/pkg/x"
 	"context"
@@ -66,9 +67,11 @@ func RunServerStart(ctx context.Context, opts *StartOptions, version string) err
 
 	var groupService client.Group
 	var messageService client.Message
+	var deviceService client.Device
 	if strings.TrimSpace(config.OccultURL) != "" {
 		groupService = client.NewGroupService(config.OccultURL)
 		messageService = client.NewMessageService(config.OccultURL)
+		deviceService = client.NewDeviceService(config.OccultURL)
 	} else {
 		srvRecord := &resty.SRVRecord{
 			Domain:  "consul",
@@ -76,20 +79,84 @@ func RunServerStart(ctx context.Context, opts *StartOptions, version string) err
 		}
 		groupService = client.NewGroupServiceWithSRV("http", srvRecord)
 		messageService = client.NewMessageServiceWithSRV("http", srvRecord)
+		deviceService = client.NewDeviceServiceWithSRV("http", srvRecord)
+	}
+
+	rdb, err := conf.InitRedis(config.RedisAddrs, config.RedisPass)
+	if err != nil {
+		return err
+	}
+	cache := storage.NewRedisStorage(rdb)
+	//集群部署时改用redis.NewClusterClient，cache:=storage.NewRedisClusterStorage(cluster)
+	if config.SessionCacheSize > 0 {
+		local, err := storage.NewLocalStorage(cache, rdb, config.SessionCacheSize, config.SessionCacheTTL)
+		if err != nil {
+			return err
+		}
+		go local.Watch(ctx.Done())
+		cache = local
 	}
 
 	r := x.NewRouter()
 	r.Use(middleware.Recover())
 
+	// presence
+	presenceHandler := handler.NewPresenceHandler(storage.NewRedisPresenceStorage(rdb), cache,
+		&server.SvrDispatcher{}, config.PresenceMinInterval)
+	r.Handle(common.CommandPresenceQuery, presenceHandler.DoQuery)
+	r.Handle(common.CommandPresenceSubscribe, presenceHandler.DoSubscribe)
+	r.Handle(common.CommandPresenceUnsubscribe, presenceHandler.DoUnsubscribe)
+	r.Handle(common.CommandPresenceStatus, presenceHandler.DoSetStatus)
+	go presenceHandler.Notify(config.PresenceNotifyInterval, ctx.Done())
 	// login
-	loginHandler := handler.NewLoginHandler()
+	loginHandler := handler.NewLoginHandler(config.DevicePolicyOf, cache.(x.SessionLeaser), presenceHandler)
 	r.Handle(common.CommandLoginSignIn, loginHandler.DoLogin)
 	r.Handle(common.CommandLoginSignOut, loginHandler.DoLogout)
+	r.Handle(common.CommandLoginRenew, loginHandler.DoRenew)
 	// talk
-	chatHandler := handler.NewChatHandler(messageService, groupService)
+	chatHandler := handler.NewChatHandler(messageService, groupService, config.RecallWindowOf, config.EditWindowOf, config.ReactionLimit)
 	r.Handle(common.CommandChatUserTalk, chatHandler.DoSingleTalk)
 	r.Handle(common.CommandChatGroupTalk, chatHandler.DoGroupTalk)
 	r.Handle(common.CommandChatTalkAck, chatHandler.DoTalkAck)
+	r.Handle(common.CommandChatTalkFallback, chatHandler.DoTalkFallback)
+	r.Handle(common.CommandChatTalkRecall, chatHandler.DoRecall)
+	r.Handle(common.CommandChatTalkEdit, chatHandler.DoEdit)
+	r.Handle(common.CommandChatReactionAdd, chatHandler.DoReactionAdd)
+	r.Handle(common.CommandChatReactionRemove, chatHandler.DoReactionRemove)
+	r.Handle(common.CommandChatThreadReplies, chatHandler.DoThreadReplies)
+	r.Handle(common.CommandChatThreadCounts, chatHandler.DoThreadCounts)
+	r.Handle(common.CommandChatUserRead, chatHandler.DoUserRead)
+	r.Handle(common.CommandChatGroupRead, chatHandler.DoGroupRead)
+	r.Handle(common.CommandChatUserReadState, chatHandler.DoUserReadState)
+	r.Handle(common.CommandChatGroupReadState, chatHandler.DoGroupReadState)
+	// notify
+	notifyHandler := handler.NewNotifyHandler(deviceService, messageService, cache.(x.LocationBatcher), config.PushOf, config.PushWorkers)
+	chatHandler.SetNotifier(notifyHandler)
+	r.Handle(common.CommandChatDeviceRegister, notifyHandler.DoRegister)
+	r.Handle(common.CommandChatDeviceUnregister, notifyHandler.DoUnregister)
+	// 离线通知只在处理消息的chat实例上记录与发送
+	if opts.serviceName == common.SNChat {
+		go notifyHandler.Notify(config.PushCollapseInterval, ctx.Done())
+	}
+	// scheduled
+	timingwheel.Start()
+	scheduleHandler := handler.NewScheduleHandler(messageService, groupService, cache, &server.SvrDispatcher{}, config.ServiceID, config.ScheduleMaxAhead)
+	scheduleHandler.SetNotifier(notifyHandler)
+	chatHandler.SetScheduler(scheduleHandler)
+	r.Handle(common.CommandChatScheduledList, scheduleHandler.DoList)
+	r.Handle(common.CommandChatScheduledCancel, scheduleHandler.DoCancel)
+	if opts.serviceName == common.SNChat {
+		go scheduleHandler.Recover(config.ScheduleScanInterval, ctx.Done())
+	}
+	// expire
+	expireHandler := handler.NewExpireHandler(messageService, cache, &server.SvrDispatcher{})
+	if opts.serviceName == common.SNChat {
+		go expireHandler.Sweep(config.ExpireSweepInterval, ctx.Done())
+	}
+	// signal
+	signalHandler := handler.NewSignalHandler(groupService, config.SignalInterval, config.SignalMaxGroupMembers)
+	r.Handle(common.CommandChatUserSignal, signalHandler.DoUserSignal)
+	r.Handle(common.CommandChatGroupSignal, signalHandler.DoGroupSignal)
 	// group
 	groupHandler := handler.NewGroupHandler(groupService)
 	r.Handle(common.CommandGroupCreate, groupHandler.DoCreate)
@@ -101,15 +168,15 @@ func RunServerStart(ctx context.Context, opts *StartOptions, version string) err
 	offlineHandler := handler.NewOfflineHandler(messageService)
 	r.Handle(common.CommandOfflineIndex, offlineHandler.DoSyncIndex)
 	r.Handle(common.CommandOfflineContent, offlineHandler.DoSyncContent)
-
-	rdb, err := conf.InitRedis(config.RedisAddrs, config.RedisPass)
-	if err != nil {
-		return err
-	}
-	cache := storage.NewRedisStorage(rdb)
-	//cache:=storage.NewRedisClusterStorage(rdb)
+	r.Handle(common.CommandConversationList, offlineHandler.DoConversationList)
+	r.Handle(common.CommandConversationSync, offlineHandler.DoConversationSync)
+	r.Handle(common.CommandConversationHistory, offlineHandler.DoConversationHistory)
+	r.Handle(common.CommandConversationMute, offlineHandler.DoConversationMute)
 
 	servHandler := server.NewServHandler(r, cache)
+	servHandler.SetGatewayGrace(config.GatewayDownGrace)
+	servHandler.SetPresenceChanged(presenceHandler.Changed)
+	go servHandler.SweepSessions(config.SessionSweepInterval, ctx.Done())
 
 	meta := make(map[string]string)
 	meta[consul.KeyHealthURL] = fmt.Sprintf("http://%s:%d/health", config.PublicAddress, config.MonitorPort)
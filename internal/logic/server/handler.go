@@ -23,6 +23,10 @@ type Handler struct {
 	//Redis中的会话管理
 	cache      x.SessionStorage
 	dispatcher *SvrDispatcher
+	// 网关断开后它的会话最多保留的时长
+	gatewayGrace time.Duration
+	// presenceChanged 网关断开或者清理会话后通知账号的在线状态可能发生了变化
+	presenceChanged func(account string)
 }
 
 func NewServHandler(r *x.Router, cache x.SessionStorage) *Handler {
@@ -58,8 +62,8 @@ func (h *Handler) Receive(agent x.Agent, payload []byte) {
 	}
 
 	var session *pkt.Session
-	//登录包
-	if packet.Command == common.CommandLoginSignIn {
+	//登录包与网关的续期包
+	if packet.Command == common.CommandLoginSignIn || packet.Command == common.CommandLoginRenew {
 		server, _ := packet.GetMeta(common.MetaDestServer)
 		//登录后生成pkt.Session
 		session = &pkt.Session{
@@ -68,8 +72,7 @@ func (h *Handler) Receive(agent x.Agent, payload []byte) {
 			Tags:      []string{"AutoGenerated"},
 		}
 	} else {
-		//todo: to be optimized
-
+		//开启本地缓存时cache为storage.LocalStorage
 		session, err = h.cache.Get(packet.ChannelID)
 		//session不存在，需要重新连接并登录
 		if errors.Is(err, x.ErrSessionNil) {
@@ -106,8 +109,64 @@ func (d *SvrDispatcher) Push(gateway string, channels []string, p *pkt.LogicPkt)
 	return container.Push(gateway, p)
 }
 
-// Disconnect default listener
+// SetGatewayGrace 设置网关断开后它的会话最多保留的时长，0表示等待租约自然过期
+func (h *Handler) SetGatewayGrace(grace time.Duration) {
+	h.gatewayGrace = grace
+}
+
+// SetPresenceChanged 设置会话因网关断开或者租约过期发生变化时的回调
+func (h *Handler) SetPresenceChanged(changed func(account string)) {
+	h.presenceChanged = changed
+}
+
+// notifyChanged 通知账号的在线状态可能发生了变化
+func (h *Handler) notifyChanged(accounts ...string) {
+	if h.presenceChanged == nil {
+		return
+	}
+	for _, account := range accounts {
+		h.presenceChanged(account)
+	}
+}
+
+// Disconnect 网关断开时缩短它的会话租约，网关恢复后的续期会重新延长
 func (h *Handler) Disconnect(id string) error {
 	logger.Warnf("in internal/logic/server/handler.go:Disconnect(): close event of %s", id)
+	leaser, ok := h.cache.(x.SessionLeaser)
+	if !ok || h.gatewayGrace <= 0 {
+		return nil
+	}
+	accounts, err := leaser.ExpireGateway(id, h.gatewayGrace)
+	if err != nil {
+		log.WithField("func", "Disconnect").Warn(err)
+	}
+	h.notifyChanged(accounts...)
 	return nil
 }
+
+// SweepSessions 定期删除租约已经过期的会话，直到stop被关闭
+func (h *Handler) SweepSessions(interval time.Duration, stop <-chan struct{}) {
+	leaser, ok := h.cache.(x.SessionLeaser)
+	if !ok || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			swept, err := leaser.Sweep()
+			if err != nil {
+				log.WithField("func", "SweepSessions").Warn(err)
+			}
+			if len(swept) > 0 {
+				log.WithField("func", "SweepSessions").Infof("%d expired sessions are deleted", len(swept))
+			}
+			for _, session := range swept {
+				h.notifyChanged(session.Account)
+			}
+		}
+	}
+}
@@ -18,12 +18,15 @@ type Model struct {
 type MessageIndex struct {
 	ID int64 `gorm:"primarykey"`
 	//ShardID   int32  `gorm:"shard_id"`
-	AccountA  string `gorm:"index;size:60;not null;comment:队列唯一标识"`
-	AccountB  string `gorm:"size:60;not null;comment:另一方"`
+	AccountA  string `gorm:"index;index:idx_acc_peer_seq,priority:1;index:idx_acc_group_seq,priority:1;index:idx_acc_peer_time,priority:1;size:60;not null;comment:队列唯一标识"`
+	AccountB  string `gorm:"index:idx_acc_peer_seq,priority:2;index:idx_acc_peer_time,priority:2;size:60;not null;comment:另一方"`
 	Direction byte   `gorm:"default:0;not null;comment:1 表示AccountA为发送者"`
-	MessageID int64  `gorm:"not null;comment:关联消息内容表中的ID"`
-	Group     string `gorm:"size:30;comment:群ID，单聊情况为空"`
-	SendTime  int64  `gorm:"index;not null;comment:消息发送时间"`
+	MessageID int64  `gorm:"index:idx_acc_peer_seq,priority:5;index:idx_acc_group_seq,priority:4;not null;comment:关联消息内容表中的ID"`
+	Group     string `gorm:"index:idx_acc_peer_seq,priority:3;index:idx_acc_group_seq,priority:2;index:idx_group_time,priority:1;size:30;comment:群ID，单聊情况为空"`
+	SendTime  int64  `gorm:"index;index:idx_acc_peer_time,priority:3;index:idx_group_time,priority:2;not null;comment:消息发送时间"`
+	Seq       int64  `gorm:"index:idx_acc_peer_seq,priority:4;index:idx_acc_group_seq,priority:3;default:0;not null;comment:消息在会话中的序号，引入序号之前写入的为0"`
+	Expired   bool   `gorm:"default:false;not null;comment:消息已过期并被清理，只保留序号"`
+	Recalled  bool   `gorm:"default:false;not null;comment:消息已撤回，不计入未读"`
 }
 
 type MessageContent struct {
@@ -32,6 +35,117 @@ type MessageContent struct {
 	Body     string `gorm:"size:5000;not null"`
 	Extra    string `gorm:"size:500"`
 	SendTime int64  `gorm:"index"`
+	Recalled bool   `gorm:"default:false;not null;comment:已撤回的消息离线同步时只返回墓碑"`
+	Version  int32  `gorm:"default:0;not null;comment:编辑次数，大于0表示已编辑"`
+	// ReplyTo 与 ThreadRoot 引用的消息在同一个会话中
+	ReplyTo    int64 `gorm:"default:0;not null;comment:回复的消息"`
+	ThreadRoot int64 `gorm:"index;default:0;not null;comment:所在话题的根消息"`
+	// 阅后即焚，过期后由清理任务清空内容，内容与索引保留为墓碑
+	TTL          int64 `gorm:"default:0;not null;comment:存活时长，单位纳秒"`
+	TTLAfterRead bool  `gorm:"default:false;not null;comment:从接收方读到后开始计算"`
+	ExpireAt     int64 `gorm:"index:idx_swept_expire,priority:2;default:0;not null;comment:过期时间，0表示不过期或者还未读到"`
+	Swept        bool  `gorm:"index:idx_swept_expire,priority:1;default:false;not null;comment:过期后已经被清理"`
+}
+
+// Expired 消息已经过期但还未被清理
+func (m *MessageContent) Expired(now int64) bool {
+	return m.ExpireAt > 0 && m.ExpireAt <= now
+}
+
+// Conversation 账号的会话，写入消息时在同一个事务中更新，已读回执重新计算未读数
+type Conversation struct {
+	ID            int64  `gorm:"primarykey"`
+	Account       string `gorm:"uniqueIndex:uni_acc_peer;index:idx_acc_last;size:60;not null"`
+	Peer          string `gorm:"uniqueIndex:uni_acc_peer;size:60;not null;comment:单聊的对方或者群ID"`
+	IsGroup       bool   `gorm:"uniqueIndex:uni_acc_peer;default:false;not null"`
+	LastMessageID int64  `gorm:"index:idx_acc_last;not null"`
+	LastSendTime  int64  `gorm:"not null"`
+	LastSeq       int64  `gorm:"default:0;not null"`
+	Unread        int32  `gorm:"default:0;not null"`
+	Muted         bool   `gorm:"default:false;not null;comment:免打扰"`
+}
+
+// ConversationSeq 会话内消息序号的计数器，在写入消息的事务中递增，事务回滚时序号一起回滚，因此序号连续。
+// 单聊的AccountA为较小的账号，群聊只有Group
+type ConversationSeq struct {
+	AccountA string `gorm:"primaryKey;size:60"`
+	AccountB string `gorm:"primaryKey;size:60"`
+	Group    string `gorm:"primaryKey;size:30"`
+	Seq      int64  `gorm:"not null"`
+}
+
+// MessageVersion 消息被编辑前的内容，保留用于审核
+type MessageVersion struct {
+	ID        int64  `gorm:"primarykey"`
+	MessageID int64  `gorm:"uniqueIndex:uni_msg_ver;not null"`
+	Version   int32  `gorm:"uniqueIndex:uni_msg_ver;not null;comment:被替换的版本"`
+	Body      string `gorm:"size:5000;not null"`
+	Extra     string `gorm:"size:500"`
+	EditTime  int64  `gorm:"not null;comment:被替换的时间"`
+}
+
+// MessageDedup 按clientMsgID去重的记录，与消息在同一个事务中写入，redis中的占位失效时由唯一索引保证只写入一次。
+// 超过MessageDedupWindow的记录由清理过期消息的任务删除
+type MessageDedup struct {
+	ID          int64  `gorm:"primarykey"`
+	App         string `gorm:"uniqueIndex:uni_app_sender_client;size:30;not null"`
+	Sender      string `gorm:"uniqueIndex:uni_app_sender_client;size:60;not null"`
+	ClientMsgID string `gorm:"uniqueIndex:uni_app_sender_client;size:64;not null"`
+	MessageID   int64  `gorm:"not null"`
+	SendTime    int64  `gorm:"not null"`
+	Seq         int64  `gorm:"default:0;not null"`
+	CreateTime  int64  `gorm:"index;not null"`
+}
+
+// MessageReaction 表情回应，同一账号对同一消息的同一表情只保存一次
+type MessageReaction struct {
+	ID         int64  `gorm:"primarykey"`
+	MessageID  int64  `gorm:"uniqueIndex:uni_msg_acc_rct;not null"`
+	Account    string `gorm:"uniqueIndex:uni_msg_acc_rct;size:60;not null"`
+	Reaction   string `gorm:"uniqueIndex:uni_msg_acc_rct;size:32;not null"`
+	CreateTime int64  `gorm:"not null"`
+}
+
+// ScheduledMessage 状态
+const (
+	ScheduledPending   = 0
+	ScheduledDelivered = 1
+	ScheduledCanceled  = 2
+	ScheduledFailed    = 3
+)
+
+// ScheduledMessage 定时发送的消息，送达时才写入MessageContent与MessageIndex
+type ScheduledMessage struct {
+	ID           int64  `gorm:"primarykey"`
+	App          string `gorm:"size:30;not null"`
+	Sender       string `gorm:"index;size:60;not null"`
+	Dest         string `gorm:"size:60;not null;comment:单聊的接收方或者群ID"`
+	IsGroup      bool   `gorm:"default:false;not null"`
+	Type         byte   `gorm:"default:0"`
+	Body         string `gorm:"size:5000;not null"`
+	Extra        string `gorm:"size:500"`
+	ReplyTo      int64  `gorm:"default:0;not null"`
+	ThreadRoot   int64  `gorm:"default:0;not null"`
+	TTL          int64  `gorm:"default:0;not null"`
+	TTLAfterRead bool   `gorm:"default:false;not null"`
+	Mentions     string `gorm:"type:text;comment:群消息提及的成员，以逗号分隔"`
+	SendAt       int64  `gorm:"index:idx_status_send;not null;comment:计划送达的时间"`
+	Status       byte   `gorm:"index:idx_status_send;default:0;not null;comment:0待发送 1已送达 2已取消 3送达失败"`
+	MessageID    int64  `gorm:"default:0;not null;comment:送达时生成的消息ID"`
+	Owner        string `gorm:"size:60;default:'';not null;comment:负责送达的调度器实例"`
+	LeaseUntil   int64  `gorm:"default:0;not null;comment:领取的有效期，过期后其他实例可以接管"`
+	CreateTime   int64  `gorm:"not null"`
+}
+
+// DeviceToken 离线推送的设备token，同一账号的同类设备只保存一个，同一token只属于一个账号
+type DeviceToken struct {
+	ID         int64  `gorm:"primarykey"`
+	App        string `gorm:"uniqueIndex:uni_app_acc_dev;size:30;not null"`
+	Account    string `gorm:"uniqueIndex:uni_app_acc_dev;size:60;not null"`
+	Device     string `gorm:"uniqueIndex:uni_app_acc_dev;size:20;not null"`
+	Platform   string `gorm:"size:10;not null;comment:apns或fcm"`
+	Token      string `gorm:"index;size:200;not null"`
+	UpdateTime int64  `gorm:"not null"`
 }
 
 type User struct {
@@ -13,6 +13,46 @@ func KeyMessageAckIndex(account string) string {
 	return fmt.Sprintf("chat:ack:%s", account)
 }
 
+// KeyMessageSyncFloor 离线同步的最早位置(send_time)，推送失败的消息由此兜底
+func KeyMessageSyncFloor(account string) string {
+	return fmt.Sprintf("chat:floor:%s", account)
+}
+
+// KeyMessageRead 单聊的读位置，field为对方账号
+func KeyMessageRead(account string) string {
+	return fmt.Sprintf("chat:read:u:%s", account)
+}
+
+// KeyGroupMessageRead 群成员的读位置，field为成员账号
+func KeyGroupMessageRead(group string) string {
+	return fmt.Sprintf("chat:read:g:%s", group)
+}
+
+// KeyMessageDedup app中发送方的客户端消息ID，值为写入后的消息，写入完成前为空
+func KeyMessageDedup(app string, sender string, clientMsgID string) string {
+	return fmt.Sprintf("chat:dedup:%s:%s:%s", app, sender, clientMsgID)
+}
+
+// 消息ID超过了Lua中double的精度，按字符串比较大小
+var advanceReadScript = redis.NewScript(`
+local cur = redis.call('HGET', KEYS[1], ARGV[1]) or '0'
+if #ARGV[2] > #cur or (#ARGV[2] == #cur and ARGV[2] > cur) then
+  redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+  redis.call('EXPIRE', KEYS[1], ARGV[3])
+  return 1
+end
+return 0
+`)
+
+// AdvanceReadIndex 读位置只前进不后退，返回是否前进
+func AdvanceReadIndex(cache *redis.Client, key, field string, msgID int64, expiresIn time.Duration) (bool, error) {
+	n, err := advanceReadScript.Run(cache, []string{key}, field, msgID, int(expiresIn/time.Second)).Int()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
 // InitRedis return a redis instance
 func InitRedis(addr string, pass string) (*redis.Client, error) {
 	redisDB := redis.NewClient(&redis.Options{
@@ -0,0 +1,421 @@
+package handler
+
+import (
+	"X_IM/internal/occult/database"
+	"X_IM/pkg/wire/common"
+	"X_IM/pkg/wire/rpc"
+	"errors"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/kataras/iris/v12"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Conversations 按最后一条消息从新到旧分页读取账号的会话
+func (h *ServiceHandler) Conversations(c iris.Context) {
+	var req rpc.ConversationsReq
+	if err := c.ReadBody(&req); err != nil {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	limit := int(req.Limit)
+	if limit <= 0 || limit > common.MessageMaxCountPerPage {
+		limit = common.MessageMaxCountPerPage
+	}
+	// 只设置了免打扰还没有消息的会话不返回
+	tx := h.MessageDB.Where("account=? and last_message_id>0", req.Account)
+	if req.Before > 0 {
+		tx = tx.Where("last_message_id<?", req.Before)
+	}
+	var rows []database.Conversation
+	if err := tx.Order("last_message_id desc").Limit(limit + 1).Find(&rows).Error; err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+	var resp rpc.ConversationsResp
+	if len(rows) > limit {
+		rows = rows[:limit]
+		resp.More = true
+	}
+	resp.List = make([]*rpc.Conversation, len(rows))
+	for i, row := range rows {
+		resp.List[i] = &rpc.Conversation{
+			Dest:          row.Peer,
+			Group:         row.IsGroup,
+			LastMessageID: row.LastMessageID,
+			LastSendTime:  row.LastSendTime,
+			Unread:        row.Unread,
+			LastSeq:       row.LastSeq,
+			Muted:         row.Muted,
+		}
+	}
+	_, _ = c.Negotiate(&resp)
+}
+
+// ConversationMute 设置会话免打扰，会话还没有消息时先创建
+func (h *ServiceHandler) ConversationMute(c iris.Context) {
+	var req rpc.ConversationMuteReq
+	if err := c.ReadBody(&req); err != nil || req.Account == "" || req.Dest == "" {
+		c.StopWithText(iris.StatusBadRequest, "invalid conversation")
+		return
+	}
+	if err := h.conversationMute(&req); err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+	}
+}
+
+func (h *ServiceHandler) conversationMute(req *rpc.ConversationMuteReq) error {
+	row := database.Conversation{
+		Account: req.Account,
+		Peer:    req.Dest,
+		IsGroup: req.Group,
+		Muted:   req.Muted,
+	}
+	return h.MessageDB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "account"}, {Name: "peer"}, {Name: "is_group"}},
+		DoUpdates: clause.AssignmentColumns([]string{"muted"}),
+	}).Create(&row).Error
+}
+
+// MutedConversations 批量读取账号设置了免打扰的会话，用于发送离线通知前过滤
+func (h *ServiceHandler) MutedConversations(c iris.Context) {
+	var req rpc.MutedConversationsReq
+	if err := c.ReadBody(&req); err != nil {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	resp, err := h.mutedConversations(&req)
+	if err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+	_, _ = c.Negotiate(resp)
+}
+
+func (h *ServiceHandler) mutedConversations(req *rpc.MutedConversationsReq) (*rpc.MutedConversationsResp, error) {
+	var rows []database.Conversation
+	if len(req.Accounts) > 0 {
+		err := h.MessageDB.Select("account", "peer", "is_group").
+			Where("account in ? and muted=?", req.Accounts, true).Find(&rows).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	var resp = rpc.MutedConversationsResp{
+		List: make([]*rpc.MutedConversation, len(rows)),
+	}
+	for i, row := range rows {
+		resp.List[i] = &rpc.MutedConversation{
+			Account: row.Account,
+			Dest:    row.Peer,
+			Group:   row.IsGroup,
+		}
+	}
+	return &resp, nil
+}
+
+// upsertConversations 把序号为seq的消息写入会话，不存在时创建，每个会话的未读数增加unread。
+// 并发写入时会话只保留更新的消息，SET最后更新last_message_id，MySQL中后面的赋值会读到前面的结果
+func upsertConversations(tx *gorm.DB, rows []database.Conversation, seq int64, unread int32) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	msgID, sendTime := rows[0].LastMessageID, rows[0].LastSendTime
+	for i := range rows {
+		rows[i].LastSeq = seq
+		rows[i].Unread = unread
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "account"}, {Name: "peer"}, {Name: "is_group"}},
+		DoUpdates: clause.Set{
+			{Column: clause.Column{Name: "last_send_time"}, Value: gorm.Expr("case when last_message_id<? then ? else last_send_time end", msgID, sendTime)},
+			{Column: clause.Column{Name: "last_seq"}, Value: gorm.Expr("case when last_seq<? then ? else last_seq end", seq, seq)},
+			{Column: clause.Column{Name: "last_message_id"}, Value: gorm.Expr("case when last_message_id<? then ? else last_message_id end", msgID, msgID)},
+			{Column: clause.Column{Name: "unread"}, Value: gorm.Expr("unread+?", unread)},
+		},
+	}).Create(&rows).Error
+}
+
+// ConversationSync 按序号分页读取账号在会话中的消息索引，序号在after之后
+func (h *ServiceHandler) ConversationSync(c iris.Context) {
+	var req rpc.ConversationSyncReq
+	if err := c.ReadBody(&req); err != nil {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	resp, err := h.conversationSync(&req)
+	if err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+	_, _ = c.Negotiate(resp)
+}
+
+// conversationSync after为0时先按messageID返回引入序号之前写入的索引（seq为0），读完之后再按序号返回
+func (h *ServiceHandler) conversationSync(req *rpc.ConversationSyncReq) (*rpc.ConversationSyncResp, error) {
+	limit := int(req.Limit)
+	if limit <= 0 || limit > common.OfflineSyncIndexCount {
+		limit = common.OfflineSyncIndexCount
+	}
+	conversation := func() *gorm.DB {
+		tx := h.MessageDB.Where("account_a=?", req.Account)
+		if req.Group {
+			return tx.Where(map[string]interface{}{"group": req.Dest})
+		}
+		return tx.Where(map[string]interface{}{"account_b": req.Dest, "group": ""})
+	}
+	var indexes []database.MessageIndex
+	if req.After == 0 {
+		err := conversation().Where("seq=? and message_id>?", 0, req.AfterMessageID).
+			Order("message_id asc").Limit(limit + 1).Find(&indexes).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(indexes) <= limit {
+		var sequenced []database.MessageIndex
+		err := conversation().Where("seq>?", req.After).
+			Order("seq asc").Limit(limit + 1 - len(indexes)).Find(&sequenced).Error
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, sequenced...)
+	}
+	var resp rpc.ConversationSyncResp
+	if len(indexes) > limit {
+		indexes = indexes[:limit]
+		resp.More = true
+	}
+	resp.List = make([]*rpc.MessageIndex, len(indexes))
+	for i, index := range indexes {
+		resp.List[i] = &rpc.MessageIndex{
+			MessageID: index.MessageID,
+			Direction: int32(index.Direction),
+			SendTime:  index.SendTime,
+			AccountB:  index.AccountB,
+			Group:     index.Group,
+			Seq:       index.Seq,
+			Expired:   index.Expired,
+		}
+	}
+	return &resp, nil
+}
+
+// userSeqCounter 单聊双方共用一个计数器，较小的账号在前
+func userSeqCounter(a, b string) database.ConversationSeq {
+	if a > b {
+		a, b = b, a
+	}
+	return database.ConversationSeq{AccountA: a, AccountB: b}
+}
+
+// nextSeq 在事务中递增会话的计数器并返回新的序号。计数器的行锁在事务提交前一直持有，
+// 同一会话并发写入的消息按序号依次提交，读到序号N时小于N的消息都已经提交或者回滚
+func nextSeq(tx *gorm.DB, counter database.ConversationSeq) (int64, error) {
+	counter.Seq = 1
+	err := tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "account_a"}, {Name: "account_b"}, {Name: "group"}},
+		DoUpdates: clause.Set{{Column: clause.Column{Name: "seq"}, Value: gorm.Expr("seq+1")}},
+	}).Create(&counter).Error
+	if err != nil {
+		return 0, err
+	}
+	var seq int64
+	err = tx.Model(&database.ConversationSeq{}).Where(map[string]interface{}{
+		"account_a": counter.AccountA,
+		"account_b": counter.AccountB,
+		"group":     counter.Group,
+	}).Pluck("seq", &seq).Error
+	return seq, err
+}
+
+// setIndexSeq 同一条消息的所有索引使用会话的序号
+func setIndexSeq(idxs []database.MessageIndex, seq int64) *[]database.MessageIndex {
+	for i := range idxs {
+		idxs[i].Seq = seq
+	}
+	return &idxs
+}
+
+// resetUnread 已读回执之后，未读数为读位置之后收到的、没有撤回或者过期的消息数
+func (h *ServiceHandler) resetUnread(req *rpc.ReadMessageReq) error {
+	received := h.MessageDB.Model(&database.MessageIndex{}).
+		Where("account_a=? and direction=? and message_id>? and expired=? and recalled=?", req.Account, 0, req.MessageID, false, false)
+	conversation := database.Conversation{Account: req.Account, Peer: req.Dest}
+	if req.Group != "" {
+		received = received.Where(map[string]interface{}{"group": req.Group})
+		conversation.Peer, conversation.IsGroup = req.Group, true
+	} else {
+		received = received.Where(map[string]interface{}{"account_b": req.Dest, "group": ""})
+	}
+	var unread int64
+	if err := received.Count(&unread).Error; err != nil {
+		return err
+	}
+	return h.MessageDB.Model(&database.Conversation{}).
+		Where("account=? and peer=? and is_group=?", conversation.Account, conversation.Peer, conversation.IsGroup).
+		Update("unread", unread).Error
+}
+
+// dropUnread 在撤回或者清理过期消息的事务中，把消息的索引标记为column（recalled或expired），
+// 之前没有被标记、接收方还没有读到的，会话的未读数减一
+func (h *ServiceHandler) dropUnread(tx *gorm.DB, msgID int64, column string) error {
+	var indexes []database.MessageIndex
+	err := tx.Select("account_a", "account_b", "group").
+		Where("message_id=? and direction=? and expired=? and recalled=?", msgID, 0, false, false).Find(&indexes).Error
+	if err != nil {
+		return err
+	}
+	if err = tx.Model(&database.MessageIndex{}).Where("message_id=?", msgID).Update(column, true).Error; err != nil {
+		return err
+	}
+	if len(indexes) == 0 {
+		return nil
+	}
+	// 读位置保存在redis中，一次pipeline读取所有接收方的
+	cmds, err := h.Cache.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, index := range indexes {
+			if index.Group != "" {
+				pipe.HGet(database.KeyGroupMessageRead(index.Group), index.AccountA)
+			} else {
+				pipe.HGet(database.KeyMessageRead(index.AccountA), index.AccountB)
+			}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+	// 群聊的接收方在同一个会话中，按会话批量更新
+	var unread = make(map[database.Conversation][]string)
+	for i, index := range indexes {
+		if read, _ := cmds[i].(*redis.StringCmd).Int64(); read >= msgID {
+			continue
+		}
+		conversation := database.Conversation{Peer: index.AccountB}
+		if index.Group != "" {
+			conversation = database.Conversation{Peer: index.Group, IsGroup: true}
+		}
+		unread[conversation] = append(unread[conversation], index.AccountA)
+	}
+	for conversation, accounts := range unread {
+		err = tx.Model(&database.Conversation{}).
+			Where("account in ? and peer=? and is_group=? and unread>0", accounts, conversation.Peer, conversation.IsGroup).
+			Update("unread", gorm.Expr("unread-1")).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConversationHistory 从游标开始按时间分页读取会话的历史消息和内容，每页按时间从早到晚排列
+func (h *ServiceHandler) ConversationHistory(c iris.Context) {
+	var req rpc.ConversationHistoryReq
+	if err := c.ReadBody(&req); err != nil {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	resp, err := h.conversationHistory(&req)
+	if errors.Is(err, ErrNotParticipant) {
+		c.StopWithError(iris.StatusForbidden, err)
+		return
+	}
+	if err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+	_, _ = c.Negotiate(resp)
+}
+
+func (h *ServiceHandler) conversationHistory(req *rpc.ConversationHistoryReq) (*rpc.ConversationHistoryResp, error) {
+	limit := int(req.Limit)
+	if limit <= 0 || limit > common.MessageMaxCountPerPage {
+		limit = common.MessageMaxCountPerPage
+	}
+	var tx *gorm.DB
+	if req.Group {
+		// 群成员只能读到加入之后的消息，退出后重新加入的从最后一次加入开始。
+		// 不依赖发送方的索引，发送方可能已经退群，每条消息的各条索引按去重后只取一条
+		var member database.GroupMember
+		err := h.BaseDB.Select("created_at").
+			Where(&database.GroupMember{Group: req.Dest, Account: req.Account}).Take(&member).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotParticipant
+		}
+		if err != nil {
+			return nil, err
+		}
+		// 群消息所有索引的account_b都是发送方
+		tx = h.MessageDB.Where(map[string]interface{}{"group": req.Dest}).
+			Where("send_time>=?", member.CreatedAt.UnixNano()).
+			Distinct("message_id", "account_b", "send_time", "seq")
+	} else {
+		tx = h.MessageDB.Where(map[string]interface{}{"account_a": req.Account, "account_b": req.Dest, "group": ""})
+		if req.Dest == req.Account {
+			// 发给自己的消息有两条索引
+			tx = tx.Where("direction=?", 1)
+		}
+		tx = tx.Select("message_id", "account_a", "account_b", "direction", "send_time", "seq")
+	}
+	// 游标为0时从最新（forward时从最早）的消息开始；同一时间发送的消息按ID排序
+	order := "send_time desc, message_id desc"
+	if req.Forward {
+		order = "send_time asc, message_id asc"
+		if req.SendTime > 0 {
+			tx = tx.Where("send_time>? or (send_time=? and message_id>?)", req.SendTime, req.SendTime, req.MessageID)
+		}
+	} else if req.SendTime > 0 {
+		tx = tx.Where("send_time<? or (send_time=? and message_id<?)", req.SendTime, req.SendTime, req.MessageID)
+	}
+	var indexes []database.MessageIndex
+	err := tx.Order(order).Limit(limit + 1).Find(&indexes).Error
+	if err != nil {
+		return nil, err
+	}
+	var resp rpc.ConversationHistoryResp
+	if len(indexes) > limit {
+		indexes = indexes[:limit]
+		resp.More = true
+	}
+	if !req.Forward {
+		for i, j := 0, len(indexes)-1; i < j; i, j = i+1, j-1 {
+			indexes[i], indexes[j] = indexes[j], indexes[i]
+		}
+	}
+	if len(indexes) == 0 {
+		return &resp, nil
+	}
+	var ids = make([]int64, len(indexes))
+	for i, index := range indexes {
+		ids[i] = index.MessageID
+	}
+	contents, err := h.messageContents(h.MessageDB.Where(ids))
+	if err != nil {
+		return nil, err
+	}
+	var byID = make(map[int64]*rpc.Message, len(contents))
+	for _, content := range contents {
+		byID[content.ID] = content
+	}
+	resp.List = make([]*rpc.HistoryMessage, 0, len(indexes))
+	for _, index := range indexes {
+		content, ok := byID[index.MessageID]
+		if !ok {
+			continue
+		}
+		// 发送方的索引中account_a是发送方，接收方的索引中account_b是发送方
+		sender := index.AccountB
+		if index.Direction == 1 {
+			sender = index.AccountA
+		}
+		resp.List = append(resp.List, &rpc.HistoryMessage{
+			Sender:   sender,
+			SendTime: index.SendTime,
+			Seq:      index.Seq,
+			Message:  content,
+		})
+	}
+	return &resp, nil
+}
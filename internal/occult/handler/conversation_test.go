@@ -0,0 +1,281 @@
+package handler
+
+import (
+	"X_IM/internal/occult/database"
+	"X_IM/pkg/wire/rpc"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConversationMute(t *testing.T) {
+	h := newTestHandler(t)
+	group := createGroup(t, h, "alice", "bob")
+
+	// 还没有消息的会话也可以设置免打扰，新消息不改变免打扰
+	assert.Nil(t, h.conversationMute(&rpc.ConversationMuteReq{Account: "bob", Dest: group, Group: true, Muted: true}))
+	assert.Nil(t, h.conversationMute(&rpc.ConversationMuteReq{Account: "bob", Dest: "alice", Muted: true}))
+	sendGroupMessage(t, h, "alice", group, &rpc.Message{Body: "hi"})
+	var row database.Conversation
+	assert.Nil(t, h.MessageDB.Where("account=? and peer=? and is_group=?", "bob", group, true).Take(&row).Error)
+	assert.True(t, row.Muted)
+	assert.Equal(t, int32(1), row.Unread)
+
+	resp, err := h.mutedConversations(&rpc.MutedConversationsReq{Accounts: []string{"bob", "carol"}})
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []*rpc.MutedConversation{
+		{Account: "bob", Dest: group, Group: true},
+		{Account: "bob", Dest: "alice"},
+	}, resp.List)
+
+	assert.Nil(t, h.conversationMute(&rpc.ConversationMuteReq{Account: "bob", Dest: "alice", Muted: false}))
+	resp, err = h.mutedConversations(&rpc.MutedConversationsReq{Accounts: []string{"bob"}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(resp.List))
+	assert.Equal(t, group, resp.List[0].Dest)
+}
+
+func TestUnreadRecallExpire(t *testing.T) {
+	h := newTestHandler(t)
+	unreadOf := func(account, peer string, group bool) int32 {
+		var row database.Conversation
+		err := h.MessageDB.Where("account=? and peer=? and is_group=?", account, peer, group).Take(&row).Error
+		assert.Nil(t, err)
+		return row.Unread
+	}
+	recall := func(msgID int64) {
+		_, err := h.messageRecall(&rpc.RecallMessageReq{Account: "alice", MessageID: msgID, Window: int64(time.Minute)})
+		assert.Nil(t, err)
+	}
+	expire := func(msgID int64) {
+		assert.Nil(t, h.MessageDB.Model(&database.MessageContent{}).
+			Where("id=?", msgID).Update("expire_at", time.Now().UnixNano()).Error)
+		_, err := h.sweepExpired(&rpc.SweepExpiredReq{Before: time.Now().Add(time.Second).UnixNano()})
+		assert.Nil(t, err)
+	}
+
+	// 群聊：已经读到这条消息的成员未读数不变
+	group := createGroup(t, h, "alice", "bob", "carol")
+	m1 := sendGroupMessage(t, h, "alice", group, &rpc.Message{Type: 1, Body: "1"})
+	m2 := sendGroupMessage(t, h, "alice", group, &rpc.Message{Type: 1, Body: "2", Ttl: int64(time.Hour)})
+	_, err := h.messageRead(&rpc.ReadMessageReq{Account: "carol", Group: group, MessageID: m1.MessageID})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), unreadOf("bob", group, true))
+	assert.Equal(t, int32(1), unreadOf("carol", group, true))
+	recall(m1.MessageID)
+	assert.Equal(t, int32(1), unreadOf("bob", group, true))
+	assert.Equal(t, int32(1), unreadOf("carol", group, true))
+	expire(m2.MessageID)
+	assert.Equal(t, int32(0), unreadOf("bob", group, true))
+	assert.Equal(t, int32(0), unreadOf("carol", group, true))
+	assert.Equal(t, int32(0), unreadOf("alice", group, true))
+
+	// 单聊：重复撤回不会重复减少，已读回执重新计算时不计入撤回与过期的消息
+	s1 := sendUserMessage(t, h, "alice", "bob", &rpc.Message{Type: 1, Body: "1"})
+	s2 := sendUserMessage(t, h, "alice", "bob", &rpc.Message{Type: 1, Body: "2", Ttl: int64(time.Hour)})
+	s3 := sendUserMessage(t, h, "alice", "bob", &rpc.Message{Type: 1, Body: "3"})
+	sendUserMessage(t, h, "alice", "bob", &rpc.Message{Type: 1, Body: "4"})
+	recall(s3.MessageID)
+	recall(s3.MessageID)
+	assert.Equal(t, int32(3), unreadOf("bob", "alice", false))
+	expire(s2.MessageID)
+	assert.Equal(t, int32(2), unreadOf("bob", "alice", false))
+	_, err = h.messageRead(&rpc.ReadMessageReq{Account: "bob", Dest: "alice", MessageID: s1.MessageID})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), unreadOf("bob", "alice", false))
+	// 已经过期的消息再撤回不会重复减少
+	recall(s2.MessageID)
+	assert.Equal(t, int32(1), unreadOf("bob", "alice", false))
+}
+
+func TestConversationSeqConcurrent(t *testing.T) {
+	h := newTestHandler(t)
+	// sqlite同时只允许一个写事务，这里限制为一个连接，并发的写入在连接池上排队
+	sqlDB, _ := h.MessageDB.DB()
+	sqlDB.SetMaxOpenConns(1)
+
+	const count = 40
+	var wg sync.WaitGroup
+	var seqs = make(chan int64, count)
+	for i := 0; i < count; i++ {
+		sender, dest := "alice", "bob"
+		if i%2 == 1 {
+			sender, dest = dest, sender
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := h.insertUserMessage(h.MessageDB, &rpc.InsertMessageReq{
+				Sender:   sender,
+				Dest:     dest,
+				SendTime: time.Now().UnixNano(),
+				Message:  &rpc.Message{Type: 1, Body: "hi"},
+			})
+			assert.Nil(t, err)
+			seqs <- resp.Seq
+		}()
+	}
+	wg.Wait()
+	close(seqs)
+
+	// 双方共用一个计数器，序号从1开始连续且不重复
+	var got []int64
+	for seq := range seqs {
+		got = append(got, seq)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	for i, seq := range got {
+		assert.Equal(t, int64(i+1), seq)
+	}
+	var row database.Conversation
+	assert.Nil(t, h.MessageDB.Where("account=? and peer=?", "bob", "alice").Take(&row).Error)
+	assert.Equal(t, int64(count), row.LastSeq)
+}
+
+func TestConversationSync(t *testing.T) {
+	h := newTestHandler(t)
+	var sent []*rpc.InsertMessageResp
+	for i := 0; i < 5; i++ {
+		sent = append(sent, sendUserMessage(t, h, "alice", "bob", &rpc.Message{Type: 1, Body: "hi"}))
+	}
+	sendUserMessage(t, h, "alice", "carol", &rpc.Message{Type: 1, Body: "other"})
+	// 前两条模拟引入序号之前写入的索引
+	assert.Nil(t, h.MessageDB.Model(&database.MessageIndex{}).
+		Where("message_id in ?", []int64{sent[0].MessageID, sent[1].MessageID}).Update("seq", 0).Error)
+
+	// 旧索引按messageID排在最前面，之后按序号分页
+	req := &rpc.ConversationSyncReq{Account: "bob", Dest: "alice", Limit: 1}
+	resp, err := h.conversationSync(req)
+	assert.Nil(t, err)
+	assert.True(t, resp.More)
+	assert.Equal(t, sent[0].MessageID, resp.List[0].MessageID)
+
+	req.AfterMessageID, req.Limit = resp.List[0].MessageID, 2
+	resp, err = h.conversationSync(req)
+	assert.Nil(t, err)
+	assert.True(t, resp.More)
+	assert.Equal(t, []int64{sent[1].MessageID, sent[2].MessageID}, []int64{resp.List[0].MessageID, resp.List[1].MessageID})
+	assert.Equal(t, []int64{0, sent[2].Seq}, []int64{resp.List[0].Seq, resp.List[1].Seq})
+
+	req.After, req.AfterMessageID = resp.List[1].Seq, 0
+	resp, err = h.conversationSync(req)
+	assert.Nil(t, err)
+	assert.False(t, resp.More)
+	assert.Len(t, resp.List, 2)
+	assert.Equal(t, sent[3].Seq, resp.List[0].Seq)
+	assert.Equal(t, sent[4].Seq, resp.List[1].Seq)
+
+	// 发送方的索引与接收方的序号相同，其他会话的索引不会返回
+	resp, err = h.conversationSync(&rpc.ConversationSyncReq{Account: "alice", Dest: "bob", After: sent[3].Seq})
+	assert.Nil(t, err)
+	assert.Len(t, resp.List, 1)
+	assert.Equal(t, sent[4].MessageID, resp.List[0].MessageID)
+	assert.Equal(t, int32(1), resp.List[0].Direction)
+}
+
+func TestConversationHistoryJoinTime(t *testing.T) {
+	h := newTestHandler(t)
+	group := createGroup(t, h, "alice", "bob")
+	before := sendGroupMessage(t, h, "alice", group, &rpc.Message{Type: 1, Body: "before"})
+	time.Sleep(time.Millisecond)
+	assert.Nil(t, h.BaseDB.Create(&database.GroupMember{
+		Model:   database.Model{ID: h.IDGen.Next().Int64()},
+		Account: "dave",
+		Group:   group,
+	}).Error)
+	time.Sleep(time.Millisecond)
+	after := sendGroupMessage(t, h, "bob", group, &rpc.Message{Type: 1, Body: "after"})
+
+	// 新成员只能读到加入之后的消息，原来的成员可以读到全部
+	resp, err := h.conversationHistory(&rpc.ConversationHistoryReq{Account: "dave", Dest: group, Group: true})
+	assert.Nil(t, err)
+	assert.Len(t, resp.List, 1)
+	assert.Equal(t, "after", resp.List[0].Message.Body)
+	assert.Equal(t, "bob", resp.List[0].Sender)
+	resp, err = h.conversationHistory(&rpc.ConversationHistoryReq{Account: "dave", Dest: group, Group: true,
+		SendTime: after.SendTime, MessageID: after.MessageID})
+	assert.Nil(t, err)
+	assert.Empty(t, resp.List)
+	resp, err = h.conversationHistory(&rpc.ConversationHistoryReq{Account: "bob", Dest: group, Group: true})
+	assert.Nil(t, err)
+	assert.Len(t, resp.List, 2)
+	assert.Equal(t, before.MessageID, resp.List[0].Message.ID)
+
+	_, err = h.conversationHistory(&rpc.ConversationHistoryReq{Account: "mallory", Dest: group, Group: true})
+	assert.ErrorIs(t, err, ErrNotParticipant)
+}
+
+func TestConversationHistorySenderLeft(t *testing.T) {
+	h := newTestHandler(t)
+	group := createGroup(t, h, "alice", "bob", "carol")
+	left := sendGroupMessage(t, h, "carol", group, &rpc.Message{Type: 1, Body: "bye"})
+	stay := sendGroupMessage(t, h, "alice", group, &rpc.Message{Type: 1, Body: "hi"})
+	// carol退群，她自己的索引也已经被删除
+	assert.Nil(t, h.BaseDB.Where(&database.GroupMember{Group: group, Account: "carol"}).Delete(&database.GroupMember{}).Error)
+	assert.Nil(t, h.MessageDB.Where("account_a=?", "carol").Delete(&database.MessageIndex{}).Error)
+
+	resp, err := h.conversationHistory(&rpc.ConversationHistoryReq{Account: "bob", Dest: group, Group: true})
+	assert.Nil(t, err)
+	// 每条消息只返回一次
+	assert.Len(t, resp.List, 2)
+	assert.Equal(t, left.MessageID, resp.List[0].Message.ID)
+	assert.Equal(t, "carol", resp.List[0].Sender)
+	assert.Equal(t, left.Seq, resp.List[0].Seq)
+	assert.Equal(t, stay.MessageID, resp.List[1].Message.ID)
+	assert.Equal(t, "alice", resp.List[1].Sender)
+
+	resp, err = h.conversationHistory(&rpc.ConversationHistoryReq{Account: "bob", Dest: group, Group: true, Limit: 1})
+	assert.Nil(t, err)
+	assert.True(t, resp.More)
+	assert.Len(t, resp.List, 1)
+	assert.Equal(t, stay.MessageID, resp.List[0].Message.ID)
+}
+
+func TestConversationHistoryCursor(t *testing.T) {
+	h := newTestHandler(t)
+	var sent []*rpc.InsertMessageResp
+	for i := 0; i < 5; i++ {
+		sender, dest := "alice", "bob"
+		if i%2 == 1 {
+			sender, dest = dest, sender
+		}
+		sent = append(sent, sendUserMessage(t, h, sender, dest, &rpc.Message{Type: 1, Body: "hi"}))
+	}
+	sendUserMessage(t, h, "alice", "carol", &rpc.Message{Type: 1, Body: "other"})
+	idsOf := func(resp *rpc.ConversationHistoryResp) []int64 {
+		var ids []int64
+		for _, m := range resp.List {
+			ids = append(ids, m.Message.ID)
+		}
+		return ids
+	}
+
+	// 向前翻页：从最新的消息开始，每页按时间从早到晚排列
+	req := &rpc.ConversationHistoryReq{Account: "bob", Dest: "alice", Limit: 2}
+	resp, err := h.conversationHistory(req)
+	assert.Nil(t, err)
+	assert.True(t, resp.More)
+	assert.Equal(t, []int64{sent[3].MessageID, sent[4].MessageID}, idsOf(resp))
+	req.SendTime, req.MessageID = resp.List[0].SendTime, resp.List[0].Message.ID
+	resp, err = h.conversationHistory(req)
+	assert.Nil(t, err)
+	assert.True(t, resp.More)
+	assert.Equal(t, []int64{sent[1].MessageID, sent[2].MessageID}, idsOf(resp))
+	req.SendTime, req.MessageID = resp.List[0].SendTime, resp.List[0].Message.ID
+	resp, err = h.conversationHistory(req)
+	assert.Nil(t, err)
+	assert.False(t, resp.More)
+	assert.Equal(t, []int64{sent[0].MessageID}, idsOf(resp))
+	assert.Equal(t, "alice", resp.List[0].Sender)
+
+	// 向后翻页：从游标之后更新的消息开始
+	resp, err = h.conversationHistory(&rpc.ConversationHistoryReq{Account: "alice", Dest: "bob", Forward: true, Limit: 3,
+		SendTime: sent[1].SendTime, MessageID: sent[1].MessageID})
+	assert.Nil(t, err)
+	assert.False(t, resp.More)
+	assert.Equal(t, []int64{sent[2].MessageID, sent[3].MessageID, sent[4].MessageID}, idsOf(resp))
+	assert.Equal(t, "bob", resp.List[1].Sender)
+}
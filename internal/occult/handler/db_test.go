@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"X_IM/internal/occult/database"
+	"X_IM/pkg/wire/rpc"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestHandler 使用内存中的sqlite与miniredis，每个测试一个独立的库
+func newTestHandler(t *testing.T) *ServiceHandler {
+	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AutoMigrate(&database.Group{}, &database.GroupMember{}, &database.DeviceToken{},
+		&database.MessageIndex{}, &database.MessageContent{}, &database.MessageVersion{}, &database.MessageReaction{},
+		&database.ScheduledMessage{}, &database.Conversation{}, &database.ConversationSeq{}, &database.MessageDedup{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, _ := db.DB()
+	t.Cleanup(func() { _ = sqlDB.Close() })
+
+	mr := miniredis.RunT(t)
+	idgen, _ := database.NewIDGenerator(1)
+	return &ServiceHandler{
+		BaseDB:    db,
+		MessageDB: db,
+		Cache:     redis.NewClient(&redis.Options{Addr: mr.Addr()}),
+		IDGen:     idgen,
+	}
+}
+
+func sendUserMessage(t *testing.T, h *ServiceHandler, sender, dest string, message *rpc.Message) *rpc.InsertMessageResp {
+	resp, err := h.insertUserMessage(h.MessageDB, &rpc.InsertMessageReq{
+		Sender:   sender,
+		Dest:     dest,
+		SendTime: time.Now().UnixNano(),
+		Message:  message,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func sendGroupMessage(t *testing.T, h *ServiceHandler, sender, group string, message *rpc.Message) *rpc.InsertMessageResp {
+	resp, err := h.insertGroupMessage(h.MessageDB, &rpc.InsertMessageReq{
+		Sender:   sender,
+		Dest:     group,
+		SendTime: time.Now().UnixNano(),
+		Message:  message,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func createGroup(t *testing.T, h *ServiceHandler, owner string, members ...string) string {
+	id, err := h.groupCreate(&rpc.CreateGroupReq{
+		App:     "x_t",
+		Name:    "testg",
+		Owner:   owner,
+		Members: append([]string{owner}, members...),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id.Base36()
+}
@@ -0,0 +1,140 @@
+package handler
+
+import (
+	"X_IM/internal/occult/database"
+	"X_IM/pkg/logger"
+	"X_IM/pkg/wire/common"
+	"X_IM/pkg/wire/rpc"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrDuplicateInFlight = errors.New("the message with the same clientMsgID is still being inserted")
+	// errDedupReleased 占位已经被删除，例如第一次写入失败，重新占位
+	errDedupReleased = errors.New("dedup placeholder is released")
+)
+
+const (
+	// dedupWait 重复的请求等待第一次写入完成的最长时间
+	dedupWait = time.Second * 3
+	// dedupInsertTimeout 写入消息的事务的超时时间
+	dedupInsertTimeout = time.Second * 10
+	// dedupPending 占位的有效期，远长于dedupInsertTimeout，写入完成后延长到MessageDedupWindow。
+	// 保存写入结果失败时占位过期后可以重试，重试由数据库中的唯一索引返回原来的消息
+	dedupPending = time.Minute
+)
+
+// insertOnce 同一app中同一发送方的clientMsgID在MessageDedupWindow内只写入一次，重复的请求返回原来的消息。
+// 第一次写入前用SETNX占位，写入失败时删除占位，允许客户端重试；数据库中的MessageDedup与消息在同一个事务中写入，
+// 占位失效时也不会重复写入
+func (h *ServiceHandler) insertOnce(app string, req *rpc.InsertMessageReq, insert func(tx *gorm.DB) (*rpc.InsertMessageResp, error)) (*rpc.InsertMessageResp, error) {
+	if req.ClientMsgID == "" {
+		return insert(h.MessageDB)
+	}
+	key := database.KeyMessageDedup(app, req.Sender, req.ClientMsgID)
+	deadline := time.Now().Add(dedupWait)
+	for {
+		ok, err := h.Cache.SetNX(key, "", dedupPending).Result()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		resp, err := h.waitInserted(key, deadline)
+		if !errors.Is(err, errDedupReleased) {
+			return resp, err
+		}
+	}
+	resp, err := h.insertDedup(app, req, insert)
+	if err != nil {
+		_ = h.Cache.Del(key).Err()
+		return nil, err
+	}
+	// 消息已经写入，保存失败时占位过期后由数据库去重
+	val := fmt.Sprintf("%d:%d:%d", resp.MessageID, resp.SendTime, resp.Seq)
+	if err = h.Cache.Set(key, val, common.MessageDedupWindow).Err(); err != nil {
+		logger.WithField("func", "insertOnce").Warn(err)
+	}
+	return resp, nil
+}
+
+// insertDedup 在同一个事务中写入消息与MessageDedup，窗口内已经写入过时返回原来的消息
+func (h *ServiceHandler) insertDedup(app string, req *rpc.InsertMessageReq, insert func(tx *gorm.DB) (*rpc.InsertMessageResp, error)) (*rpc.InsertMessageResp, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dedupInsertTimeout)
+	defer cancel()
+	now := time.Now().UnixNano()
+	var resp *rpc.InsertMessageResp
+	err := h.MessageDB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		dedup := database.MessageDedup{
+			ID:          h.IDGen.Next().Int64(),
+			App:         app,
+			Sender:      req.Sender,
+			ClientMsgID: req.ClientMsgID,
+			CreateTime:  now,
+		}
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&dedup)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			var prev database.MessageDedup
+			err := tx.Where("app=? and sender=? and client_msg_id=?", app, req.Sender, req.ClientMsgID).Take(&prev).Error
+			if err != nil {
+				return err
+			}
+			if prev.CreateTime > now-int64(common.MessageDedupWindow) {
+				resp = &rpc.InsertMessageResp{MessageID: prev.MessageID, SendTime: prev.SendTime, Seq: prev.Seq, Duplicate: true}
+				return nil
+			}
+			// 超过时间窗口的记录还没有被清理，重新写入
+			dedup.ID = prev.ID
+		}
+		inserted, err := insert(tx)
+		if err != nil {
+			return err
+		}
+		resp = inserted
+		return tx.Model(&database.MessageDedup{ID: dedup.ID}).Updates(map[string]interface{}{
+			"message_id":  inserted.MessageID,
+			"send_time":   inserted.SendTime,
+			"seq":         inserted.Seq,
+			"create_time": now,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// waitInserted 读取第一次写入的消息，还在写入时等待到deadline，占位已经被删除时返回errDedupReleased
+func (h *ServiceHandler) waitInserted(key string, deadline time.Time) (*rpc.InsertMessageResp, error) {
+	for {
+		val, err := h.Cache.Get(key).Result()
+		if err == redis.Nil {
+			return nil, errDedupReleased
+		}
+		if err != nil {
+			return nil, err
+		}
+		if val != "" {
+			var resp = rpc.InsertMessageResp{Duplicate: true}
+			if _, err = fmt.Sscanf(val, "%d:%d:%d", &resp.MessageID, &resp.SendTime, &resp.Seq); err != nil {
+				return nil, err
+			}
+			return &resp, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrDuplicateInFlight
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+}
@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"X_IM/internal/occult/database"
+	"X_IM/pkg/wire/common"
+	"X_IM/pkg/wire/rpc"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestInsertOnce(t *testing.T) {
+	h := newTestHandler(t)
+	mr := miniredis.RunT(t)
+	h.Cache = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	req := &rpc.InsertMessageReq{Sender: "alice", Dest: "bob", ClientMsgID: "c1", Message: &rpc.Message{Type: 1, Body: "hi"}}
+	send := func(app string) (*rpc.InsertMessageResp, error) {
+		return h.insertOnce(app, req, func(tx *gorm.DB) (*rpc.InsertMessageResp, error) {
+			req.SendTime = time.Now().UnixNano()
+			return h.insertUserMessage(tx, req)
+		})
+	}
+
+	first, err := send("app1")
+	assert.Nil(t, err)
+	assert.False(t, first.Duplicate)
+	dup, err := send("app1")
+	assert.Nil(t, err)
+	assert.True(t, dup.Duplicate)
+	assert.Equal(t, first.MessageID, dup.MessageID)
+	assert.Equal(t, first.SendTime, dup.SendTime)
+	assert.Equal(t, first.Seq, dup.Seq)
+
+	// 不同app中相同的clientMsgID互不影响
+	other, err := send("app2")
+	assert.Nil(t, err)
+	assert.False(t, other.Duplicate)
+
+	// redis中的记录丢失时由数据库去重
+	mr.FlushAll()
+	dup, err = send("app1")
+	assert.Nil(t, err)
+	assert.True(t, dup.Duplicate)
+	assert.Equal(t, first.MessageID, dup.MessageID)
+	assert.Equal(t, first.Seq, dup.Seq)
+
+	// 超过时间窗口后重新写入
+	mr.FastForward(common.MessageDedupWindow)
+	assert.Nil(t, h.MessageDB.Model(&database.MessageDedup{}).Where("app=?", "app1").
+		Update("create_time", time.Now().Add(-common.MessageDedupWindow).UnixNano()).Error)
+	again, err := send("app1")
+	assert.Nil(t, err)
+	assert.False(t, again.Duplicate)
+	assert.NotEqual(t, first.MessageID, again.MessageID)
+
+	var count int64
+	assert.Nil(t, h.MessageDB.Model(&database.MessageDedup{}).Count(&count).Error)
+	assert.Equal(t, int64(2), count)
+}
+
+func TestInsertOnceInFlight(t *testing.T) {
+	h := newTestHandler(t)
+	mr := miniredis.RunT(t)
+	h.Cache = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	req := &rpc.InsertMessageReq{Sender: "alice", Dest: "bob", ClientMsgID: "c1", Message: &rpc.Message{Type: 1, Body: "hi"}}
+	key := database.KeyMessageDedup("app1", "alice", "c1")
+	insert := func(tx *gorm.DB) (*rpc.InsertMessageResp, error) {
+		req.SendTime = time.Now().UnixNano()
+		return h.insertUserMessage(tx, req)
+	}
+
+	// 第一次写入失败时删除占位，重试可以写入
+	_, err := h.insertOnce("app1", req, func(tx *gorm.DB) (*rpc.InsertMessageResp, error) {
+		return nil, errors.New("db down")
+	})
+	assert.NotNil(t, err)
+	assert.False(t, mr.Exists(key))
+
+	// 第一次写入还没有完成时，重复的请求等待它完成
+	assert.Nil(t, mr.Set(key, ""))
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		_ = mr.Set(key, "7:8:9")
+	}()
+	resp, err := h.insertOnce("app1", req, nil)
+	assert.Nil(t, err)
+	assert.True(t, resp.Duplicate)
+	assert.Equal(t, int64(7), resp.MessageID)
+	assert.Equal(t, int64(9), resp.Seq)
+
+	// 等待期间第一次写入失败并删除了占位，重新占位后写入
+	assert.Nil(t, mr.Set(key, ""))
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		mr.Del(key)
+	}()
+	first, err := h.insertOnce("app1", req, insert)
+	assert.Nil(t, err)
+	assert.False(t, first.Duplicate)
+	assert.Equal(t, common.MessageDedupWindow, mr.TTL(key))
+
+	// 写入成功但保存结果失败时仍然返回写入的消息，占位在dedupPending后过期
+	req.ClientMsgID = "c2"
+	key = database.KeyMessageDedup("app1", "alice", "c2")
+	second, err := h.insertOnce("app1", req, func(tx *gorm.DB) (*rpc.InsertMessageResp, error) {
+		resp, err := insert(tx)
+		mr.SetError("redis down")
+		return resp, err
+	})
+	mr.SetError("")
+	assert.Nil(t, err)
+	assert.False(t, second.Duplicate)
+	assert.Equal(t, dedupPending, mr.TTL(key))
+	// 占位过期之前重复的请求等待dedupWait后返回409
+	_, err = h.insertOnce("app1", req, nil)
+	assert.ErrorIs(t, err, ErrDuplicateInFlight)
+	// 占位过期之后由数据库返回原来的消息
+	mr.FastForward(dedupPending)
+	resp, err = h.insertOnce("app1", req, insert)
+	assert.Nil(t, err)
+	assert.True(t, resp.Duplicate)
+	assert.Equal(t, second.MessageID, resp.MessageID)
+	assert.Equal(t, second.Seq, resp.Seq)
+	assert.Equal(t, common.MessageDedupWindow, mr.TTL(key))
+}
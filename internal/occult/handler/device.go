@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"X_IM/internal/occult/database"
+	"X_IM/pkg/wire/rpc"
+	"time"
+
+	"github.com/kataras/iris/v12"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RegisterToken 保存账号当前设备的推送token，覆盖同一app中同类设备之前的token；
+// 同一个token之前属于其他账号时一并删除，例如手机上切换了登录的账号
+func (h *ServiceHandler) RegisterToken(c iris.Context) {
+	var req rpc.RegisterTokenReq
+	if err := c.ReadBody(&req); err != nil || req.Token == nil || req.Token.Token == "" {
+		c.StopWithText(iris.StatusBadRequest, "invalid device token")
+		return
+	}
+	if err := h.registerToken(c.Params().Get("app"), req.Token); err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+	}
+}
+
+func (h *ServiceHandler) registerToken(app string, req *rpc.DeviceToken) error {
+	token := database.DeviceToken{
+		ID:         h.IDGen.Next().Int64(),
+		App:        app,
+		Account:    req.Account,
+		Device:     req.Device,
+		Platform:   req.Platform,
+		Token:      req.Token,
+		UpdateTime: time.Now().UnixNano(),
+	}
+	return h.BaseDB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("app=? and token=? and (account<>? or device<>?)", app, token.Token, token.Account, token.Device).
+			Delete(&database.DeviceToken{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "app"}, {Name: "account"}, {Name: "device"}},
+			DoUpdates: clause.AssignmentColumns([]string{"platform", "token", "update_time"}),
+		}).Create(&token).Error
+	})
+}
+
+// UnregisterToken 删除账号设备的推送token，device为空时删除token本身，不存在时直接返回成功
+func (h *ServiceHandler) UnregisterToken(c iris.Context) {
+	var req rpc.UnregisterTokenReq
+	if err := c.ReadBody(&req); err != nil {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	tx := h.BaseDB.Where("app=? and account=?", c.Params().Get("app"), req.Account)
+	if req.Device != "" {
+		tx = tx.Where("device=?", req.Device)
+	} else {
+		tx = tx.Where("token=?", req.Token)
+	}
+	if err := tx.Delete(&database.DeviceToken{}).Error; err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+	}
+}
+
+// DeviceTokens 批量读取账号所有设备的推送token
+func (h *ServiceHandler) DeviceTokens(c iris.Context) {
+	var req rpc.DeviceTokensReq
+	if err := c.ReadBody(&req); err != nil {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	var tokens []database.DeviceToken
+	if len(req.Accounts) > 0 {
+		err := h.BaseDB.Where("app=? and account in ?", c.Params().Get("app"), req.Accounts).Find(&tokens).Error
+		if err != nil {
+			c.StopWithError(iris.StatusInternalServerError, err)
+			return
+		}
+	}
+	var resp = rpc.DeviceTokensResp{
+		Tokens: make([]*rpc.DeviceToken, len(tokens)),
+	}
+	for i, token := range tokens {
+		resp.Tokens[i] = &rpc.DeviceToken{
+			Account:  token.Account,
+			Device:   token.Device,
+			Platform: token.Platform,
+			Token:    token.Token,
+		}
+	}
+	_, _ = c.Negotiate(&resp)
+}
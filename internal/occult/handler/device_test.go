@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"X_IM/internal/occult/database"
+	"X_IM/pkg/wire/rpc"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterTokenPerApp(t *testing.T) {
+	h := newTestHandler(t)
+	register := func(app, account, device, token string) {
+		err := h.registerToken(app, &rpc.DeviceToken{Account: account, Device: device, Platform: "apns", Token: token})
+		assert.Nil(t, err)
+	}
+	tokensOf := func(app string) map[string]string {
+		var rows []database.DeviceToken
+		assert.Nil(t, h.BaseDB.Where("app=?", app).Find(&rows).Error)
+		var tokens = make(map[string]string)
+		for _, row := range rows {
+			tokens[row.Account+"/"+row.Device] = row.Token
+		}
+		return tokens
+	}
+
+	// 同一账号在不同app中的token互不覆盖
+	register("app1", "bob", "ios", "t1")
+	register("app2", "bob", "ios", "t2")
+	assert.Equal(t, map[string]string{"bob/ios": "t1"}, tokensOf("app1"))
+	assert.Equal(t, map[string]string{"bob/ios": "t2"}, tokensOf("app2"))
+
+	// 同一app中同类设备的token被覆盖，切换账号后token只属于最后注册的账号
+	register("app1", "bob", "ios", "t3")
+	register("app1", "carol", "ios", "t3")
+	assert.Equal(t, map[string]string{"carol/ios": "t3"}, tokensOf("app1"))
+	assert.Equal(t, map[string]string{"bob/ios": "t2"}, tokensOf("app2"))
+}
@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"X_IM/internal/occult/database"
+	"X_IM/pkg/wire/common"
+	"X_IM/pkg/wire/rpc"
+
+	"github.com/kataras/iris/v12"
+	"gorm.io/gorm"
+)
+
+// SweepExpired 清理所有app在before之前过期的消息：清空内容，删除回应与编辑历史，索引标记为过期后保留，
+// 会话的序号不会出现空洞，还没有读到的接收方未读数减一。返回被清理的消息以及有它索引的账号，用于通知参与者。
+// 多个清理任务同时运行时每条消息只会被其中一个清理并返回。
+// 同时删除超过MessageDedupWindow的去重记录
+func (h *ServiceHandler) SweepExpired(c iris.Context) {
+	var req rpc.SweepExpiredReq
+	if err := c.ReadBody(&req); err != nil {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	resp, err := h.sweepExpired(&req)
+	if err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+	_, _ = c.Negotiate(resp)
+}
+
+func (h *ServiceHandler) sweepExpired(req *rpc.SweepExpiredReq) (*rpc.SweepExpiredResp, error) {
+	limit := int(req.Limit)
+	if limit <= 0 || limit > common.MessageMaxCountPerPage {
+		limit = common.MessageMaxCountPerPage
+	}
+	err := h.MessageDB.Where("create_time<?", req.Before-int64(common.MessageDedupWindow)).
+		Delete(&database.MessageDedup{}).Error
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	err = h.MessageDB.Model(&database.MessageContent{}).
+		Where("swept=? and expire_at>0 and expire_at<=?", false, req.Before).
+		Order("expire_at asc").Limit(limit).Pluck("id", &ids).Error
+	if err != nil {
+		return nil, err
+	}
+	var resp rpc.SweepExpiredResp
+	for _, id := range ids {
+		expired, err := h.sweepMessage(id, req.Before)
+		if err != nil {
+			return nil, err
+		}
+		if expired != nil {
+			resp.List = append(resp.List, expired)
+		}
+	}
+	return &resp, nil
+}
+
+// sweepMessage 在同一个事务中把过期的消息清理为墓碑，已经被清理时返回nil
+func (h *ServiceHandler) sweepMessage(id int64, before int64) (*rpc.ExpiredMessage, error) {
+	var expired *rpc.ExpiredMessage
+	err := h.MessageDB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&database.MessageContent{}).
+			Where("id=? and swept=? and expire_at>0 and expire_at<=?", id, false, before).
+			Updates(map[string]interface{}{"body": "", "extra": "", "swept": true})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		var indexes []database.MessageIndex
+		err := tx.Select("account_a", "group").Where("message_id=?", id).Find(&indexes).Error
+		if err != nil {
+			return err
+		}
+		expired = &rpc.ExpiredMessage{MessageID: id}
+		for _, index := range indexes {
+			expired.Group = index.Group
+			expired.Accounts = append(expired.Accounts, index.AccountA)
+		}
+		if err = h.dropUnread(tx, id, "expired"); err != nil {
+			return err
+		}
+		for _, model := range []interface{}{&database.MessageReaction{}, &database.MessageVersion{}} {
+			if err = tx.Where("message_id=?", id).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
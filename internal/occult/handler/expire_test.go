@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"X_IM/internal/occult/database"
+	"X_IM/pkg/wire/common"
+	"X_IM/pkg/wire/rpc"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSweepExpired(t *testing.T) {
+	h := newTestHandler(t)
+	first := sendUserMessage(t, h, "alice", "bob", &rpc.Message{Type: 1, Body: "1"})
+	burned := sendUserMessage(t, h, "alice", "bob", &rpc.Message{Type: 1, Body: "2", Ttl: int64(time.Hour)})
+	last := sendUserMessage(t, h, "alice", "bob", &rpc.Message{Type: 1, Body: "3"})
+	_, err := h.messageReact(&rpc.ReactMessageReq{Account: "bob", MessageID: burned.MessageID, Reaction: "👍", MaxKinds: 1, MaxPerUser: 1})
+	assert.Nil(t, err)
+	// 回应之后再让消息过期
+	assert.Nil(t, h.MessageDB.Model(&database.MessageContent{}).
+		Where("id=?", burned.MessageID).Update("expire_at", time.Now().UnixNano()).Error)
+
+	// 超过去重窗口的记录一起删除
+	for i, createTime := range []int64{time.Now().Add(-common.MessageDedupWindow * 2).UnixNano(), time.Now().UnixNano()} {
+		assert.Nil(t, h.MessageDB.Create(&database.MessageDedup{ID: int64(i + 1), App: "app1", Sender: "alice",
+			ClientMsgID: fmt.Sprintf("c%d", i), CreateTime: createTime}).Error)
+	}
+
+	before := time.Now().Add(time.Second).UnixNano()
+	resp, err := h.sweepExpired(&rpc.SweepExpiredReq{Before: before})
+	assert.Nil(t, err)
+	var dedups []database.MessageDedup
+	assert.Nil(t, h.MessageDB.Find(&dedups).Error)
+	assert.Len(t, dedups, 1)
+	assert.Equal(t, "c1", dedups[0].ClientMsgID)
+	assert.Len(t, resp.List, 1)
+	assert.Equal(t, burned.MessageID, resp.List[0].MessageID)
+	assert.ElementsMatch(t, []string{"alice", "bob"}, resp.List[0].Accounts)
+
+	// 已经清理的消息不会再次返回
+	resp, err = h.sweepExpired(&rpc.SweepExpiredReq{Before: before})
+	assert.Nil(t, err)
+	assert.Empty(t, resp.List)
+
+	// 索引保留为墓碑，seq连续
+	var indexes []database.MessageIndex
+	assert.Nil(t, h.MessageDB.Where("account_a=?", "bob").Order("seq asc").Find(&indexes).Error)
+	assert.Len(t, indexes, 3)
+	for i, index := range indexes {
+		assert.Equal(t, first.Seq+int64(i), index.Seq)
+		assert.Equal(t, index.MessageID == burned.MessageID, index.Expired)
+	}
+	assert.Equal(t, last.Seq, indexes[2].Seq)
+
+	var content database.MessageContent
+	assert.Nil(t, h.MessageDB.First(&content, burned.MessageID).Error)
+	assert.True(t, content.Swept)
+	assert.Empty(t, content.Body)
+	var reactions int64
+	assert.Nil(t, h.MessageDB.Model(&database.MessageReaction{}).Where("message_id=?", burned.MessageID).Count(&reactions).Error)
+	assert.Zero(t, reactions)
+
+	contents, err := h.messageContents(h.MessageDB.Where([]int64{burned.MessageID}))
+	assert.Nil(t, err)
+	assert.True(t, contents[0].Expired)
+}
@@ -4,11 +4,27 @@ import (
 	"X_IM/internal/occult/database"
 	"X_IM/pkg/wire/common"
 	"X_IM/pkg/wire/rpc"
+	"errors"
+	"fmt"
 	"github.com/go-redis/redis/v7"
 	"github.com/kataras/iris/v12"
 	"golang.org/x/sync/singleflight"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"sort"
+	"strconv"
 	"time"
+	"unicode/utf8"
+)
+
+var (
+	ErrNotSender     = errors.New("only the sender can change the message")
+	ErrWindowExpired = errors.New("message is out of the allowed window")
+	ErrNotEditable   = errors.New("only text messages that are not recalled or expired can be edited")
+	ErrInvalidRef    = errors.New("referenced message is not in the conversation")
+	ErrInvalidThread = errors.New("replied message is not in the thread")
+	ErrBodyTooLong   = fmt.Errorf("body must be at most %d characters", common.MessageMaxBodyLength)
+	ErrExtraTooLong  = fmt.Errorf("extra must be at most %d characters", common.MessageMaxExtraLength)
 )
 
 type ServiceHandler struct {
@@ -25,26 +41,23 @@ func (h *ServiceHandler) InsertUserMessage(c iris.Context) {
 		c.StopWithError(iris.StatusBadRequest, err)
 		return
 	}
-	id, err := h.insertUserMessage(&req)
-	if err != nil {
-		c.StopWithError(iris.StatusInternalServerError, err)
+	if err := h.checkReferences(&req, false); err != nil {
+		stopWithRefError(c, err)
 		return
 	}
-	_, _ = c.Negotiate(&rpc.InsertMessageResp{
-		MessageID: id,
+	resp, err := h.insertOnce(c.Params().Get("app"), &req, func(tx *gorm.DB) (*rpc.InsertMessageResp, error) {
+		return h.insertUserMessage(tx, &req)
 	})
+	if err != nil {
+		stopWithInsertError(c, err)
+		return
+	}
+	_, _ = c.Negotiate(resp)
 }
 
-func (h *ServiceHandler) insertUserMessage(req *rpc.InsertMessageReq) (int64, error) {
+func (h *ServiceHandler) insertUserMessage(db *gorm.DB, req *rpc.InsertMessageReq) (*rpc.InsertMessageResp, error) {
 	messageId := h.IDGen.Next().Int64()
-	messageContent := database.MessageContent{
-		ID: messageId,
-		//ShardID:   database.HashCode(req.Dest),
-		Type:     byte(req.Message.Type),
-		Body:     req.Message.Body,
-		Extra:    req.Message.Extra,
-		SendTime: req.SendTime,
-	}
+	messageContent := newMessageContent(messageId, req)
 	// 扩散写
 	idxs := make([]database.MessageIndex, 2)
 	idxs[0] = database.MessageIndex{
@@ -66,19 +79,106 @@ func (h *ServiceHandler) insertUserMessage(req *rpc.InsertMessageReq) (int64, er
 		SendTime:  req.SendTime,
 	}
 
-	err := h.MessageDB.Transaction(func(tx *gorm.DB) error {
-		if err := tx.Create(&messageContent).Error; err != nil {
+	// 会话列表：发送方的会话不增加未读数，发给自己时只有一个会话
+	sent := []database.Conversation{{
+		Account:       req.Sender,
+		Peer:          req.Dest,
+		LastMessageID: messageId,
+		LastSendTime:  req.SendTime,
+	}}
+	var received []database.Conversation
+	if req.Dest != req.Sender {
+		received = []database.Conversation{{
+			Account:       req.Dest,
+			Peer:          req.Sender,
+			LastMessageID: messageId,
+			LastSendTime:  req.SendTime,
+		}}
+	}
+
+	var seq int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if seq, err = nextSeq(tx, userSeqCounter(req.Sender, req.Dest)); err != nil {
 			return err
 		}
-		if err := tx.Create(&idxs).Error; err != nil {
+		if err = tx.Create(&messageContent).Error; err != nil {
 			return err
 		}
-		return nil
+		if err = tx.Create(setIndexSeq(idxs, seq)).Error; err != nil {
+			return err
+		}
+		if err = upsertConversations(tx, sent, seq, 0); err != nil {
+			return err
+		}
+		return upsertConversations(tx, received, seq, 1)
 	})
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	return &rpc.InsertMessageResp{MessageID: messageId, Seq: seq, SendTime: req.SendTime}, nil
+}
+
+// checkReferences 回复与话题引用的消息必须在同一个会话中：
+// 发送方有这条消息的索引，单聊时另一方是dest，群聊时在dest群中。
+// 话题的根消息不能是其他话题的回复，同时带上replyTo时回复的消息必须是根消息或者这个话题中的回复
+func (h *ServiceHandler) checkReferences(req *rpc.InsertMessageReq, group bool) error {
+	var ids []int64
+	for _, id := range []int64{req.Message.GetReplyTo(), req.Message.GetThreadRoot()} {
+		if id != 0 && (len(ids) == 0 || ids[0] != id) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	tx := h.MessageDB.Model(&database.MessageIndex{}).Where("account_a=? and message_id in ?", req.Sender, ids)
+	if group {
+		tx = tx.Where(map[string]interface{}{"group": req.Dest})
+	} else {
+		tx = tx.Where(map[string]interface{}{"account_b": req.Dest, "group": ""})
+	}
+	var count int64
+	if err := tx.Distinct("message_id").Count(&count).Error; err != nil {
+		return err
+	}
+	if int(count) != len(ids) {
+		return ErrInvalidRef
+	}
+	root := req.Message.GetThreadRoot()
+	if root == 0 {
+		return nil
+	}
+	var contents []database.MessageContent
+	err := h.MessageDB.Select("id", "thread_root").Where("id in ?", ids).Find(&contents).Error
+	if err != nil {
+		return err
 	}
-	return messageId, nil
+	for _, content := range contents {
+		if content.ID == root && content.ThreadRoot != 0 {
+			return ErrInvalidThread
+		}
+		if content.ID != root && content.ThreadRoot != root {
+			return ErrInvalidThread
+		}
+	}
+	return nil
+}
+
+func stopWithRefError(c iris.Context, err error) {
+	if errors.Is(err, ErrInvalidRef) || errors.Is(err, ErrInvalidThread) {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	c.StopWithError(iris.StatusInternalServerError, err)
+}
+
+func stopWithInsertError(c iris.Context, err error) {
+	if errors.Is(err, ErrDuplicateInFlight) {
+		c.StopWithError(iris.StatusConflict, err)
+		return
+	}
+	c.StopWithError(iris.StatusInternalServerError, err)
 }
 
 func (h *ServiceHandler) InsertGroupMessage(c iris.Context) {
@@ -87,27 +187,44 @@ func (h *ServiceHandler) InsertGroupMessage(c iris.Context) {
 		c.StopWithError(iris.StatusBadRequest, err)
 		return
 	}
-	messageId, err := h.insertGroupMessage(&req)
-	if err != nil {
-		c.StopWithError(iris.StatusInternalServerError, err)
+	if err := h.checkReferences(&req, true); err != nil {
+		stopWithRefError(c, err)
 		return
 	}
-	_, _ = c.Negotiate(&rpc.InsertMessageResp{
-		MessageID: messageId,
+	resp, err := h.insertOnce(c.Params().Get("app"), &req, func(tx *gorm.DB) (*rpc.InsertMessageResp, error) {
+		return h.insertGroupMessage(tx, &req)
 	})
+	if err != nil {
+		stopWithInsertError(c, err)
+		return
+	}
+	_, _ = c.Negotiate(resp)
 }
 
-func (h *ServiceHandler) insertGroupMessage(req *rpc.InsertMessageReq) (int64, error) {
+func (h *ServiceHandler) insertGroupMessage(db *gorm.DB, req *rpc.InsertMessageReq) (*rpc.InsertMessageResp, error) {
 	messageId := h.IDGen.Next().Int64()
 
 	var members []database.GroupMember
 	err := h.BaseDB.Where(&database.GroupMember{Group: req.Dest}).Find(&members).Error
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	// 扩散写
 	var idxs = make([]database.MessageIndex, len(members))
+	var sent, received []database.Conversation
 	for i, m := range members {
+		conversation := database.Conversation{
+			Account:       m.Account,
+			Peer:          req.Dest,
+			IsGroup:       true,
+			LastMessageID: messageId,
+			LastSendTime:  req.SendTime,
+		}
+		if m.Account == req.Sender {
+			sent = append(sent, conversation)
+		} else {
+			received = append(received, conversation)
+		}
 		idxs[i] = database.MessageIndex{
 			ID:        h.IDGen.Next().Int64(),
 			MessageID: messageId,
@@ -122,27 +239,49 @@ func (h *ServiceHandler) insertGroupMessage(req *rpc.InsertMessageReq) (int64, e
 		}
 	}
 
-	messageContent := database.MessageContent{
-		ID:       messageId,
-		Type:     byte(req.Message.Type),
-		Body:     req.Message.Body,
-		Extra:    req.Message.Extra,
-		SendTime: req.SendTime,
-	}
+	messageContent := newMessageContent(messageId, req)
 
-	err = h.MessageDB.Transaction(func(tx *gorm.DB) error {
-		if err := tx.Create(&messageContent).Error; err != nil {
+	var seq int64
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if seq, err = nextSeq(tx, database.ConversationSeq{Group: req.Dest}); err != nil {
 			return err
 		}
-		if err := tx.Create(&idxs).Error; err != nil {
+		if err = tx.Create(&messageContent).Error; err != nil {
 			return err
 		}
-		return nil
+		if err = tx.Create(setIndexSeq(idxs, seq)).Error; err != nil {
+			return err
+		}
+		if err = upsertConversations(tx, sent, seq, 0); err != nil {
+			return err
+		}
+		return upsertConversations(tx, received, seq, 1)
 	})
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	return &rpc.InsertMessageResp{MessageID: messageId, Seq: seq, SendTime: req.SendTime}, nil
+}
+
+func newMessageContent(id int64, req *rpc.InsertMessageReq) database.MessageContent {
+	content := database.MessageContent{
+		ID:       id,
+		Type:     byte(req.Message.Type),
+		Body:     req.Message.Body,
+		Extra:    req.Message.Extra,
+		SendTime: req.SendTime,
+		// 引用的消息已经通过checkReferences校验
+		ReplyTo:      req.Message.ReplyTo,
+		ThreadRoot:   req.Message.ThreadRoot,
+		TTL:          req.Message.Ttl,
+		TTLAfterRead: req.Message.TtlAfterRead,
+	}
+	// ttlAfterRead的消息在接收方读到时才开始计时
+	if content.TTL > 0 && !content.TTLAfterRead {
+		content.ExpireAt = req.SendTime + content.TTL
 	}
-	return messageId, nil
+	return content
 }
 
 func (h *ServiceHandler) MessageACK(c iris.Context) {
@@ -167,6 +306,357 @@ func setMessageAck(cache *redis.Client, account string, msgId int64) error {
 	return cache.Set(key, msgId, common.OfflineReadIndexExpiresIn).Err()
 }
 
+// MessageRewind 推送失败的消息需要在下次离线同步时返回，
+// 把同步的最早位置设置到这些消息之前
+func (h *ServiceHandler) MessageRewind(c iris.Context) {
+	var req rpc.RewindMessageReq
+	if err := c.ReadBody(&req); err != nil {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	if len(req.MessageIDs) == 0 {
+		return
+	}
+	var content database.MessageContent
+	err := h.MessageDB.Select("send_time").Where(req.MessageIDs).Order("send_time asc").First(&content).Error
+	if err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+	floor := content.SendTime - 1
+	key := database.KeyMessageSyncFloor(req.Account)
+	if old, err := h.Cache.Get(key).Int64(); err == nil && old < floor {
+		return
+	}
+	err = h.Cache.Set(key, floor, common.OfflineReadIndexExpiresIn).Err()
+	if err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+}
+
+// MessageRecall 发送方在时间窗口内撤回消息，内容只标记为已撤回，离线同步时返回墓碑
+func (h *ServiceHandler) MessageRecall(c iris.Context) {
+	var req rpc.RecallMessageReq
+	if err := c.ReadBody(&req); err != nil {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	resp, err := h.messageRecall(&req)
+	if errors.Is(err, ErrNotSender) {
+		c.StopWithError(iris.StatusForbidden, err)
+		return
+	}
+	if errors.Is(err, ErrWindowExpired) {
+		c.StopWithError(iris.StatusUnprocessableEntity, err)
+		return
+	}
+	if err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+	_, _ = c.Negotiate(resp)
+}
+
+func (h *ServiceHandler) messageRecall(req *rpc.RecallMessageReq) (*rpc.RecallMessageResp, error) {
+	index, err := h.senderIndex(req.Account, req.MessageID, req.Window)
+	if err != nil {
+		return nil, err
+	}
+	// 重复撤回时不再减少未读数
+	err = h.MessageDB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&database.MessageContent{}).
+			Where("id=? and recalled=?", req.MessageID, false).Update("recalled", true)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		return h.dropUnread(tx, req.MessageID, "recalled")
+	})
+	if err != nil {
+		return nil, err
+	}
+	if index.Group != "" {
+		return &rpc.RecallMessageResp{Group: index.Group}, nil
+	}
+	return &rpc.RecallMessageResp{Dest: index.AccountB}, nil
+}
+
+// senderIndex 返回发送方的消息索引，校验请求方是发送方并且消息仍在时间窗口内
+func (h *ServiceHandler) senderIndex(account string, msgID int64, window int64) (*database.MessageIndex, error) {
+	// 发送方的消息索引direction为1
+	var index database.MessageIndex
+	err := h.MessageDB.Select("account_b", "group", "send_time").
+		Where("message_id=? and account_a=? and direction=?", msgID, account, 1).First(&index).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotSender
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().UnixNano()-index.SendTime > window {
+		return nil, ErrWindowExpired
+	}
+	return &index, nil
+}
+
+// MessageEdit 发送方在时间窗口内编辑文本消息，旧的内容保存到MessageVersion
+func (h *ServiceHandler) MessageEdit(c iris.Context) {
+	var req rpc.EditMessageReq
+	if err := c.ReadBody(&req); err != nil {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	resp, err := h.messageEdit(&req)
+	if errors.Is(err, ErrNotSender) {
+		c.StopWithError(iris.StatusForbidden, err)
+		return
+	}
+	if errors.Is(err, ErrWindowExpired) {
+		c.StopWithError(iris.StatusUnprocessableEntity, err)
+		return
+	}
+	if errors.Is(err, ErrNotEditable) || errors.Is(err, ErrBodyTooLong) || errors.Is(err, ErrExtraTooLong) {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+	_, _ = c.Negotiate(resp)
+}
+
+func (h *ServiceHandler) messageEdit(req *rpc.EditMessageReq) (*rpc.EditMessageResp, error) {
+	if utf8.RuneCountInString(req.Body) > common.MessageMaxBodyLength {
+		return nil, ErrBodyTooLong
+	}
+	if utf8.RuneCountInString(req.Extra) > common.MessageMaxExtraLength {
+		return nil, ErrExtraTooLong
+	}
+	index, err := h.senderIndex(req.Account, req.MessageID, req.Window)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		version int32
+		extra   = req.Extra
+	)
+	err = h.MessageDB.Transaction(func(tx *gorm.DB) error {
+		// 锁住内容，并发的编辑按顺序生成版本
+		var content database.MessageContent
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&content, req.MessageID).Error
+		if err != nil {
+			return err
+		}
+		if content.Recalled || content.Expired(time.Now().UnixNano()) || content.Type != common.MessageTypeText {
+			return ErrNotEditable
+		}
+		err = tx.Create(&database.MessageVersion{
+			ID:        h.IDGen.Next().Int64(),
+			MessageID: content.ID,
+			Version:   content.Version,
+			Body:      content.Body,
+			Extra:     content.Extra,
+			EditTime:  time.Now().UnixNano(),
+		}).Error
+		if err != nil {
+			return err
+		}
+		version = content.Version + 1
+		// 没有携带extra时保留原来的
+		if extra == "" {
+			extra = content.Extra
+		}
+		return tx.Model(&content).Updates(map[string]interface{}{
+			"body":    req.Body,
+			"extra":   extra,
+			"version": version,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	var resp = rpc.EditMessageResp{Group: index.Group, Version: version, Extra: extra}
+	if index.Group == "" {
+		resp.Dest = index.AccountB
+	}
+	return &resp, nil
+}
+
+// MessageVersions 返回消息被编辑前的各个版本，用于审核，只有会话的参与者可以查询
+func (h *ServiceHandler) MessageVersions(c iris.Context) {
+	msgID, err := c.Params().GetInt64("id")
+	if err != nil {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	account := c.URLParam("account")
+	if account == "" {
+		c.StopWithText(iris.StatusBadRequest, "account is required")
+		return
+	}
+	resp, err := h.messageVersions(account, msgID)
+	if errors.Is(err, ErrNotParticipant) {
+		c.StopWithError(iris.StatusForbidden, err)
+		return
+	}
+	if err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+	_, _ = c.Negotiate(resp)
+}
+
+func (h *ServiceHandler) messageVersions(account string, msgID int64) (*rpc.MessageVersionsResp, error) {
+	var count int64
+	err := h.MessageDB.Model(&database.MessageIndex{}).
+		Where("message_id=? and account_a=?", msgID, account).Count(&count).Error
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, ErrNotParticipant
+	}
+	var versions []*rpc.MessageVersion
+	err = h.MessageDB.Model(&database.MessageVersion{}).
+		Where("message_id=?", msgID).Order("version asc").Find(&versions).Error
+	if err != nil {
+		return nil, err
+	}
+	return &rpc.MessageVersionsResp{List: versions}, nil
+}
+
+// MessageRead 记录账号在会话中的读位置，返回消息的发送者用于推送已读回执
+func (h *ServiceHandler) MessageRead(c iris.Context) {
+	var req rpc.ReadMessageReq
+	if err := c.ReadBody(&req); err != nil {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	if req.MessageID <= 0 {
+		c.StopWithText(iris.StatusBadRequest, "invalid messageID")
+		return
+	}
+	resp, err := h.messageRead(&req)
+	if errors.Is(err, ErrNotParticipant) {
+		c.StopWithError(iris.StatusForbidden, err)
+		return
+	}
+	if err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+	_, _ = c.Negotiate(resp)
+}
+
+func (h *ServiceHandler) messageRead(req *rpc.ReadMessageReq) (*rpc.ReadMessageResp, error) {
+	// 读者在这个会话中必须有这条消息的索引，不能用伪造的messageID推进读位置
+	var index database.MessageIndex
+	tx := h.MessageDB.Select("account_b", "direction").Where("message_id=? and account_a=?", req.MessageID, req.Account)
+	if req.Group != "" {
+		tx = tx.Where(map[string]interface{}{"group": req.Group})
+	} else {
+		tx = tx.Where(map[string]interface{}{"account_b": req.Dest, "group": ""})
+	}
+	err := tx.First(&index).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotParticipant
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, field := database.KeyMessageRead(req.Account), req.Dest
+	if req.Group != "" {
+		key, field = database.KeyGroupMessageRead(req.Group), req.Account
+	}
+	advanced, err := database.AdvanceReadIndex(h.Cache, key, field, req.MessageID, common.OfflineReadIndexExpiresIn)
+	if err != nil {
+		return nil, err
+	}
+	var resp = rpc.ReadMessageResp{Advanced: advanced}
+	if !advanced {
+		return &resp, nil
+	}
+	if err = h.startReadTTL(req); err != nil {
+		return nil, err
+	}
+	if err = h.resetUnread(req); err != nil {
+		return nil, err
+	}
+	// 接收方索引的account_b是发送方，direction为1时是读者自己发的消息
+	resp.Sender = req.Account
+	if index.Direction == 0 {
+		resp.Sender = index.AccountB
+	}
+	return &resp, nil
+}
+
+// startReadTTL 读者收到的ttlAfterRead消息从读到时开始计时，群聊中第一个读到的成员开始计时
+func (h *ServiceHandler) startReadTTL(req *rpc.ReadMessageReq) error {
+	received := h.MessageDB.Model(&database.MessageIndex{}).Select("message_id").
+		Where("account_a=? and direction=? and message_id<=?", req.Account, 0, req.MessageID)
+	if req.Group != "" {
+		received = received.Where(map[string]interface{}{"group": req.Group})
+	} else {
+		received = received.Where(map[string]interface{}{"account_b": req.Dest, "group": ""})
+	}
+	return h.MessageDB.Model(&database.MessageContent{}).
+		Where("id in (?) and ttl_after_read=? and ttl>0 and expire_at=0", received, true).
+		Update("expire_at", gorm.Expr("? + ttl", time.Now().UnixNano())).Error
+}
+
+// MessageReadState 单聊返回对方的读位置，群聊返回读到messageID的成员
+func (h *ServiceHandler) MessageReadState(c iris.Context) {
+	var req rpc.ReadStateReq
+	if err := c.ReadBody(&req); err != nil {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	resp, err := h.messageReadState(&req)
+	if errors.Is(err, ErrNotParticipant) {
+		c.StopWithError(iris.StatusForbidden, err)
+		return
+	}
+	if err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+	_, _ = c.Negotiate(resp)
+}
+
+// messageReadState 单聊只能查对方在与自己的会话中的读位置，群聊只有群成员可以查
+func (h *ServiceHandler) messageReadState(req *rpc.ReadStateReq) (*rpc.ReadStateResp, error) {
+	var resp rpc.ReadStateResp
+	if req.Group == "" {
+		msgID, err := h.Cache.HGet(database.KeyMessageRead(req.Dest), req.Account).Int64()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		resp.MessageID = msgID
+		return &resp, nil
+	}
+	var count int64
+	err := h.BaseDB.Model(&database.GroupMember{}).
+		Where(&database.GroupMember{Group: req.Group, Account: req.Account}).Count(&count).Error
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, ErrNotParticipant
+	}
+	all, err := h.Cache.HGetAll(database.KeyGroupMessageRead(req.Group)).Result()
+	if err != nil {
+		return nil, err
+	}
+	for account, val := range all {
+		if msgID, _ := strconv.ParseInt(val, 10, 64); msgID >= req.MessageID {
+			resp.Readers = append(resp.Readers, account)
+		}
+	}
+	sort.Strings(resp.Readers)
+	return &resp, nil
+}
+
 // GetOfflineMessageIndex
 // 获取读索引的全局时钟
 // 根据这个全局时钟，从DB中把消息索引读取出来
@@ -186,10 +676,13 @@ func (h *ServiceHandler) GetOfflineMessageIndex(c iris.Context) {
 
 	var indexes []*rpc.MessageIndex
 	tx := h.MessageDB.Model(&database.MessageIndex{}).
-		Select("send_time", "account_b", "direction", "message_id", "group")
+		Select("send_time", "account_b", "direction", "message_id", "group", "seq", "expired")
 
-	err = tx.Where("account_a=? and send_time>? and direction=?", req.Account, start, 0).
-		Order("send_time asc").Limit(common.OfflineSyncIndexCount).Find(&indexes).Error
+	tx = tx.Where("account_a=? and send_time>?", req.Account, start)
+	if !req.WithSent {
+		tx = tx.Where("direction=?", 0)
+	}
+	err = tx.Order("send_time asc").Limit(common.OfflineSyncIndexCount).Find(&indexes).Error
 	if err != nil {
 		c.StopWithError(iris.StatusInternalServerError, err)
 		return
@@ -199,6 +692,7 @@ func (h *ServiceHandler) GetOfflineMessageIndex(c iris.Context) {
 		c.StopWithError(iris.StatusInternalServerError, err)
 		return
 	}
+	_ = h.Cache.Del(database.KeyMessageSyncFloor(req.Account)).Err()
 	_, _ = c.Negotiate(&rpc.GetOfflineMessageIndexResp{
 		List: indexes,
 	})
@@ -223,6 +717,11 @@ func (h *ServiceHandler) getSentTime(account string, msgID int64) (int64, error)
 			start = content.SendTime
 		}
 	}
+	// 推送失败的消息需要包含在本次同步中
+	floor, err := h.Cache.Get(database.KeyMessageSyncFloor(account)).Int64()
+	if err == nil && (start == 0 || floor < start) {
+		start = floor
+	}
 	// 4.返回默认的离线消息过期时间
 	earliestKeepTime := time.Now().
 		AddDate(0, 0, -1*common.OfflineMessageExpiresIn).UnixNano()
@@ -244,8 +743,7 @@ func (h *ServiceHandler) GetOfflineMessageContent(c iris.Context) {
 		c.StopWithText(iris.StatusBadRequest, "too many MessageIDs")
 		return
 	}
-	var contents []*rpc.Message
-	err := h.MessageDB.Model(&database.MessageContent{}).Where(req.MessageIDs).Find(&contents).Error
+	contents, err := h.messageContents(h.MessageDB.Where(req.MessageIDs))
 	if err != nil {
 		c.StopWithError(iris.StatusInternalServerError, err)
 		return
@@ -254,3 +752,127 @@ func (h *ServiceHandler) GetOfflineMessageContent(c iris.Context) {
 		List: contents,
 	})
 }
+
+// messageContents 读取消息内容并带上聚合后的回应数，已撤回或过期的消息只返回墓碑
+func (h *ServiceHandler) messageContents(query *gorm.DB) ([]*rpc.Message, error) {
+	var rows []database.MessageContent
+	if err := query.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	var ids = make([]int64, len(rows))
+	for i, row := range rows {
+		ids[i] = row.ID
+	}
+	reactions, err := h.reactionCounts(ids...)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UnixNano()
+	var contents = make([]*rpc.Message, len(rows))
+	for i, row := range rows {
+		contents[i] = &rpc.Message{
+			ID:           row.ID,
+			Type:         int32(row.Type),
+			Body:         row.Body,
+			Extra:        row.Extra,
+			Recalled:     row.Recalled,
+			Version:      row.Version,
+			ReplyTo:      row.ReplyTo,
+			ThreadRoot:   row.ThreadRoot,
+			Reactions:    reactions[row.ID],
+			Ttl:          row.TTL,
+			TtlAfterRead: row.TTLAfterRead,
+			ExpireAt:     row.ExpireAt,
+			Expired:      row.Expired(now),
+		}
+		// 过期的消息在清理之前同样只返回墓碑
+		if row.Recalled || contents[i].Expired {
+			contents[i].Body = ""
+			contents[i].Extra = ""
+			contents[i].Reactions = nil
+		}
+	}
+	return contents, nil
+}
+
+// ThreadReplies 按消息ID分页读取话题的回复，只有会话的参与者可以读取
+func (h *ServiceHandler) ThreadReplies(c iris.Context) {
+	var req rpc.ThreadRepliesReq
+	if err := c.ReadBody(&req); err != nil {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	limit := int(req.Limit)
+	if limit <= 0 || limit > common.MessageMaxCountPerPage {
+		limit = common.MessageMaxCountPerPage
+	}
+	// 会话的参与者都有根消息的索引
+	var count int64
+	err := h.MessageDB.Model(&database.MessageIndex{}).
+		Where("account_a=? and message_id=?", req.Account, req.Root).Count(&count).Error
+	if err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+	if count == 0 {
+		c.StopWithError(iris.StatusForbidden, ErrInvalidRef)
+		return
+	}
+	contents, err := h.messageContents(h.MessageDB.
+		Where("thread_root=? and id>?", req.Root, req.After).
+		Order("id asc").Limit(limit + 1))
+	if err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+	more := len(contents) > limit
+	if more {
+		contents = contents[:limit]
+	}
+	_, _ = c.Negotiate(&rpc.ThreadRepliesResp{
+		List: contents,
+		More: more,
+	})
+}
+
+// ThreadCounts 返回根消息的回复数，没有回复或者account不在会话中的根消息不返回
+func (h *ServiceHandler) ThreadCounts(c iris.Context) {
+	var req rpc.ThreadCountsReq
+	if err := c.ReadBody(&req); err != nil {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	if len(req.Roots) > common.MessageMaxCountPerPage {
+		c.StopWithText(iris.StatusBadRequest, "too many roots")
+		return
+	}
+	resp, err := h.threadCounts(&req)
+	if err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+	_, _ = c.Negotiate(resp)
+}
+
+func (h *ServiceHandler) threadCounts(req *rpc.ThreadCountsReq) (*rpc.ThreadCountsResp, error) {
+	var rows []struct {
+		ThreadRoot int64
+		Count      int32
+	}
+	if len(req.Roots) > 0 {
+		// 会话的参与者都有根消息的索引
+		roots := h.MessageDB.Model(&database.MessageIndex{}).Select("message_id").
+			Where("account_a=? and message_id in ?", req.Account, req.Roots)
+		err := h.MessageDB.Model(&database.MessageContent{}).
+			Select("thread_root, count(*) as count").
+			Where("thread_root in (?)", roots).Group("thread_root").Find(&rows).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	var resp = rpc.ThreadCountsResp{Counts: make(map[int64]int32, len(rows))}
+	for _, row := range rows {
+		resp.Counts[row.ThreadRoot] = row.Count
+	}
+	return &resp, nil
+}
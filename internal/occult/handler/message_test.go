@@ -2,8 +2,10 @@ package handler
 
 import (
 	"X_IM/internal/occult/database"
+	"X_IM/pkg/wire/common"
 	"X_IM/pkg/wire/rpc"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -31,7 +33,7 @@ func BenchmarkInsUsrMsg(b *testing.B) {
 	b.ReportAllocs()
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			_, _ = handler.insertUserMessage(&rpc.InsertMessageReq{
+			_, _ = handler.insertUserMessage(handler.MessageDB, &rpc.InsertMessageReq{
 				Sender:   "test1",
 				Dest:     ksuid.New().String(),
 				SendTime: time.Now().UnixNano(),
@@ -65,7 +67,7 @@ func BenchmarkInsGrp10Msg(b *testing.B) {
 	b.ReportAllocs()
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			_, _ = handler.insertGroupMessage(&rpc.InsertMessageReq{
+			_, _ = handler.insertGroupMessage(handler.MessageDB, &rpc.InsertMessageReq{
 				Sender:   "test1",
 				Dest:     groupId.Base36(),
 				SendTime: time.Now().UnixNano(),
@@ -99,7 +101,7 @@ func BenchmarkInsGrp50Msg(b *testing.B) {
 	b.ReportAllocs()
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			_, _ = handler.insertGroupMessage(&rpc.InsertMessageReq{
+			_, _ = handler.insertGroupMessage(handler.MessageDB, &rpc.InsertMessageReq{
 				Sender:   "test1",
 				Dest:     groupId.Base36(),
 				SendTime: time.Now().UnixNano(),
@@ -111,3 +113,141 @@ func BenchmarkInsGrp50Msg(b *testing.B) {
 		}
 	})
 }
+
+func TestMessageReadParticipant(t *testing.T) {
+	h := newTestHandler(t)
+	sent := sendUserMessage(t, h, "alice", "bob", &rpc.Message{Type: 1, Body: "hello"})
+	other := sendUserMessage(t, h, "alice", "carol", &rpc.Message{Type: 1, Body: "hello"})
+
+	// 伪造的messageID与其他会话的消息不能推进读位置
+	for _, id := range []int64{sent.MessageID + 1<<40, other.MessageID} {
+		_, err := h.messageRead(&rpc.ReadMessageReq{Account: "bob", Dest: "alice", MessageID: id})
+		assert.ErrorIs(t, err, ErrNotParticipant)
+	}
+	_, err := h.messageRead(&rpc.ReadMessageReq{Account: "mallory", Dest: "alice", MessageID: sent.MessageID})
+	assert.ErrorIs(t, err, ErrNotParticipant)
+
+	resp, err := h.messageRead(&rpc.ReadMessageReq{Account: "bob", Dest: "alice", MessageID: sent.MessageID})
+	assert.Nil(t, err)
+	assert.True(t, resp.Advanced)
+	assert.Equal(t, "alice", resp.Sender)
+
+	state, err := h.messageReadState(&rpc.ReadStateReq{Account: "alice", Dest: "bob"})
+	assert.Nil(t, err)
+	assert.Equal(t, sent.MessageID, state.MessageID)
+}
+
+func TestGroupReadParticipant(t *testing.T) {
+	h := newTestHandler(t)
+	group := createGroup(t, h, "alice", "bob")
+	sent := sendGroupMessage(t, h, "alice", group, &rpc.Message{Type: 1, Body: "hello"})
+
+	_, err := h.messageRead(&rpc.ReadMessageReq{Account: "mallory", Group: group, MessageID: sent.MessageID})
+	assert.ErrorIs(t, err, ErrNotParticipant)
+	_, err = h.messageRead(&rpc.ReadMessageReq{Account: "bob", Group: group, MessageID: sent.MessageID + 1<<40})
+	assert.ErrorIs(t, err, ErrNotParticipant)
+
+	resp, err := h.messageRead(&rpc.ReadMessageReq{Account: "bob", Group: group, MessageID: sent.MessageID})
+	assert.Nil(t, err)
+	assert.True(t, resp.Advanced)
+	assert.Equal(t, "alice", resp.Sender)
+
+	_, err = h.messageReadState(&rpc.ReadStateReq{Account: "mallory", Group: group, MessageID: sent.MessageID})
+	assert.ErrorIs(t, err, ErrNotParticipant)
+	state, err := h.messageReadState(&rpc.ReadStateReq{Account: "alice", Group: group, MessageID: sent.MessageID})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"bob"}, state.Readers)
+}
+
+func TestMessageRecallWindow(t *testing.T) {
+	h := newTestHandler(t)
+	sent := sendUserMessage(t, h, "alice", "bob", &rpc.Message{Type: 1, Body: "hello"})
+
+	_, err := h.messageRecall(&rpc.RecallMessageReq{Account: "bob", MessageID: sent.MessageID, Window: int64(time.Minute)})
+	assert.ErrorIs(t, err, ErrNotSender)
+	_, err = h.messageRecall(&rpc.RecallMessageReq{Account: "alice", MessageID: sent.MessageID, Window: 1})
+	assert.ErrorIs(t, err, ErrWindowExpired)
+
+	resp, err := h.messageRecall(&rpc.RecallMessageReq{Account: "alice", MessageID: sent.MessageID, Window: int64(time.Minute)})
+	assert.Nil(t, err)
+	assert.Equal(t, "bob", resp.Dest)
+
+	contents, err := h.messageContents(h.MessageDB.Where([]int64{sent.MessageID}))
+	assert.Nil(t, err)
+	assert.Len(t, contents, 1)
+	assert.True(t, contents[0].Recalled)
+	assert.Empty(t, contents[0].Body)
+}
+
+func TestMessageEditVersions(t *testing.T) {
+	h := newTestHandler(t)
+	sent := sendUserMessage(t, h, "alice", "bob", &rpc.Message{Type: 1, Body: "v0", Extra: "e0"})
+
+	_, err := h.messageEdit(&rpc.EditMessageReq{Account: "bob", MessageID: sent.MessageID, Body: "v1", Window: int64(time.Minute)})
+	assert.ErrorIs(t, err, ErrNotSender)
+	_, err = h.messageEdit(&rpc.EditMessageReq{Account: "alice", MessageID: sent.MessageID, Body: "v1", Window: 1})
+	assert.ErrorIs(t, err, ErrWindowExpired)
+	_, err = h.messageEdit(&rpc.EditMessageReq{Account: "alice", MessageID: sent.MessageID,
+		Body: strings.Repeat("长", common.MessageMaxBodyLength+1), Window: int64(time.Minute)})
+	assert.ErrorIs(t, err, ErrBodyTooLong)
+	_, err = h.messageEdit(&rpc.EditMessageReq{Account: "alice", MessageID: sent.MessageID, Body: "v1",
+		Extra: strings.Repeat("长", common.MessageMaxExtraLength+1), Window: int64(time.Minute)})
+	assert.ErrorIs(t, err, ErrExtraTooLong)
+
+	for i, body := range []string{"v1", strings.Repeat("长", common.MessageMaxBodyLength)} {
+		resp, err := h.messageEdit(&rpc.EditMessageReq{Account: "alice", MessageID: sent.MessageID, Body: body, Window: int64(time.Minute)})
+		assert.Nil(t, err)
+		assert.Equal(t, "bob", resp.Dest)
+		assert.Equal(t, int32(i+1), resp.Version)
+		// 没有携带extra时保留原来的
+		assert.Equal(t, "e0", resp.Extra)
+	}
+	resp, err := h.messageEdit(&rpc.EditMessageReq{Account: "alice", MessageID: sent.MessageID, Body: "v3", Extra: "e1", Window: int64(time.Minute)})
+	assert.Nil(t, err)
+	assert.Equal(t, "e1", resp.Extra)
+
+	_, err = h.messageVersions("mallory", sent.MessageID)
+	assert.ErrorIs(t, err, ErrNotParticipant)
+	versions, err := h.messageVersions("bob", sent.MessageID)
+	assert.Nil(t, err)
+	assert.Len(t, versions.List, 3)
+	assert.Equal(t, "v0", versions.List[0].Body)
+	assert.Equal(t, "v1", versions.List[1].Body)
+}
+
+func TestThreadReferences(t *testing.T) {
+	h := newTestHandler(t)
+	root := sendUserMessage(t, h, "alice", "bob", &rpc.Message{Type: 1, Body: "root"})
+	other := sendUserMessage(t, h, "alice", "bob", &rpc.Message{Type: 1, Body: "other"})
+	reply := sendUserMessage(t, h, "bob", "alice", &rpc.Message{Type: 1, Body: "reply", ThreadRoot: root.MessageID})
+	outside := sendUserMessage(t, h, "alice", "carol", &rpc.Message{Type: 1, Body: "outside"})
+
+	check := func(sender, dest string, replyTo, threadRoot int64) error {
+		return h.checkReferences(&rpc.InsertMessageReq{
+			Sender:  sender,
+			Dest:    dest,
+			Message: &rpc.Message{Type: 1, Body: "hi", ReplyTo: replyTo, ThreadRoot: threadRoot},
+		}, false)
+	}
+	assert.Nil(t, check("alice", "bob", reply.MessageID, root.MessageID))
+	assert.Nil(t, check("alice", "bob", root.MessageID, root.MessageID))
+	assert.ErrorIs(t, check("alice", "bob", outside.MessageID, 0), ErrInvalidRef)
+	assert.ErrorIs(t, check("alice", "bob", other.MessageID, root.MessageID), ErrInvalidThread)
+	assert.ErrorIs(t, check("alice", "bob", 0, reply.MessageID), ErrInvalidThread)
+}
+
+func TestThreadCountsParticipant(t *testing.T) {
+	h := newTestHandler(t)
+	root := sendUserMessage(t, h, "alice", "bob", &rpc.Message{Type: 1, Body: "root"})
+	for i := 0; i < 2; i++ {
+		sendUserMessage(t, h, "bob", "alice", &rpc.Message{Type: 1, Body: "reply", ThreadRoot: root.MessageID})
+	}
+
+	resp, err := h.threadCounts(&rpc.ThreadCountsReq{Account: "bob", Roots: []int64{root.MessageID}})
+	assert.Nil(t, err)
+	assert.Equal(t, map[int64]int32{root.MessageID: 2}, resp.Counts)
+
+	resp, err = h.threadCounts(&rpc.ThreadCountsReq{Account: "mallory", Roots: []int64{root.MessageID}})
+	assert.Nil(t, err)
+	assert.Empty(t, resp.Counts)
+}
@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"X_IM/internal/occult/database"
+	"X_IM/pkg/wire/rpc"
+	"errors"
+	"time"
+
+	"github.com/kataras/iris/v12"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrNotParticipant   = errors.New("account is not in the conversation")
+	ErrMessageGone      = errors.New("message has been recalled or expired")
+	ErrTooManyReactions = errors.New("too many reactions on the message")
+)
+
+// MessageReact 会话的参与者添加或删除表情回应，返回变化后消息上的回应数
+func (h *ServiceHandler) MessageReact(c iris.Context) {
+	var req rpc.ReactMessageReq
+	if err := c.ReadBody(&req); err != nil {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	resp, err := h.messageReact(&req)
+	if errors.Is(err, ErrNotParticipant) {
+		c.StopWithError(iris.StatusForbidden, err)
+		return
+	}
+	if errors.Is(err, ErrMessageGone) {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	if errors.Is(err, ErrTooManyReactions) {
+		c.StopWithError(iris.StatusTooManyRequests, err)
+		return
+	}
+	if err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+	_, _ = c.Negotiate(resp)
+}
+
+func (h *ServiceHandler) messageReact(req *rpc.ReactMessageReq) (*rpc.ReactMessageResp, error) {
+	// 会话的参与者都有消息的索引
+	var index database.MessageIndex
+	err := h.MessageDB.Select("account_b", "group").
+		Where("message_id=? and account_a=?", req.MessageID, req.Account).First(&index).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotParticipant
+	}
+	if err != nil {
+		return nil, err
+	}
+	var changed bool
+	err = h.MessageDB.Transaction(func(tx *gorm.DB) error {
+		// 锁住内容，并发的回应按顺序检查数量限制
+		var content database.MessageContent
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "recalled", "expire_at").First(&content, req.MessageID).Error
+		if err != nil {
+			return err
+		}
+		if content.Recalled || content.Expired(time.Now().UnixNano()) {
+			return ErrMessageGone
+		}
+		if req.Remove {
+			result := tx.Where("message_id=? and account=? and reaction=?", req.MessageID, req.Account, req.Reaction).
+				Delete(&database.MessageReaction{})
+			changed = result.RowsAffected > 0
+			return result.Error
+		}
+		var reactions []database.MessageReaction
+		err = tx.Select("account", "reaction").Where("message_id=?", req.MessageID).Find(&reactions).Error
+		if err != nil {
+			return err
+		}
+		var mine int
+		var kinds = make(map[string]struct{})
+		for _, reaction := range reactions {
+			if reaction.Account == req.Account {
+				if reaction.Reaction == req.Reaction {
+					return nil
+				}
+				mine++
+			}
+			kinds[reaction.Reaction] = struct{}{}
+		}
+		if mine >= int(req.MaxPerUser) {
+			return ErrTooManyReactions
+		}
+		if _, ok := kinds[req.Reaction]; !ok && len(kinds) >= int(req.MaxKinds) {
+			return ErrTooManyReactions
+		}
+		changed = true
+		return tx.Create(&database.MessageReaction{
+			ID:         h.IDGen.Next().Int64(),
+			MessageID:  req.MessageID,
+			Account:    req.Account,
+			Reaction:   req.Reaction,
+			CreateTime: time.Now().UnixNano(),
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	counts, err := h.reactionCounts(req.MessageID)
+	if err != nil {
+		return nil, err
+	}
+	var resp = rpc.ReactMessageResp{Group: index.Group, Changed: changed, Reactions: counts[req.MessageID]}
+	if index.Group == "" {
+		resp.Dest = index.AccountB
+	}
+	return &resp, nil
+}
+
+// reactionCounts 按表情聚合消息上的回应数，同一消息的表情按第一次回应的先后排列
+func (h *ServiceHandler) reactionCounts(ids ...int64) (map[int64][]*rpc.Reaction, error) {
+	var result = make(map[int64][]*rpc.Reaction)
+	if len(ids) == 0 {
+		return result, nil
+	}
+	var rows []struct {
+		MessageID int64
+		Reaction  string
+		Count     int32
+	}
+	err := h.MessageDB.Model(&database.MessageReaction{}).
+		Select("message_id, reaction, count(*) as count").
+		Where("message_id in ?", ids).Group("message_id, reaction").Order("min(id) asc").Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		result[row.MessageID] = append(result[row.MessageID], &rpc.Reaction{
+			Reaction: row.Reaction,
+			Count:    row.Count,
+		})
+	}
+	return result, nil
+}
@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"X_IM/pkg/wire/rpc"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageReact(t *testing.T) {
+	h := newTestHandler(t)
+	sent := sendUserMessage(t, h, "alice", "bob", &rpc.Message{Type: 1, Body: "hello"})
+
+	react := func(account, reaction string, remove bool) (*rpc.ReactMessageResp, error) {
+		return h.messageReact(&rpc.ReactMessageReq{
+			Account:    account,
+			MessageID:  sent.MessageID,
+			Reaction:   reaction,
+			Remove:     remove,
+			MaxKinds:   3,
+			MaxPerUser: 2,
+		})
+	}
+
+	_, err := react("mallory", "👍", false)
+	assert.ErrorIs(t, err, ErrNotParticipant)
+
+	resp, err := react("bob", "👍", false)
+	assert.Nil(t, err)
+	assert.True(t, resp.Changed)
+	assert.Equal(t, "alice", resp.Dest)
+	// 重复的回应不改变计数
+	resp, err = react("bob", "👍", false)
+	assert.Nil(t, err)
+	assert.False(t, resp.Changed)
+
+	_, err = react("alice", "👍", false)
+	assert.Nil(t, err)
+	resp, err = react("alice", "❤", false)
+	assert.Nil(t, err)
+	assert.Equal(t, []*rpc.Reaction{{Reaction: "👍", Count: 2}, {Reaction: "❤", Count: 1}}, resp.Reactions)
+
+	// 每个账号最多2个回应，消息上最多3种表情
+	_, err = react("alice", "😂", false)
+	assert.ErrorIs(t, err, ErrTooManyReactions)
+	_, err = react("bob", "😂", false)
+	assert.Nil(t, err)
+	_, err = react("bob", "🎉", false)
+	assert.ErrorIs(t, err, ErrTooManyReactions)
+
+	resp, err = react("bob", "👍", true)
+	assert.Nil(t, err)
+	assert.True(t, resp.Changed)
+	resp, err = react("bob", "👍", true)
+	assert.Nil(t, err)
+	assert.False(t, resp.Changed)
+
+	contents, err := h.messageContents(h.MessageDB.Where([]int64{sent.MessageID}))
+	assert.Nil(t, err)
+	assert.Equal(t, []*rpc.Reaction{{Reaction: "👍", Count: 1}, {Reaction: "❤", Count: 1}, {Reaction: "😂", Count: 1}}, contents[0].Reactions)
+
+	_, err = h.messageRecall(&rpc.RecallMessageReq{Account: "alice", MessageID: sent.MessageID, Window: int64(time.Minute)})
+	assert.Nil(t, err)
+	_, err = react("bob", "👍", false)
+	assert.ErrorIs(t, err, ErrMessageGone)
+}
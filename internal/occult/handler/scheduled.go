@@ -0,0 +1,297 @@
+package handler
+
+import (
+	"X_IM/internal/occult/database"
+	"X_IM/pkg/wire/common"
+	"X_IM/pkg/wire/rpc"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/kataras/iris/v12"
+	"gorm.io/gorm"
+)
+
+var ErrScheduledDone = errors.New("scheduled message is already delivered or canceled")
+
+// ScheduleMessage 保存定时发送的消息，引用的消息在保存时校验
+func (h *ServiceHandler) ScheduleMessage(c iris.Context) {
+	var req rpc.ScheduledMessage
+	if err := c.ReadBody(&req); err != nil || req.Message == nil {
+		c.StopWithText(iris.StatusBadRequest, "invalid scheduled message")
+		return
+	}
+	err := h.checkReferences(&rpc.InsertMessageReq{
+		Sender:  req.Sender,
+		Dest:    req.Dest,
+		Message: req.Message,
+	}, req.Group)
+	if err != nil {
+		stopWithRefError(c, err)
+		return
+	}
+	scheduled := database.ScheduledMessage{
+		ID:           h.IDGen.Next().Int64(),
+		App:          c.Params().Get("app"),
+		Sender:       req.Sender,
+		Dest:         req.Dest,
+		IsGroup:      req.Group,
+		Type:         byte(req.Message.Type),
+		Body:         req.Message.Body,
+		Extra:        req.Message.Extra,
+		ReplyTo:      req.Message.ReplyTo,
+		ThreadRoot:   req.Message.ThreadRoot,
+		TTL:          req.Message.Ttl,
+		TTLAfterRead: req.Message.TtlAfterRead,
+		Mentions:     strings.Join(req.Mentions, ","),
+		SendAt:       req.SendAt,
+		Status:       database.ScheduledPending,
+		Owner:        req.Owner,
+		LeaseUntil:   req.SendAt + int64(common.ScheduledLease),
+		CreateTime:   time.Now().UnixNano(),
+	}
+	if err = h.MessageDB.Create(&scheduled).Error; err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+	_, _ = c.Negotiate(&rpc.ScheduleMessageResp{
+		ID: scheduled.ID,
+	})
+}
+
+// ScheduledList 按创建顺序分页读取账号待发送的消息
+func (h *ServiceHandler) ScheduledList(c iris.Context) {
+	var req rpc.ScheduledListReq
+	if err := c.ReadBody(&req); err != nil {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	resp, err := h.scheduledList(h.MessageDB.Where("sender=?", req.Account), req.After, req.Limit)
+	if err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+	_, _ = c.Negotiate(resp)
+}
+
+// PendingScheduled 分页领取所有app待发送的消息，用于调度器启动时恢复定时器，以及接管过期未送达的消息
+func (h *ServiceHandler) PendingScheduled(c iris.Context) {
+	var req rpc.PendingScheduledReq
+	if err := c.ReadBody(&req); err != nil {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	if req.Owner == "" {
+		c.StopWithText(iris.StatusBadRequest, "owner is required")
+		return
+	}
+	resp, err := h.pendingScheduled(&req)
+	if err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+	_, _ = c.Negotiate(resp)
+}
+
+// pendingScheduled 先读出一页可以领取的消息，再用带同样条件的UPDATE领取，
+// 多个实例同时领取同一条消息时只有一个UPDATE生效，只返回领取成功的消息
+func (h *ServiceHandler) pendingScheduled(req *rpc.PendingScheduledReq) (*rpc.ScheduledListResp, error) {
+	now := time.Now().UnixNano()
+	claimable := func(tx *gorm.DB) *gorm.DB {
+		tx = tx.Where("owner=? or lease_until<?", req.Owner, now)
+		if req.Before > 0 {
+			tx = tx.Where("send_at<=?", req.Before)
+		}
+		return tx
+	}
+	resp, err := h.scheduledList(claimable(h.MessageDB), req.After, req.Limit)
+	if err != nil || len(resp.List) == 0 {
+		return resp, err
+	}
+	var ids = make([]int64, len(resp.List))
+	for i, m := range resp.List {
+		ids[i] = m.ID
+	}
+	claim := func(sendAt string, leaseUntil interface{}) error {
+		return claimable(h.MessageDB.Model(&database.ScheduledMessage{})).
+			Where("id in ? and status=? and send_at"+sendAt+"?", ids, database.ScheduledPending, now).
+			Updates(map[string]interface{}{"owner": req.Owner, "lease_until": leaseUntil}).Error
+	}
+	// 已经过期的消息从现在开始计算领取的有效期
+	if err = claim("<=", now+int64(common.ScheduledLease)); err != nil {
+		return nil, err
+	}
+	if err = claim(">", gorm.Expr("send_at + ?", int64(common.ScheduledLease))); err != nil {
+		return nil, err
+	}
+	var claimed []int64
+	err = h.MessageDB.Model(&database.ScheduledMessage{}).
+		Where("id in ? and status=? and owner=?", ids, database.ScheduledPending, req.Owner).Pluck("id", &claimed).Error
+	if err != nil {
+		return nil, err
+	}
+	var owned = make(map[int64]bool, len(claimed))
+	for _, id := range claimed {
+		owned[id] = true
+	}
+	var list = resp.List[:0]
+	for _, m := range resp.List {
+		if owned[m.ID] {
+			list = append(list, m)
+		}
+	}
+	resp.List = list
+	return resp, nil
+}
+
+func (h *ServiceHandler) scheduledList(tx *gorm.DB, after int64, limit int32) (*rpc.ScheduledListResp, error) {
+	if limit <= 0 || limit > common.MessageMaxCountPerPage {
+		limit = common.MessageMaxCountPerPage
+	}
+	var rows []database.ScheduledMessage
+	err := tx.Where("status=? and id>?", database.ScheduledPending, after).
+		Order("id asc").Limit(int(limit) + 1).Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	var resp rpc.ScheduledListResp
+	if len(rows) > int(limit) {
+		rows = rows[:limit]
+		resp.More = true
+	}
+	resp.List = make([]*rpc.ScheduledMessage, len(rows))
+	for i, row := range rows {
+		resp.List[i] = &rpc.ScheduledMessage{
+			ID:       row.ID,
+			App:      row.App,
+			Sender:   row.Sender,
+			Dest:     row.Dest,
+			Group:    row.IsGroup,
+			SendAt:   row.SendAt,
+			Mentions: splitMentions(row.Mentions),
+			Message: &rpc.Message{
+				Type:         int32(row.Type),
+				Body:         row.Body,
+				Extra:        row.Extra,
+				ReplyTo:      row.ReplyTo,
+				ThreadRoot:   row.ThreadRoot,
+				Ttl:          row.TTL,
+				TtlAfterRead: row.TTLAfterRead,
+			},
+		}
+	}
+	return &resp, nil
+}
+
+// splitMentions 解析以逗号分隔的提及成员，为空时返回nil
+func splitMentions(mentions string) []string {
+	if mentions == "" {
+		return nil
+	}
+	return strings.Split(mentions, ",")
+}
+
+// CancelScheduled 发送方取消还未送达的消息
+func (h *ServiceHandler) CancelScheduled(c iris.Context) {
+	var req rpc.CancelScheduledReq
+	if err := c.ReadBody(&req); err != nil {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	result := h.MessageDB.Model(&database.ScheduledMessage{}).
+		Where("id=? and sender=? and status=?", req.ID, req.Account, database.ScheduledPending).
+		Update("status", database.ScheduledCanceled)
+	if result.Error != nil {
+		c.StopWithError(iris.StatusInternalServerError, result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		return
+	}
+	var count int64
+	err := h.MessageDB.Model(&database.ScheduledMessage{}).
+		Where("id=? and sender=?", req.ID, req.Account).Count(&count).Error
+	if err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+	if count == 0 {
+		c.StopWithError(iris.StatusForbidden, ErrNotSender)
+		return
+	}
+	c.StopWithError(iris.StatusUnprocessableEntity, ErrScheduledDone)
+}
+
+// FailScheduled 领取消息的调度器多次送达失败后把它标记为失败，不再被领取
+func (h *ServiceHandler) FailScheduled(c iris.Context) {
+	var req rpc.FailScheduledReq
+	if err := c.ReadBody(&req); err != nil {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	if err := h.failScheduled(&req); err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+}
+
+func (h *ServiceHandler) failScheduled(req *rpc.FailScheduledReq) error {
+	return h.MessageDB.Model(&database.ScheduledMessage{}).
+		Where("id=? and owner=? and status=?", req.ID, req.Owner, database.ScheduledPending).
+		Update("status", database.ScheduledFailed).Error
+}
+
+// DeliverScheduled 把待发送的消息标记为已送达并写入消息，两者在同一个事务中。
+// 多个调度器同时送达同一条消息时只有一个成功
+func (h *ServiceHandler) DeliverScheduled(c iris.Context) {
+	var req rpc.DeliverScheduledReq
+	if err := c.ReadBody(&req); err != nil {
+		c.StopWithError(iris.StatusBadRequest, err)
+		return
+	}
+	var resp rpc.DeliverScheduledResp
+	err := h.MessageDB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&database.ScheduledMessage{}).
+			Where("id=? and status=?", req.ID, database.ScheduledPending).
+			Update("status", database.ScheduledDelivered)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		var scheduled database.ScheduledMessage
+		if err := tx.First(&scheduled, req.ID).Error; err != nil {
+			return err
+		}
+		insert := &rpc.InsertMessageReq{
+			Sender:   scheduled.Sender,
+			Dest:     scheduled.Dest,
+			SendTime: req.SendTime,
+			Message: &rpc.Message{
+				Type:         int32(scheduled.Type),
+				Body:         scheduled.Body,
+				Extra:        scheduled.Extra,
+				ReplyTo:      scheduled.ReplyTo,
+				ThreadRoot:   scheduled.ThreadRoot,
+				Ttl:          scheduled.TTL,
+				TtlAfterRead: scheduled.TTLAfterRead,
+			},
+		}
+		var inserted *rpc.InsertMessageResp
+		var err error
+		if scheduled.IsGroup {
+			inserted, err = h.insertGroupMessage(tx, insert)
+		} else {
+			inserted, err = h.insertUserMessage(tx, insert)
+		}
+		if err != nil {
+			return err
+		}
+		resp.Delivered = true
+		resp.MessageID, resp.Seq = inserted.MessageID, inserted.Seq
+		return tx.Model(&scheduled).Update("message_id", resp.MessageID).Error
+	})
+	if err != nil {
+		c.StopWithError(iris.StatusInternalServerError, err)
+		return
+	}
+	_, _ = c.Negotiate(&resp)
+}
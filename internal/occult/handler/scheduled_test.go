@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"X_IM/internal/occult/database"
+	"X_IM/pkg/wire/rpc"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func createScheduled(t *testing.T, h *ServiceHandler, id int64, owner string, sendAt int64) {
+	err := h.MessageDB.Create(&database.ScheduledMessage{
+		ID:         id,
+		App:        "x_t",
+		Sender:     "alice",
+		Dest:       "bob",
+		Body:       "hello",
+		SendAt:     sendAt,
+		Status:     database.ScheduledPending,
+		Owner:      owner,
+		CreateTime: time.Now().UnixNano(),
+	}).Error
+	assert.Nil(t, err)
+}
+
+func pendingIDs(t *testing.T, h *ServiceHandler, owner string, before int64) []int64 {
+	resp, err := h.pendingScheduled(&rpc.PendingScheduledReq{Owner: owner, Before: before})
+	assert.Nil(t, err)
+	var ids []int64
+	for _, m := range resp.List {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func TestPendingScheduledClaim(t *testing.T) {
+	h := newTestHandler(t)
+	now := time.Now().UnixNano()
+	// 1没有被领取，2由chat01负责并且还未到时间，3由已经退出的chat03负责，领取已经过期
+	createScheduled(t, h, 1, "", now-int64(time.Minute))
+	createScheduled(t, h, 2, "chat01", now+int64(time.Hour))
+	createScheduled(t, h, 3, "chat03", now-int64(time.Hour))
+	assert.Nil(t, h.MessageDB.Model(&database.ScheduledMessage{}).
+		Where("id in ?", []int64{2}).Update("lease_until", now+int64(time.Hour*2)).Error)
+
+	assert.Nil(t, h.MessageDB.Model(&database.ScheduledMessage{}).
+		Where("id=?", 2).Update("mentions", "bob,carol").Error)
+
+	assert.Equal(t, []int64{1, 2, 3}, pendingIDs(t, h, "chat01", 0))
+	resp, err := h.pendingScheduled(&rpc.PendingScheduledReq{Owner: "chat01"})
+	assert.Nil(t, err)
+	assert.Empty(t, resp.List[0].Mentions)
+	assert.Equal(t, []string{"bob", "carol"}, resp.List[1].Mentions)
+	// 已经被chat01领取的消息其他实例领取不到
+	assert.Empty(t, pendingIDs(t, h, "chat02", 0))
+	assert.Equal(t, []int64{1, 3}, pendingIDs(t, h, "chat01", now))
+
+	var rows []database.ScheduledMessage
+	assert.Nil(t, h.MessageDB.Order("id asc").Find(&rows).Error)
+	for _, row := range rows {
+		assert.Equal(t, "chat01", row.Owner)
+		assert.Greater(t, row.LeaseUntil, now)
+	}
+
+	// 只有负责的实例可以标记失败，失败的消息不再被领取
+	assert.Nil(t, h.failScheduled(&rpc.FailScheduledReq{ID: 1, Owner: "chat02"}))
+	assert.Nil(t, h.failScheduled(&rpc.FailScheduledReq{ID: 3, Owner: "chat01"}))
+	assert.Equal(t, []int64{1, 2}, pendingIDs(t, h, "chat01", 0))
+
+	// 领取过期后由其他实例接管
+	assert.Nil(t, h.MessageDB.Model(&database.ScheduledMessage{}).
+		Where("id=?", 1).Update("lease_until", now-1).Error)
+	assert.Equal(t, []int64{1}, pendingIDs(t, h, "chat02", 0))
+	assert.Empty(t, pendingIDs(t, h, "chat01", now))
+}
@@ -48,8 +48,27 @@ func newApp(serviceHandler *handler.ServiceHandler) *iris.Application {
 		messageAPI.Post("/user", serviceHandler.InsertUserMessage)
 		messageAPI.Post("/group", serviceHandler.InsertGroupMessage)
 		messageAPI.Post("/ack", serviceHandler.MessageACK)
+		messageAPI.Post("/rewind", serviceHandler.MessageRewind)
+		messageAPI.Post("/recall", serviceHandler.MessageRecall)
+		messageAPI.Post("/edit", serviceHandler.MessageEdit)
+		messageAPI.Get("/versions/:id", serviceHandler.MessageVersions)
+		messageAPI.Post("/reaction", serviceHandler.MessageReact)
+		messageAPI.Post("/scheduled", serviceHandler.ScheduleMessage)
+		messageAPI.Post("/scheduled/list", serviceHandler.ScheduledList)
+		messageAPI.Post("/scheduled/cancel", serviceHandler.CancelScheduled)
+		messageAPI.Post("/scheduled/deliver", serviceHandler.DeliverScheduled)
+		messageAPI.Post("/scheduled/fail", serviceHandler.FailScheduled)
+		messageAPI.Post("/thread", serviceHandler.ThreadReplies)
+		messageAPI.Post("/thread/counts", serviceHandler.ThreadCounts)
+		messageAPI.Post("/read", serviceHandler.MessageRead)
+		messageAPI.Post("/read/state", serviceHandler.MessageReadState)
 	}
 
+	// 定时发送的调度器恢复所有app待发送的消息
+	app.Post("/api/scheduled/pending", serviceHandler.PendingScheduled)
+	// 阅后即焚的清理任务删除所有app过期的消息
+	app.Post("/api/expired/sweep", serviceHandler.SweepExpired)
+
 	groupAPI := app.Party("/api/:app/group")
 	{
 		groupAPI.Get("/:id", serviceHandler.GroupGet)
@@ -59,11 +78,23 @@ func newApp(serviceHandler *handler.ServiceHandler) *iris.Application {
 		groupAPI.Get("/members/:id", serviceHandler.GroupMembers)
 	}
 
+	deviceAPI := app.Party("/api/:app/device")
+	{
+		deviceAPI.Post("/token", serviceHandler.RegisterToken)
+		deviceAPI.Delete("/token", serviceHandler.UnregisterToken)
+		deviceAPI.Post("/tokens", serviceHandler.DeviceTokens)
+	}
+
 	offlineAPI := app.Party("/api/:app/offline")
 	{
 		offlineAPI.Use(iris.Compression)
 		offlineAPI.Post("/index", serviceHandler.GetOfflineMessageIndex)
 		offlineAPI.Post("/content", serviceHandler.GetOfflineMessageContent)
+		offlineAPI.Post("/conversations", serviceHandler.Conversations)
+		offlineAPI.Post("/conversation/sync", serviceHandler.ConversationSync)
+		offlineAPI.Post("/conversation/history", serviceHandler.ConversationHistory)
+		offlineAPI.Post("/conversation/mute", serviceHandler.ConversationMute)
+		offlineAPI.Post("/conversations/muted", serviceHandler.MutedConversations)
 	}
 	return app
 }
@@ -108,10 +139,18 @@ func RunServerStart(ctx context.Context, opts *ServerStartOptions, version strin
 		return err
 	}
 
-	_ = baseDB.AutoMigrate(&database.Group{}, &database.GroupMember{})
+	// 推送token的唯一索引加上了app，同一账号在不同app中的token互不覆盖
+	if baseDB.Migrator().HasIndex(&database.DeviceToken{}, "uni_acc_dev") {
+		_ = baseDB.Migrator().DropIndex(&database.DeviceToken{}, "uni_acc_dev")
+	}
+	_ = baseDB.AutoMigrate(&database.Group{}, &database.GroupMember{}, &database.DeviceToken{})
 	//TODO： 如果MySQL需要分区表，那么这里不用自动生成messageIndex
 	// 需要在scripts目录下使用sql直接生成表
-	_ = messageDB.AutoMigrate(&database.MessageIndex{}, &database.MessageContent{})
+	// 按序号同步的索引改为包含会话的另一方或群ID，见MessageIndex
+	if messageDB.Migrator().HasIndex(&database.MessageIndex{}, "idx_acc_seq") {
+		_ = messageDB.Migrator().DropIndex(&database.MessageIndex{}, "idx_acc_seq")
+	}
+	_ = messageDB.AutoMigrate(&database.MessageIndex{}, &database.MessageContent{}, &database.MessageVersion{}, &database.MessageReaction{}, &database.ScheduledMessage{}, &database.Conversation{}, &database.ConversationSeq{}, &database.MessageDedup{})
 
 	if config.NodeID == 0 {
 		config.NodeID = int64(HashCode(config.ServiceID))
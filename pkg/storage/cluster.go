@@ -3,55 +3,68 @@ package storage
 import (
 	"X_IM/pkg/wire/pkt"
 	"X_IM/pkg/x"
-	"errors"
-	"github.com/gitstliu/go-redis-cluster"
 	"time"
 
+	"github.com/go-redis/redis/v7"
 	"google.golang.org/protobuf/proto"
 )
 
+// RedisClusterStorage Redis集群中的会话，key与RedisStorage相同。
+// 位置与session的key不在同一个slot，不能放在同一个事务中，位置的读写通过脚本保证原子性。
+// ClusterClient的Pipeline会按key的slot把命令分组到所在的节点，每个节点一次往返
 type RedisClusterStorage struct {
-	cli *redis.Cluster
+	cli *redis.ClusterClient
 }
 
-func NewRedisClusterStorage(cli *redis.Cluster) x.SessionStorage {
+func NewRedisClusterStorage(cli *redis.ClusterClient) x.SessionStorage {
 	return &RedisClusterStorage{
 		cli: cli,
 	}
 }
 
-func (r *RedisClusterStorage) Add(session *pkt.Session) error {
+func (r *RedisClusterStorage) Add(session *pkt.Session) (*x.Location, error) {
 	// save x.Location
 	loc := x.Location{
 		ChannelID: session.ChannelID,
 		GateID:    session.GateID,
+		Device:    session.Device,
+		LoginTime: time.Now().UnixNano(),
 	}
-	ex := int(LocationExpired / time.Second)
-	locKey := KeyLocation(session.Account, "")
-	_, err := r.cli.Do("SET", locKey, loc.Bytes(), "EX", ex)
-	if err != nil {
-		return err
+	locKey := KeyLocation(session.Account)
+	prev, err := addLocationScript.Run(r.cli, []string{locKey},
+		session.Device, loc.Bytes(), int(LocationExpired/time.Second)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
 	}
 	// save session
 	snKey := KeySession(session.ChannelID)
 	buf, _ := proto.Marshal(session)
-	_, err = r.cli.Do("SET", snKey, buf, "EX", ex)
+	deadline := time.Now().Add(LocationExpired).Unix()
+	_, err = r.cli.Pipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(snKey, buf, LocationExpired)
+		pipe.ZAdd(KeyGateSessions(session.GateID), &redis.Z{
+			Score:  float64(deadline),
+			Member: gateMember(session.Account, session.ChannelID),
+		})
+		pipe.SAdd(KeyGates, session.GateID)
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return parseLocation(prev), nil
 }
 
 // Delete a session
 func (r *RedisClusterStorage) Delete(account string, channelId string) error {
-	locKey := KeyLocation(account, "")
-	_, err := r.cli.Do("DEL", locKey)
+	locKey := KeyLocation(account)
+	err := deleteLocationScript.Run(r.cli, []string{locKey}, channelId).Err()
 	if err != nil {
 		return err
 	}
 
 	snKey := KeySession(channelId)
-	_, err = r.cli.Do("DEL", snKey)
+	err = r.cli.Del(snKey).Err()
 	if err != nil {
 		return err
 	}
@@ -61,9 +74,9 @@ func (r *RedisClusterStorage) Delete(account string, channelId string) error {
 // Get session by sessionID
 func (r *RedisClusterStorage) Get(ChannelId string) (*pkt.Session, error) {
 	snKey := KeySession(ChannelId)
-	bts, err := redis.Bytes(r.cli.Do("GET", snKey))
+	bts, err := r.cli.Get(snKey).Bytes()
 	if err != nil {
-		if errors.Is(err, redis.ErrNil) {
+		if err == redis.Nil {
 			return nil, x.ErrSessionNil
 		}
 		return nil, err
@@ -74,19 +87,21 @@ func (r *RedisClusterStorage) Get(ChannelId string) (*pkt.Session, error) {
 }
 
 func (r *RedisClusterStorage) GetLocations(accounts ...string) ([]*x.Location, error) {
-	keys := KeyLocations(accounts...)
-	list, err := redis.Values(r.cli.Do("MGET", keys))
+	if len(accounts) == 0 {
+		return nil, x.ErrSessionNil
+	}
+	cmds, err := r.cli.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, account := range accounts {
+			pipe.HGetAll(KeyLocation(account))
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 	var result = make([]*x.Location, 0)
-	for _, l := range list {
-		if l == nil {
-			continue
-		}
-		var loc x.Location
-		_ = loc.Unmarshal([]byte(l.(string)))
-		result = append(result, &loc)
+	for _, cmd := range cmds {
+		result = appendLocations(result, cmd.(*redis.StringStringMapCmd).Val())
 	}
 	if len(result) == 0 {
 		return nil, x.ErrSessionNil
@@ -94,11 +109,45 @@ func (r *RedisClusterStorage) GetLocations(accounts ...string) ([]*x.Location, e
 	return result, nil
 }
 
+// GetAccountLocations 用一次pipeline读取所有账号的位置，按账号分组
+func (r *RedisClusterStorage) GetAccountLocations(accounts ...string) (map[string][]*x.Location, error) {
+	var result = make(map[string][]*x.Location)
+	if len(accounts) == 0 {
+		return result, nil
+	}
+	cmds, err := r.cli.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, account := range accounts {
+			pipe.HGetAll(KeyLocation(account))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, cmd := range cmds {
+		if locs := appendLocations(nil, cmd.(*redis.StringStringMapCmd).Val()); len(locs) > 0 {
+			result[accounts[i]] = locs
+		}
+	}
+	return result, nil
+}
+
 func (r *RedisClusterStorage) GetLocation(account string, device string) (*x.Location, error) {
-	key := KeyLocation(account, device)
-	bts, err := redis.Bytes(r.cli.Do("GET", key))
+	key := KeyLocation(account)
+	if device == "" {
+		all, err := r.cli.HGetAll(key).Result()
+		if err != nil {
+			return nil, err
+		}
+		locs := appendLocations(nil, all)
+		if len(locs) == 0 {
+			return nil, x.ErrSessionNil
+		}
+		return locs[0], nil
+	}
+	bts, err := r.cli.HGet(key, device).Bytes()
 	if err != nil {
-		if errors.Is(err, redis.ErrNil) {
+		if err == redis.Nil {
 			return nil, x.ErrSessionNil
 		}
 		return nil, err
@@ -107,3 +156,73 @@ func (r *RedisClusterStorage) GetLocation(account string, device string) (*x.Loc
 	_ = loc.Unmarshal(bts)
 	return &loc, nil
 }
+
+// Renew 续期网关上在线channel的会话
+func (r *RedisClusterStorage) Renew(gateID string, leases ...*pkt.SessionLease) error {
+	if len(leases) == 0 {
+		return nil
+	}
+	deadline := float64(time.Now().Add(LocationExpired).Unix())
+	gateKey := KeyGateSessions(gateID)
+	_, err := r.cli.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, lease := range leases {
+			pipe.Expire(KeySession(lease.ChannelID), LocationExpired)
+			pipe.Expire(KeyLocation(lease.Account), LocationExpired)
+			// 已经被清理的会话不再加回索引
+			pipe.ZAddXX(gateKey, &redis.Z{
+				Score:  deadline,
+				Member: gateMember(lease.Account, lease.ChannelID),
+			})
+		}
+		pipe.SAdd(KeyGates, gateID)
+		return nil
+	})
+	return err
+}
+
+// ExpireGateway 网关断开后，它的会话最多再保留grace，期间网关恢复并续期则不受影响，返回受影响的账号
+func (r *RedisClusterStorage) ExpireGateway(gateID string, grace time.Duration) ([]string, error) {
+	deadline := time.Now().Add(grace).Unix()
+	val, err := expireGatewayScript.Run(r.cli, []string{KeyGateSessions(gateID)}, deadline).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	return gateAccounts(val), nil
+}
+
+// Sweep 按网关索引删除租约已经过期的会话，返回被删除的会话
+func (r *RedisClusterStorage) Sweep() ([]*pkt.Session, error) {
+	gates, err := r.cli.SMembers(KeyGates).Result()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	var swept []*pkt.Session
+	for _, gateID := range gates {
+		gateKey := KeyGateSessions(gateID)
+		for {
+			val, err := claimExpiredScript.Run(r.cli, []string{gateKey}, now, sweepBatch).Result()
+			if err != nil {
+				return swept, err
+			}
+			members, _ := val.([]interface{})
+			for _, member := range members {
+				account, channelID, ok := parseGateMember(member)
+				if !ok {
+					continue
+				}
+				if err = r.Delete(account, channelID); err != nil {
+					return swept, err
+				}
+				swept = append(swept, &pkt.Session{Account: account, ChannelID: channelID, GateID: gateID})
+			}
+			if len(members) < sweepBatch {
+				break
+			}
+		}
+		if n, _ := r.cli.ZCard(gateKey).Result(); n == 0 {
+			_ = r.cli.SRem(KeyGates, gateID).Err()
+		}
+	}
+	return swept, nil
+}
@@ -3,26 +3,60 @@ package storage
 import (
 	"X_IM/pkg/wire/pkt"
 	"X_IM/pkg/x"
-	"github.com/gitstliu/go-redis-cluster"
+	"fmt"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestClusterAdd(t *testing.T) {
-	cluster, err := redis.NewCluster(
-		&redis.Options{
-			StartNodes:   []string{"127.0.0.1:7000", "127.0.0.1:7001", "127.0.0.1:7002"},
-			ConnTimeout:  50 * time.Millisecond,
-			ReadTimeout:  50 * time.Millisecond,
-			WriteTimeout: 50 * time.Millisecond,
-			KeepAlive:    16,
-			AliveTime:    60 * time.Second,
-		})
+// initCluster 用三个miniredis按slot范围组成本地的集群替身，ClusterClient通过ClusterSlots获得拓扑，
+// 和真实集群一样按key的slot把命令分组发送到所在的节点
+func initCluster(t *testing.T) *redis.ClusterClient {
+	cluster, _ := newClusterStandIn(t)
+	return cluster
+}
+
+func newClusterStandIn(t *testing.T) (*redis.ClusterClient, []*miniredis.Miniredis) {
+	const nodes = 3
+	var (
+		servers = make([]*miniredis.Miniredis, nodes)
+		addrs   = make([]string, nodes)
+		slots   = make([]redis.ClusterSlot, nodes)
+	)
+	for i := range servers {
+		servers[i] = miniredis.RunT(t)
+		addrs[i] = servers[i].Addr()
+		slots[i] = redis.ClusterSlot{
+			Start: i * hashSlots / nodes,
+			End:   (i+1)*hashSlots/nodes - 1,
+			Nodes: []redis.ClusterNode{{Addr: servers[i].Addr()}},
+		}
+	}
+	// Addrs用于读取COMMAND信息，按命令中key的位置计算slot
+	cluster := redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs: addrs,
+		ClusterSlots: func() ([]redis.ClusterSlot, error) {
+			return slots, nil
+		},
+		DialTimeout:  50 * time.Millisecond,
+		ReadTimeout:  50 * time.Millisecond,
+		WriteTimeout: 50 * time.Millisecond,
+	})
+	t.Cleanup(func() { _ = cluster.Close() })
+	err := cluster.Ping().Err()
 	assert.Nil(t, err)
-	cc := NewRedisClusterStorage(cluster)
-	err = cc.Add(&pkt.Session{
+	return cluster, servers
+}
+
+// hashSlots Redis Cluster的slot总数
+const hashSlots = 16384
+
+func TestClusterAdd(t *testing.T) {
+	cc := NewRedisClusterStorage(initCluster(t))
+	_, err := cc.Add(&pkt.Session{
 		ChannelID: "ch1",
 		GateID:    "gateway1",
 		Account:   "test1",
@@ -30,7 +64,7 @@ func TestClusterAdd(t *testing.T) {
 	})
 	assert.Nil(t, err)
 
-	_ = cc.Add(&pkt.Session{
+	_, _ = cc.Add(&pkt.Session{
 		ChannelID: "ch2",
 		GateID:    "gateway1",
 		Account:   "test2",
@@ -56,3 +90,49 @@ func TestClusterAdd(t *testing.T) {
 	assert.Equal(t, "ch2", loc.ChannelID)
 	assert.Equal(t, "gateway1", loc.GateID)
 }
+
+func TestClusterCRUD(t *testing.T) {
+	testCRUD(t, NewRedisClusterStorage(initCluster(t)))
+}
+
+func TestClusterLease(t *testing.T) {
+	testLease(t, NewRedisClusterStorage(initCluster(t)))
+}
+
+// TestClusterPipeline 批量寻址的账号分布在不同的节点上，一次Pipeline读取全部位置
+func TestClusterPipeline(t *testing.T) {
+	cli, servers := newClusterStandIn(t)
+	cc := NewRedisClusterStorage(cli)
+	var accounts []string
+	for i := 0; i < 30; i++ {
+		account := fmt.Sprintf("pipeline%d", i)
+		accounts = append(accounts, account)
+		_, err := cc.Add(&pkt.Session{
+			ChannelID: "pch" + account,
+			GateID:    "gateway1",
+			Account:   account,
+			Device:    "PC",
+		})
+		assert.Nil(t, err)
+	}
+	for _, server := range servers {
+		var locs int
+		for _, key := range server.Keys() {
+			if server.Type(key) == "hash" {
+				locs++
+			}
+		}
+		assert.Greater(t, locs, 0)
+	}
+	locs, err := cc.GetLocations(accounts...)
+	assert.Nil(t, err)
+	assert.Equal(t, len(accounts), len(locs))
+
+	// 按账号分组，离线的账号不返回
+	grouped, err := cc.(x.LocationBatcher).GetAccountLocations(append(accounts, "offline")...)
+	assert.Nil(t, err)
+	assert.Equal(t, len(accounts), len(grouped))
+	for _, account := range accounts {
+		assert.Equal(t, "pch"+account, grouped[account][0].ChannelID)
+	}
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"X_IM/pkg/logger"
+	"X_IM/pkg/wire/pkt"
+	"X_IM/pkg/x"
+	"errors"
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// InvalidateChannel 会话变化时通过这个频道通知所有实例失效本地缓存，消息内容为ChannelID
+const InvalidateChannel = "login:invalidate"
+
+// versionShards 失效版本号的分片数
+const versionShards = 256
+
+// LocalStorage 在SessionStorage前面增加进程内的LRU缓存，只缓存Get的结果。
+// Add与Delete通过Redis pub/sub通知所有实例删除本地缓存，
+// 订阅断开期间丢失的通知由TTL兜底
+type LocalStorage struct {
+	x.SessionStorage
+	cli   redis.UniversalClient
+	cache *lru.Cache
+	ttl   time.Duration
+	// versions 按ChannelID分片的失效版本号，每次失效对应的分片加一，避免读Redis期间发生的失效被旧数据覆盖。
+	// 其他分片的失效不影响正在读取的会话写入缓存
+	versions [versionShards]atomic.Uint64
+}
+
+type cachedSession struct {
+	session  *pkt.Session
+	expireAt time.Time
+}
+
+// NewLocalStorage size为缓存的会话数，cli用于发布与订阅失效通知
+func NewLocalStorage(storage x.SessionStorage, cli redis.UniversalClient, size int, ttl time.Duration) (*LocalStorage, error) {
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalStorage{
+		SessionStorage: storage,
+		cli:            cli,
+		cache:          cache,
+		ttl:            ttl,
+	}, nil
+}
+
+func (s *LocalStorage) Add(session *pkt.Session) (*x.Location, error) {
+	prev, err := s.SessionStorage.Add(session)
+	if err != nil {
+		return nil, err
+	}
+	s.invalidate(session.ChannelID)
+	if prev != nil && prev.ChannelID != session.ChannelID {
+		s.invalidate(prev.ChannelID)
+	}
+	return prev, nil
+}
+
+func (s *LocalStorage) Delete(account string, channelId string) error {
+	err := s.SessionStorage.Delete(account, channelId)
+	if err != nil {
+		return err
+	}
+	s.invalidate(channelId)
+	return nil
+}
+
+func (s *LocalStorage) Get(channelId string) (*pkt.Session, error) {
+	if val, ok := s.cache.Get(channelId); ok {
+		cached := val.(*cachedSession)
+		if time.Now().Before(cached.expireAt) {
+			sessionCacheTotal.WithLabelValues("hit").Inc()
+			return cached.session, nil
+		}
+		s.cache.Remove(channelId)
+	}
+	sessionCacheTotal.WithLabelValues("miss").Inc()
+
+	shard := s.shard(channelId)
+	version := shard.Load()
+	session, err := s.SessionStorage.Get(channelId)
+	if err != nil {
+		return nil, err
+	}
+	if shard.Load() == version {
+		s.cache.Add(channelId, &cachedSession{
+			session:  session,
+			expireAt: time.Now().Add(s.ttl),
+		})
+	}
+	return session, nil
+}
+
+// Watch 订阅其他实例的失效通知，直到stop被关闭
+func (s *LocalStorage) Watch(stop <-chan struct{}) {
+	sub := s.cli.Subscribe(InvalidateChannel)
+	defer sub.Close()
+	ch := sub.Channel()
+	for {
+		select {
+		case <-stop:
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			s.remove(msg.Payload)
+		}
+	}
+}
+
+func (s *LocalStorage) invalidate(channelId string) {
+	s.remove(channelId)
+	if err := s.cli.Publish(InvalidateChannel, channelId).Err(); err != nil {
+		logger.WithField("func", "invalidate").Warn(err)
+	}
+}
+
+func (s *LocalStorage) remove(channelId string) {
+	s.shard(channelId).Add(1)
+	s.cache.Remove(channelId)
+}
+
+func (s *LocalStorage) shard(channelId string) *atomic.Uint64 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(channelId))
+	return &s.versions[h.Sum32()%versionShards]
+}
+
+// GetAccountLocations 位置不缓存，转发给被包装的SessionStorage
+func (s *LocalStorage) GetAccountLocations(accounts ...string) (map[string][]*x.Location, error) {
+	if batcher, ok := s.SessionStorage.(x.LocationBatcher); ok {
+		return batcher.GetAccountLocations(accounts...)
+	}
+	var result = make(map[string][]*x.Location)
+	for _, account := range accounts {
+		locs, err := s.SessionStorage.GetLocations(account)
+		if errors.Is(err, x.ErrSessionNil) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result[account] = locs
+	}
+	return result, nil
+}
+
+// Renew 转发给被包装的SessionStorage
+func (s *LocalStorage) Renew(gateID string, leases ...*pkt.SessionLease) error {
+	if leaser, ok := s.SessionStorage.(x.SessionLeaser); ok {
+		return leaser.Renew(gateID, leases...)
+	}
+	return nil
+}
+
+// ExpireGateway 转发给被包装的SessionStorage
+func (s *LocalStorage) ExpireGateway(gateID string, grace time.Duration) ([]string, error) {
+	if leaser, ok := s.SessionStorage.(x.SessionLeaser); ok {
+		return leaser.ExpireGateway(gateID, grace)
+	}
+	return nil, nil
+}
+
+// Sweep 转发给被包装的SessionStorage，和Delete一样通知所有实例删除被清理的会话的本地缓存
+func (s *LocalStorage) Sweep() ([]*pkt.Session, error) {
+	leaser, ok := s.SessionStorage.(x.SessionLeaser)
+	if !ok {
+		return nil, nil
+	}
+	swept, err := leaser.Sweep()
+	for _, session := range swept {
+		s.invalidate(session.ChannelID)
+	}
+	return swept, err
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"X_IM/pkg/wire/pkt"
+	"X_IM/pkg/x"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/assert"
+)
+
+type countStorage struct {
+	*RedisStorage
+	gets int
+}
+
+func (s *countStorage) Get(channelId string) (*pkt.Session, error) {
+	s.gets++
+	return s.RedisStorage.Get(channelId)
+}
+
+func TestLocalStorage(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+
+	inner := &countStorage{RedisStorage: NewRedisStorage(c).(*RedisStorage)}
+	s, err := NewLocalStorage(inner, c, 10, time.Millisecond*200)
+	assert.Nil(t, err)
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.Watch(stop)
+
+	_, err = s.Add(&pkt.Session{
+		ChannelID: "local1",
+		GateID:    "gateway1",
+		Account:   "local_account",
+		Device:    "device1",
+	})
+	assert.Nil(t, err)
+
+	// 第二次读取命中本地缓存
+	_, _ = s.Get("local1")
+	session, err := s.Get("local1")
+	assert.Nil(t, err)
+	assert.Equal(t, "local_account", session.Account)
+	assert.Equal(t, 1, inner.gets)
+
+	// 过期后重新读取
+	time.Sleep(time.Millisecond * 300)
+	_, _ = s.Get("local1")
+	assert.Equal(t, 2, inner.gets)
+
+	// 删除后立即失效
+	err = s.Delete("local_account", "local1")
+	assert.Nil(t, err)
+	_, err = s.Get("local1")
+	assert.Equal(t, x.ErrSessionNil, err)
+
+	// 租约清理后立即失效
+	_, err = s.Add(&pkt.Session{
+		ChannelID: "local2",
+		GateID:    "gateway2",
+		Account:   "local_account",
+		Device:    "device2",
+	})
+	assert.Nil(t, err)
+	_, err = s.Get("local2")
+	assert.Nil(t, err)
+	_, err = s.ExpireGateway("gateway2", -time.Second)
+	assert.Nil(t, err)
+	swept, err := s.Sweep()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(swept))
+	_, err = s.Get("local2")
+	assert.Equal(t, x.ErrSessionNil, err)
+}
+
+// blockingStorage Get等待release后返回，模拟读Redis期间发生失效
+type blockingStorage struct {
+	x.SessionStorage
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStorage) Get(channelId string) (*pkt.Session, error) {
+	s.reading <- struct{}{}
+	<-s.release
+	return &pkt.Session{ChannelID: channelId}, nil
+}
+
+func TestLocalStorageShardVersion(t *testing.T) {
+	inner := &blockingStorage{reading: make(chan struct{}), release: make(chan struct{})}
+	s, err := NewLocalStorage(inner, nil, 10, time.Minute)
+	assert.Nil(t, err)
+	assert.True(t, s.shard("ch1") != s.shard("ch2"))
+
+	get := func(invalidated string) {
+		done := make(chan struct{})
+		go func() {
+			_, _ = s.Get("ch1")
+			close(done)
+		}()
+		<-inner.reading
+		s.remove(invalidated)
+		close(inner.release)
+		<-done
+		inner.release = make(chan struct{})
+	}
+	// 其他会话的失效不影响写入缓存
+	get("ch2")
+	assert.True(t, s.cache.Contains("ch1"))
+
+	// 读取期间同一个会话失效时不缓存旧数据
+	s.cache.Purge()
+	get("ch1")
+	assert.False(t, s.cache.Contains("ch1"))
+}
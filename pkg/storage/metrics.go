@@ -0,0 +1,12 @@
+package storage
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var sessionCacheTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "x_im",
+	Name:      "session_cache_total",
+	Help:      "本地会话缓存的命中与未命中次数",
+}, []string{"result"})
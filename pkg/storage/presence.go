@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"X_IM/pkg/x"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// PresenceSubscribeExpired 订阅关系的过期时间，客户端登录后需要重新订阅
+const PresenceSubscribeExpired = time.Hour * 24
+
+// RedisPresenceStorage 自定义状态保存在presence:status:{account}中，
+// 订阅了account的账号保存在集合presence:subs:{account}中，subscriber订阅的账号保存在集合presence:following:{subscriber}中，
+// 账号所属的app保存在presence:app:{account}中
+type RedisPresenceStorage struct {
+	cli redis.UniversalClient
+}
+
+func NewRedisPresenceStorage(cli redis.UniversalClient) x.PresenceStorage {
+	return &RedisPresenceStorage{cli: cli}
+}
+
+func (r *RedisPresenceStorage) SetStatus(account string, status string) error {
+	if status == "" {
+		return r.cli.Del(KeyPresenceStatus(account)).Err()
+	}
+	return r.cli.Set(KeyPresenceStatus(account), status, 0).Err()
+}
+
+func (r *RedisPresenceStorage) GetStatus(accounts ...string) (map[string]string, error) {
+	return r.mget(KeyPresenceStatus, accounts...)
+}
+
+func (r *RedisPresenceStorage) SetApp(account string, app string) error {
+	return r.cli.Set(KeyPresenceApp(account), app, 0).Err()
+}
+
+func (r *RedisPresenceStorage) GetApps(accounts ...string) (map[string]string, error) {
+	return r.mget(KeyPresenceApp, accounts...)
+}
+
+// mget 在一个Pipeline中读取每个账号的key，值为空的账号不返回
+func (r *RedisPresenceStorage) mget(key func(string) string, accounts ...string) (map[string]string, error) {
+	var result = make(map[string]string, len(accounts))
+	if len(accounts) == 0 {
+		return result, nil
+	}
+	cmds, err := r.cli.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, account := range accounts {
+			pipe.Get(key(account))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	for i, cmd := range cmds {
+		if val := cmd.(*redis.StringCmd).Val(); val != "" {
+			result[accounts[i]] = val
+		}
+	}
+	return result, nil
+}
+
+func (r *RedisPresenceStorage) Subscribe(subscriber string, accounts ...string) error {
+	_, err := r.cli.Pipelined(func(pipe redis.Pipeliner) error {
+		following := KeyPresenceFollowing(subscriber)
+		for _, account := range accounts {
+			key := KeyPresenceSubscribers(account)
+			pipe.SAdd(key, subscriber)
+			pipe.Expire(key, PresenceSubscribeExpired)
+			pipe.SAdd(following, account)
+		}
+		pipe.Expire(following, PresenceSubscribeExpired)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisPresenceStorage) Unsubscribe(subscriber string, accounts ...string) error {
+	_, err := r.cli.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, account := range accounts {
+			pipe.SRem(KeyPresenceSubscribers(account), subscriber)
+			pipe.SRem(KeyPresenceFollowing(subscriber), account)
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *RedisPresenceStorage) Subscribers(account string) ([]string, error) {
+	return r.cli.SMembers(KeyPresenceSubscribers(account)).Result()
+}
+
+func (r *RedisPresenceStorage) Subscriptions(subscriber string) ([]string, error) {
+	return r.cli.SMembers(KeyPresenceFollowing(subscriber)).Result()
+}
+
+// KeyPresenceStatus 账号的自定义状态
+func KeyPresenceStatus(account string) string {
+	return fmt.Sprintf("presence:status:%s", account)
+}
+
+// KeyPresenceSubscribers 订阅了账号在线状态的账号
+func KeyPresenceSubscribers(account string) string {
+	return fmt.Sprintf("presence:subs:%s", account)
+}
+
+// KeyPresenceFollowing 账号订阅的在线状态，用于限制订阅数量
+func KeyPresenceFollowing(subscriber string) string {
+	return fmt.Sprintf("presence:following:%s", subscriber)
+}
+
+// KeyPresenceApp 账号所属的app，在线状态只对同一app的账号可见
+func KeyPresenceApp(account string) string {
+	return fmt.Sprintf("presence:app:%s", account)
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v7"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPresence(t *testing.T) {
+	password := "Redis:0617"
+	c, err := InitRedis(redisAddr, password)
+	assert.Nil(t, err)
+
+	s := NewRedisPresenceStorage(c)
+	err = s.SetStatus("presence1", "busy")
+	assert.Nil(t, err)
+	_ = s.SetStatus("presence2", "")
+
+	statuses, err := s.GetStatus("presence1", "presence2")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"presence1": "busy"}, statuses)
+
+	err = s.Subscribe("watcher1", "presence1", "presence2")
+	assert.Nil(t, err)
+	_ = s.Subscribe("watcher2", "presence1")
+	subs, err := s.Subscribers("presence1")
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"watcher1", "watcher2"}, subs)
+
+	err = s.Unsubscribe("watcher1", "presence1")
+	assert.Nil(t, err)
+	subs, _ = s.Subscribers("presence1")
+	assert.Equal(t, []string{"watcher2"}, subs)
+}
+
+func TestPresenceAppAndFollowing(t *testing.T) {
+	mr := miniredis.RunT(t)
+	s := NewRedisPresenceStorage(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+
+	assert.Nil(t, s.SetApp("presence1", "x_im"))
+	apps, err := s.GetApps("presence1", "presence2")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"presence1": "x_im"}, apps)
+
+	assert.Nil(t, s.Subscribe("watcher1", "presence1", "presence2"))
+	following, err := s.Subscriptions("watcher1")
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"presence1", "presence2"}, following)
+	assert.Nil(t, s.Unsubscribe("watcher1", "presence1"))
+	following, _ = s.Subscriptions("watcher1")
+	assert.Equal(t, []string{"presence2"}, following)
+}
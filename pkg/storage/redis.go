@@ -1,8 +1,10 @@
 package storage
 
 import (
+	"X_IM/pkg/wire/endian"
 	"X_IM/pkg/wire/pkt"
 	"X_IM/pkg/x"
+	"bytes"
 	"fmt"
 	"github.com/go-redis/redis/v7"
 	"google.golang.org/protobuf/proto"
@@ -10,7 +12,12 @@ import (
 )
 
 const (
-	LocationExpired = time.Hour * 48
+	// LocationExpired 会话的租约，网关为在线的channel定期续期
+	LocationExpired = time.Minute * 5
+	// KeyGates 有会话的网关
+	KeyGates = "login:gates"
+
+	sweepBatch = 500
 )
 
 type RedisStorage struct {
@@ -20,41 +27,47 @@ type RedisStorage struct {
 func NewRedisStorage(cli *redis.Client) x.SessionStorage {
 	return &RedisStorage{cli: cli}
 }
-func (r *RedisStorage) Add(session *pkt.Session) error {
+func (r *RedisStorage) Add(session *pkt.Session) (*x.Location, error) {
 	// save x.Location
 	loc := x.Location{
 		ChannelID: session.ChannelID,
 		GateID:    session.GateID,
+		Device:    session.Device,
+		LoginTime: time.Now().UnixNano(),
 	}
-	locKey := KeyLocation(session.Account, "")
-	err := r.cli.Set(locKey, loc.Bytes(), LocationExpired).Err()
-	if err != nil {
-		return err
-	}
-	// save session
+	locKey := KeyLocation(session.Account)
 	snKey := KeySession(session.ChannelID)
 	buf, _ := proto.Marshal(session)
-	err = r.cli.Set(snKey, buf, LocationExpired).Err()
-	if err != nil {
-		return err
+	deadline := time.Now().Add(LocationExpired).Unix()
+	// 位置、session与网关索引在同一个事务中保存
+	var prev *redis.Cmd
+	_, err := r.cli.TxPipelined(func(pipe redis.Pipeliner) error {
+		prev = addLocationScript.Eval(pipe, []string{locKey},
+			session.Device, loc.Bytes(), int(LocationExpired/time.Second))
+		pipe.Set(snKey, buf, LocationExpired)
+		pipe.ZAdd(KeyGateSessions(session.GateID), &redis.Z{
+			Score:  float64(deadline),
+			Member: gateMember(session.Account, session.ChannelID),
+		})
+		pipe.SAdd(KeyGates, session.GateID)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
 	}
-	return nil
+	return parseLocation(prev.Val()), nil
 }
 
 // Delete a session
 func (r *RedisStorage) Delete(account string, channelId string) error {
-	locKey := KeyLocation(account, "")
-	err := r.cli.Del(locKey).Err()
-	if err != nil {
-		return err
-	}
-
+	locKey := KeyLocation(account)
 	snKey := KeySession(channelId)
-	err = r.cli.Del(snKey).Err()
-	if err != nil {
-		return err
-	}
-	return nil
+	_, err := r.cli.TxPipelined(func(pipe redis.Pipeliner) error {
+		deleteLocationScript.Eval(pipe, []string{locKey}, channelId)
+		pipe.Del(snKey)
+		return nil
+	})
+	return err
 }
 
 // Get session by sessionID
@@ -73,19 +86,18 @@ func (r *RedisStorage) Get(ChannelID string) (*pkt.Session, error) {
 }
 
 func (r *RedisStorage) GetLocations(accounts ...string) ([]*x.Location, error) {
-	keys := KeyLocations(accounts...)
-	list, err := r.cli.MGet(keys...).Result()
+	cmds, err := r.cli.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, account := range accounts {
+			pipe.HGetAll(KeyLocation(account))
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 	var result = make([]*x.Location, 0)
-	for _, l := range list {
-		if l == nil {
-			continue
-		}
-		var loc x.Location
-		_ = loc.Unmarshal([]byte(l.(string)))
-		result = append(result, &loc)
+	for _, cmd := range cmds {
+		result = appendLocations(result, cmd.(*redis.StringStringMapCmd).Val())
 	}
 	if len(result) == 0 {
 		return nil, x.ErrSessionNil
@@ -93,9 +105,43 @@ func (r *RedisStorage) GetLocations(accounts ...string) ([]*x.Location, error) {
 	return result, nil
 }
 
+// GetAccountLocations 用一次pipeline读取所有账号的位置，按账号分组
+func (r *RedisStorage) GetAccountLocations(accounts ...string) (map[string][]*x.Location, error) {
+	var result = make(map[string][]*x.Location)
+	if len(accounts) == 0 {
+		return result, nil
+	}
+	cmds, err := r.cli.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, account := range accounts {
+			pipe.HGetAll(KeyLocation(account))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, cmd := range cmds {
+		if locs := appendLocations(nil, cmd.(*redis.StringStringMapCmd).Val()); len(locs) > 0 {
+			result[accounts[i]] = locs
+		}
+	}
+	return result, nil
+}
+
 func (r *RedisStorage) GetLocation(account string, device string) (*x.Location, error) {
-	key := KeyLocation(account, device)
-	bts, err := r.cli.Get(key).Bytes()
+	key := KeyLocation(account)
+	if device == "" {
+		all, err := r.cli.HGetAll(key).Result()
+		if err != nil {
+			return nil, err
+		}
+		locs := appendLocations(nil, all)
+		if len(locs) == 0 {
+			return nil, x.ErrSessionNil
+		}
+		return locs[0], nil
+	}
+	bts, err := r.cli.HGet(key, device).Bytes()
 	if err != nil {
 		if err == redis.Nil {
 			return nil, x.ErrSessionNil
@@ -107,24 +153,141 @@ func (r *RedisStorage) GetLocation(account string, device string) (*x.Location,
 	return &loc, nil
 }
 
+// Renew 续期网关上在线channel的会话
+func (r *RedisStorage) Renew(gateID string, leases ...*pkt.SessionLease) error {
+	if len(leases) == 0 {
+		return nil
+	}
+	deadline := float64(time.Now().Add(LocationExpired).Unix())
+	gateKey := KeyGateSessions(gateID)
+	_, err := r.cli.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, lease := range leases {
+			pipe.Expire(KeySession(lease.ChannelID), LocationExpired)
+			pipe.Expire(KeyLocation(lease.Account), LocationExpired)
+			// 已经被清理的会话不再加回索引
+			pipe.ZAddXX(gateKey, &redis.Z{
+				Score:  deadline,
+				Member: gateMember(lease.Account, lease.ChannelID),
+			})
+		}
+		pipe.SAdd(KeyGates, gateID)
+		return nil
+	})
+	return err
+}
+
+// ExpireGateway 网关断开后，它的会话最多再保留grace，期间网关恢复并续期则不受影响，返回受影响的账号
+func (r *RedisStorage) ExpireGateway(gateID string, grace time.Duration) ([]string, error) {
+	deadline := time.Now().Add(grace).Unix()
+	val, err := expireGatewayScript.Run(r.cli, []string{KeyGateSessions(gateID)}, deadline).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	return gateAccounts(val), nil
+}
+
+// Sweep 按网关索引删除租约已经过期的会话，返回被删除的会话
+func (r *RedisStorage) Sweep() ([]*pkt.Session, error) {
+	gates, err := r.cli.SMembers(KeyGates).Result()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	var swept []*pkt.Session
+	for _, gateID := range gates {
+		gateKey := KeyGateSessions(gateID)
+		for {
+			val, err := claimExpiredScript.Run(r.cli, []string{gateKey}, now, sweepBatch).Result()
+			if err != nil {
+				return swept, err
+			}
+			members, _ := val.([]interface{})
+			for _, member := range members {
+				account, channelID, ok := parseGateMember(member)
+				if !ok {
+					continue
+				}
+				if err = r.Delete(account, channelID); err != nil {
+					return swept, err
+				}
+				swept = append(swept, &pkt.Session{Account: account, ChannelID: channelID, GateID: gateID})
+			}
+			if len(members) < sweepBatch {
+				break
+			}
+		}
+		if n, _ := r.cli.ZCard(gateKey).Result(); n == 0 {
+			_ = r.cli.SRem(KeyGates, gateID).Err()
+		}
+	}
+	return swept, nil
+}
+
+func appendLocations(result []*x.Location, all map[string]string) []*x.Location {
+	for _, val := range all {
+		var loc x.Location
+		if err := loc.Unmarshal([]byte(val)); err != nil {
+			continue
+		}
+		result = append(result, &loc)
+	}
+	return result
+}
+
 // KeySession 转换为redis的key
 func KeySession(channel string) string {
 	return fmt.Sprintf("login:sn:%s", channel)
 }
 
-func KeyLocation(account, device string) string {
-	if device == "" {
-		return fmt.Sprintf("login:loc:%s", account)
+// KeyLocation 账号所有设备的位置，hash的field为设备类型
+func KeyLocation(account string) string {
+	return fmt.Sprintf("login:locs:%s", account)
+}
+
+// KeyGateSessions 网关上的会话索引，score为租约的到期时间
+func KeyGateSessions(gateID string) string {
+	return fmt.Sprintf("login:gate:%s", gateID)
+}
+
+// gateMember 网关索引的成员，由账号与ChannelID组成，账号使用2字节长度前缀
+func gateMember(account, channelID string) string {
+	buf := new(bytes.Buffer)
+	_ = endian.WriteShortBytes(buf, []byte(account))
+	buf.WriteString(channelID)
+	return buf.String()
+}
+
+func parseGateMember(member any) (account, channelID string, ok bool) {
+	var buf *bytes.Buffer
+	switch v := member.(type) {
+	case string:
+		buf = bytes.NewBufferString(v)
+	case []byte:
+		buf = bytes.NewBuffer(v)
+	default:
+		return "", "", false
 	}
-	return fmt.Sprintf("login:loc:%s:%s", account, device)
+	account, err := endian.ReadShortString(buf)
+	if err != nil {
+		return "", "", false
+	}
+	return account, buf.String(), true
 }
 
-func KeyLocations(accounts ...string) []string {
-	arr := make([]string, len(accounts))
-	for i, account := range accounts {
-		arr[i] = KeyLocation(account, "")
+// gateAccounts 解析脚本返回的网关索引成员中去重后的账号
+func gateAccounts(val any) []string {
+	members, _ := val.([]interface{})
+	var accounts []string
+	var exists = make(map[string]bool, len(members))
+	for _, member := range members {
+		account, _, ok := parseGateMember(member)
+		if !ok || exists[account] {
+			continue
+		}
+		exists[account] = true
+		accounts = append(accounts, account)
 	}
-	return arr
+	return accounts
 }
 
 //func (r *RedisStorage) GetBySingleFlight(ChannelID string, g *singleflight.Group) (any, error) {
@@ -36,8 +36,12 @@ func TestCRUD(t *testing.T) {
 	c, err := InitRedis(redisAddr, password)
 	assert.Nil(t, err)
 
-	s := NewRedisStorage(c)
-	err = s.Add(&pkt.Session{
+	testCRUD(t, NewRedisStorage(c))
+}
+
+// testCRUD 单机与集群的SessionStorage共用的用例
+func testCRUD(t *testing.T, s x.SessionStorage) {
+	_, err := s.Add(&pkt.Session{
 		ChannelID: "channel1",
 		GateID:    "gateway1",
 		Account:   "account1",
@@ -45,7 +49,7 @@ func TestCRUD(t *testing.T) {
 	})
 	assert.Nil(t, err)
 
-	_ = s.Add(&pkt.Session{
+	_, _ = s.Add(&pkt.Session{
 		ChannelID: "channel2",
 		GateID:    "gateway2",
 		Account:   "account2",
@@ -71,4 +75,90 @@ func TestCRUD(t *testing.T) {
 	assert.Equal(t, x.ErrSessionNil, err)
 	assert.Equal(t, 0, len(arr))
 
+	// 同一账号的另一个设备
+	_, _ = s.Add(&pkt.Session{
+		ChannelID: "channel3",
+		GateID:    "gateway2",
+		Account:   "account1",
+		Device:    "device3",
+	})
+	arr, err = s.GetLocations("account1")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(arr))
+
+	loc, err = s.GetLocation("account1", "device3")
+	assert.Nil(t, err)
+	assert.Equal(t, "channel3", loc.ChannelID)
+	assert.Equal(t, "device3", loc.Device)
+
+	// 位置不指向该channel时不会被删除
+	err = s.Delete("account1", "channel4")
+	assert.Nil(t, err)
+	arr, _ = s.GetLocations("account1")
+	assert.Equal(t, 2, len(arr))
+
+	err = s.Delete("account1", "channel1")
+	assert.Nil(t, err)
+	arr, _ = s.GetLocations("account1")
+	assert.Equal(t, 1, len(arr))
+	assert.Equal(t, "channel3", arr[0].ChannelID)
+
+	// 同一设备再次登录，返回之前的位置
+	prev, err := s.Add(&pkt.Session{
+		ChannelID: "channel5",
+		GateID:    "gateway1",
+		Account:   "account1",
+		Device:    "device3",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "channel3", prev.ChannelID)
+	// 旧channel的登出不会删除新的位置
+	err = s.Delete("account1", "channel3")
+	assert.Nil(t, err)
+	loc, err = s.GetLocation("account1", "device3")
+	assert.Nil(t, err)
+	assert.Equal(t, "channel5", loc.ChannelID)
+}
+
+func TestLease(t *testing.T) {
+	password := "Redis:0617"
+	c, err := InitRedis(redisAddr, password)
+	assert.Nil(t, err)
+
+	testLease(t, NewRedisStorage(c))
+}
+
+func testLease(t *testing.T, s x.SessionStorage) {
+	leaser := s.(x.SessionLeaser)
+	_, _ = s.Add(&pkt.Session{
+		ChannelID: "lease1",
+		GateID:    "lease_gateway1",
+		Account:   "lease_account",
+		Device:    "device1",
+	})
+	_, _ = s.Add(&pkt.Session{
+		ChannelID: "lease2",
+		GateID:    "lease_gateway2",
+		Account:   "lease_account",
+		Device:    "device2",
+	})
+	err := leaser.Renew("lease_gateway1", &pkt.SessionLease{ChannelID: "lease1", Account: "lease_account"})
+	assert.Nil(t, err)
+
+	// lease_gateway2宕机，它的会话立即过期
+	accounts, err := leaser.ExpireGateway("lease_gateway2", -time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"lease_account"}, accounts)
+	swept, err := leaser.Sweep()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(swept))
+	assert.Equal(t, "lease2", swept[0].ChannelID)
+	assert.Equal(t, "lease_account", swept[0].Account)
+
+	arr, err := s.GetLocations("lease_account")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(arr))
+	assert.Equal(t, "lease1", arr[0].ChannelID)
+	_, err = s.Get("lease2")
+	assert.Equal(t, x.ErrSessionNil, err)
 }
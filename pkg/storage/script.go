@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"X_IM/pkg/x"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// addLocationSrc 保存设备的位置，返回同一设备之前的位置
+// KEYS[1] 账号的位置hash，ARGV[1] 设备类型，ARGV[2] 位置，ARGV[3] 过期时间（秒）
+const addLocationSrc = `
+local prev = redis.call('HGET', KEYS[1], ARGV[1])
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+redis.call('EXPIRE', KEYS[1], ARGV[3])
+return prev
+`
+
+// deleteLocationSrc 只删除仍然指向ARGV[1]这个channel的设备位置，返回删除的数量。
+// 位置的第一个字段是ChannelID，格式为大端的2字节长度加内容，见x.Location.Bytes
+const deleteLocationSrc = `
+local all = redis.call('HGETALL', KEYS[1])
+local n = 0
+for i = 1, #all, 2 do
+	local loc = all[i + 1]
+	if #loc >= 2 then
+		local size = string.byte(loc, 1) * 256 + string.byte(loc, 2)
+		if string.sub(loc, 3, 2 + size) == ARGV[1] then
+			redis.call('HDEL', KEYS[1], all[i])
+			n = n + 1
+		end
+	end
+end
+return n
+`
+
+// expireGatewaySrc 把网关索引中晚于ARGV[1]到期的会话提前到ARGV[1]，返回修改的成员
+const expireGatewaySrc = `
+local members = redis.call('ZRANGEBYSCORE', KEYS[1], '(' .. ARGV[1], '+inf')
+for _, m in ipairs(members) do
+	redis.call('ZADD', KEYS[1], ARGV[1], m)
+end
+return members
+`
+
+// claimExpiredSrc 从网关索引中取出最多ARGV[2]个在ARGV[1]之前到期的会话，
+// 取出的成员同时从索引中删除，多个实例同时清理时不会重复处理
+const claimExpiredSrc = `
+local members = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+if #members > 0 then
+	redis.call('ZREM', KEYS[1], unpack(members))
+end
+return members
+`
+
+var (
+	addLocationScript    = redis.NewScript(addLocationSrc)
+	deleteLocationScript = redis.NewScript(deleteLocationSrc)
+	expireGatewayScript  = redis.NewScript(expireGatewaySrc)
+	claimExpiredScript   = redis.NewScript(claimExpiredSrc)
+)
+
+// parseLocation 解析脚本返回的位置，不存在时返回nil
+func parseLocation(val any) *x.Location {
+	var bts []byte
+	switch v := val.(type) {
+	case string:
+		bts = []byte(v)
+	case []byte:
+		bts = v
+	default:
+		return nil
+	}
+	var loc x.Location
+	if err := loc.Unmarshal(bts); err != nil {
+		return nil
+	}
+	return &loc
+}
@@ -11,13 +11,62 @@ const (
 const (
 	CommandLoginSignIn  = "login.signin"
 	CommandLoginSignOut = "login.signout"
+	// CommandLoginRenew 网关内部指令，批量续期在线channel的会话
+	CommandLoginRenew = "login.renew"
+
+	// 在线状态，由login服务根据会话推导
+	CommandPresenceQuery       = "login.presence.query"
+	CommandPresenceSubscribe   = "login.presence.subscribe"
+	CommandPresenceUnsubscribe = "login.presence.unsubscribe"
+	CommandPresenceStatus      = "login.presence.status"
+	// CommandPresenceNotify 在线状态变化时推送给订阅者
+	CommandPresenceNotify = "login.presence.notify"
 
 	CommandChatUserTalk  = "chat.user.talk"
 	CommandChatGroupTalk = "chat.group.talk"
 	CommandChatTalkAck   = "chat.talk.ack"
+	// CommandChatTalkRecall 撤回单聊或群聊消息
+	CommandChatTalkRecall = "chat.talk.recall"
+	// CommandChatTalkEdit 编辑单聊或群聊中的文本消息
+	CommandChatTalkEdit = "chat.talk.edit"
+	// CommandChatTalkExpired 阅后即焚的消息过期后推送给在线的参与者
+	CommandChatTalkExpired = "chat.talk.expired"
+	// 表情回应
+	CommandChatReactionAdd    = "chat.reaction.add"
+	CommandChatReactionRemove = "chat.reaction.remove"
+	// 定时发送的消息
+	CommandChatScheduledList   = "chat.scheduled.list"
+	CommandChatScheduledCancel = "chat.scheduled.cancel"
+	// 话题的回复与回复数
+	CommandChatThreadReplies = "chat.thread.replies"
+	CommandChatThreadCounts  = "chat.thread.counts"
+	// 已读回执与已读状态
+	CommandChatUserRead       = "chat.user.read"
+	CommandChatGroupRead      = "chat.group.read"
+	CommandChatUserReadState  = "chat.user.read.state"
+	CommandChatGroupReadState = "chat.group.read.state"
+	// 不保存的临时信号，如正在输入
+	CommandChatUserSignal  = "chat.user.signal"
+	CommandChatGroupSignal = "chat.group.signal"
+	// 注册或注销当前设备的离线推送token
+	CommandChatDeviceRegister   = "chat.device.register"
+	CommandChatDeviceUnregister = "chat.device.unregister"
+	// CommandChatTalkFallback 网关内部指令，推送重试失败后回退到离线同步
+	CommandChatTalkFallback = "chat.talk.fallback"
+
+	// CommandPushAck 客户端确认下行消息，由网关处理不再转发
+	CommandPushAck = "push.ack"
 
 	CommandOfflineIndex   = "chat.offline.index"
 	CommandOfflineContent = "chat.offline.content"
+	// CommandConversationList 按最近的消息分页读取会话列表与未读数
+	CommandConversationList = "chat.conversation.list"
+	// CommandConversationSync 按会话内的序号分页同步消息索引
+	CommandConversationSync = "chat.conversation.sync"
+	// CommandConversationHistory 按游标向前或向后分页读取会话的历史消息
+	CommandConversationHistory = "chat.conversation.history"
+	// CommandConversationMute 设置会话免打扰，离线时只在被提及时发送通知
+	CommandConversationMute = "chat.conversation.mute"
 
 	CommandGroupCreate  = "chat.group.create"
 	CommandGroupJoin    = "chat.group.join"
@@ -32,6 +81,8 @@ const (
 	MetaDestServer = "dest.logic"
 	// MetaDestChannels 消息将要送达的channels，即一条消息可推送给多个用户
 	MetaDestChannels = "dest.channels"
+	// MetaDeliverySeq 网关下发给channel的消息序号，channel内单调递增
+	MetaDeliverySeq = "delivery.seq"
 )
 
 type Protocol string
@@ -70,6 +121,24 @@ const (
 	OfflineSyncIndexCount     = 2000                //单次同步消息索引的数量
 	OfflineMessageExpiresIn   = 15                  // 离线消息过期时间
 	MessageMaxCountPerPage    = 200                 // 同步消息内容时每页的最大数据
+	PresenceMaxAccounts       = 200                 // 单次查询或订阅在线状态的最大账号数
+	PresenceMaxSubscriptions  = 1000                // 一个账号最多订阅的在线状态数
+	ReactionMaxLength         = 32                  // 表情回应的最大字节数
+	MessageMaxTTL             = time.Hour * 24 * 7  // 阅后即焚消息的最长存活时间
+	DeviceTokenMaxLength      = 200                 // 离线推送token的最大字节数
+	NotificationMaxBody       = 100                 // 离线推送通知正文的最大字符数
+	ClientMsgIDMaxLength      = 64                  // 客户端消息ID的最大字节数
+	MessageDedupWindow        = time.Minute * 10    // 按clientMsgID去重的时间窗口
+	MessageMaxBodyLength      = 5000                // 消息正文的最大字符数，与MessageContent.Body的列长度一致
+	MessageMaxExtraLength     = 500                 // 消息extra的最大字符数，与MessageContent.Extra的列长度一致
+	ScheduledLease            = time.Minute * 5     // 调度器领取定时消息后，超过sendAt这么久还未送达时其他实例可以接管
+	MessageMaxMentions        = 50                  // 一条群消息最多提及的成员数
+)
+
+// SignalType 临时信号类型
+const (
+	SignalTypeTyping = 1 // 正在输入
+	SignalTypePaused = 2 // 停止输入
 )
 
 // MessageType 消息类型，暂未支持
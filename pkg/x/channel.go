@@ -71,15 +71,16 @@ func (ch *ChannelImpl) writeLoop() error {
 			return err
 		}
 	}
-	return nil
+	// writeChan被Close关闭，剩余的消息已经写出，关闭连接让ReadLoop退出
+	return ch.Conn.Close()
 }
 
 // ID simpling server
 func (ch *ChannelImpl) ID() string { return ch.id }
 
-// Push 异步写数据
+// Push 异步写数据，writeLoop在NewChannel时已经启动，ReadLoop之前也可以写
 func (ch *ChannelImpl) Push(payload []byte) error {
-	if atomic.LoadInt32(&ch.state) != 1 {
+	if atomic.LoadInt32(&ch.state) == 2 {
 		return fmt.Errorf("channel %s has closed", ch.id)
 	}
 	// 异步写
@@ -165,6 +165,9 @@ func (s *DefaultServer) connHandler(rawConn net.Conn, gpool *ants.Pool) {
 	channel.SetReadWait(s.options.ReadWait)
 	channel.SetWriteWait(s.options.WriteWait)
 	s.Add(channel)
+	if lst, ok := s.StateListener.(ConnectListener); ok {
+		lst.Connect(channel.ID())
+	}
 
 	//gaugeWithLabel := channelTotalGauge.WithLabelValues(s.ServiceID(), s.ServiceName())
 	//gaugeWithLabel.Inc()
@@ -16,6 +16,10 @@ import (
 type Location struct {
 	ChannelID string
 	GateID    string
+	// Device 设备类型，同一账号的多个设备通过它区分
+	Device string
+	// LoginTime 登录时间（纳秒），多设备超出数量限制时先踢掉最早登录的设备
+	LoginTime int64
 }
 
 // Bytes 使用自定义的序列化方法
@@ -26,6 +30,8 @@ func (loc *Location) Bytes() []byte {
 	buf := new(bytes.Buffer)
 	_ = endian.WriteShortBytes(buf, []byte(loc.ChannelID))
 	_ = endian.WriteShortBytes(buf, []byte(loc.GateID))
+	_ = endian.WriteShortBytes(buf, []byte(loc.Device))
+	_ = endian.WriteUint64(buf, uint64(loc.LoginTime))
 	return buf.Bytes()
 }
 
@@ -43,5 +49,21 @@ func (loc *Location) Unmarshal(data []byte) (err error) {
 	if err != nil {
 		return
 	}
+	// 兼容没有设备类型的旧数据
+	if buf.Len() == 0 {
+		return
+	}
+	loc.Device, err = endian.ReadShortString(buf)
+	if err != nil {
+		return
+	}
+	if buf.Len() == 0 {
+		return
+	}
+	loginTime, err := endian.ReadUint64(buf)
+	if err != nil {
+		return
+	}
+	loc.LoginTime = int64(loginTime)
 	return
 }
@@ -114,6 +114,12 @@ type StateListener interface {
 	Disconnect(string) error
 }
 
+// ConnectListener 可选接口，StateListener实现后会在channel加入ChannelMap之后收到回调
+type ConnectListener interface {
+	// Connect 连接建立回调
+	Connect(string)
+}
+
 // MessageListener 监听消息
 type MessageListener interface {
 	// Receive 收到消息回调
@@ -3,20 +3,58 @@ package x
 import (
 	"X_IM/pkg/wire/pkt"
 	"errors"
+	"time"
 )
 
 var ErrSessionNil = errors.New("err:session nil")
 
 type SessionStorage interface {
-	// Add a session
-	Add(session *pkt.Session) error
-	// Delete a session
+	// Add a session, returns the previous location of the same device or nil
+	Add(session *pkt.Session) (*Location, error)
+	// Delete a session, the location of the account is removed only when it still points to channelId
 	Delete(account string, channelId string) error
 	// Get session by channelId
 	Get(channelId string) (*pkt.Session, error)
-	// GetLocations by accounts
+	// GetLocations of all devices by accounts
 	GetLocations(account ...string) ([]*Location, error)
 	// GetLocation by account and device.
-	// device parameter is not supported yet,there will be placed with ""
+	// if device is "", any one of the devices will be returned
 	GetLocation(account string, device string) (*Location, error)
 }
+
+// SessionLeaser 会话按租约过期，网关定期为在线的channel续期，
+// 每个网关的会话记录在单独的索引中，网关宕机后可以快速清理
+type SessionLeaser interface {
+	// Renew sessions of live channels on the gateway
+	Renew(gateID string, leases ...*pkt.SessionLease) error
+	// ExpireGateway keeps sessions of the gateway for at most grace, returns accounts of the affected sessions
+	ExpireGateway(gateID string, grace time.Duration) ([]string, error)
+	// Sweep deletes sessions whose lease is expired, returns the deleted sessions with only Account, ChannelID and GateID set
+	Sweep() ([]*pkt.Session, error)
+}
+
+// LocationBatcher 按账号分组批量读取位置，一次请求判断多个账号各自是否在线
+type LocationBatcher interface {
+	// GetAccountLocations returns locations of all devices grouped by account, offline accounts are omitted
+	GetAccountLocations(accounts ...string) (map[string][]*Location, error)
+}
+
+// PresenceStorage 保存自定义状态与在线状态的订阅关系，是否在线由SessionStorage推导
+type PresenceStorage interface {
+	// SetStatus sets the custom status text of the account, "" clears it
+	SetStatus(account string, status string) error
+	// GetStatus returns status texts of the accounts, accounts without status are omitted
+	GetStatus(accounts ...string) (map[string]string, error)
+	// Subscribe presence changes of the accounts
+	Subscribe(subscriber string, accounts ...string) error
+	// Unsubscribe presence changes of the accounts
+	Unsubscribe(subscriber string, accounts ...string) error
+	// Subscribers of the account
+	Subscribers(account string) ([]string, error)
+	// Subscriptions returns the accounts that the subscriber subscribes to
+	Subscriptions(subscriber string) ([]string, error)
+	// SetApp records the app that the account belongs to
+	SetApp(account string, app string) error
+	// GetApps returns apps of the accounts, accounts never signed in are omitted
+	GetApps(accounts ...string) (map[string]string, error)
+}